@@ -0,0 +1,379 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// JSON view of a [Unit], as served by /api/units and consumed by `tmaxhoc ctl`.
+type apiUnit struct {
+	Name             string    `json:"name"`
+	Description      string    `json:"description,omitempty"`
+	Kind             string    `json:"kind"`
+	Status           string    `json:"status"`
+	Hidden           bool      `json:"hidden,omitempty"`
+	Template         string    `json:"template,omitempty"`
+	Instance         string    `json:"instance,omitempty"`
+	ForceStopAllowed bool      `json:"forceStopAllowed,omitempty"`
+	RunningSubparts  int       `json:"runningSubparts,omitempty"`
+	TotalSubparts    int       `json:"totalSubparts,omitempty"`
+	Panes            []apiPane `json:"panes,omitempty"`
+	// Name of the tmux session config of a service, see [TmuxSessionConfig.Name], the socket of its tmux server, and the
+	// tmux binary the panel talks to it with.
+	TmuxSession    string `json:"tmuxSession,omitempty"`
+	TmuxSocket     string `json:"tmuxSocket,omitempty"`
+	TmuxExecutable string `json:"tmuxExecutable,omitempty"`
+	// How the service ended, while the panes it left behind are kept around, e.g. "Exited (1)".
+	Exited    string    `json:"exited,omitempty"`
+	DeadPanes []apiPane `json:"deadPanes,omitempty"`
+	// Name of the log rule that marked the service unhealthy.
+	Unhealthy string `json:"unhealthy,omitempty"`
+	// What the game server reports, see [GameStatusReporter].
+	Game *GameStatus `json:"game,omitempty"`
+	// Processes left behind by the service, see [Unitv4Service.orphans].
+	Orphans []trackedProcess `json:"orphans,omitempty"`
+}
+
+type apiPane struct {
+	Name string `json:"name"`
+	// Tmux pane id in the form of '%<int>', usable directly as a tmux target.
+	PaneId string `json:"paneId"`
+	Pid    int    `json:"pid"`
+	// Only for dead panes, e.g. "exit status 1".
+	Exit string `json:"exit,omitempty"`
+}
+
+type apiStatus struct {
+	// The default session first, see [UnitSystem.TmuxSessions].
+	TmuxSessions []apiTmuxSession `json:"tmuxSessions"`
+	MaxUnits     int              `json:"maxUnits,omitempty"`
+	Units        []apiUnit        `json:"units"`
+}
+
+type apiTmuxSession struct {
+	// See [TmuxSessionConfig.Name].
+	Name        string `json:"name"`
+	SessionName string `json:"sessionName"`
+	Socket      string `json:"socket"`
+}
+
+// Response body of the unit actions, when requested with `Accept: application/json`.
+type apiResult struct {
+	// Canonical name of the unit that the action was applied to, after resolving via [UnitSystem.MatchByName].
+	Unit string `json:"unit"`
+}
+
+func (s UnitStatus) String() string {
+	switch s {
+	case Stopped:
+		return "stopped"
+	case Stopping:
+		return "stopping"
+	case Running:
+		return "running"
+	}
+	return "unknown"
+}
+
+// Whether the client asked for a machine readable response, as opposed to a browser submitting a form.
+func wantsJSON(req *http.Request) bool {
+	return strings.Contains(req.Header.Get("Accept"), "application/json")
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Finish a successful unit action: API clients get a JSON result, browsers are sent back to the panel.
+func respondDone(w http.ResponseWriter, req *http.Request, unit *Unit) {
+	if wantsJSON(req) {
+		writeJSON(w, http.StatusOK, apiResult{Unit: unit.Name})
+		return
+	}
+	http.Redirect(w, req, "/", http.StatusFound)
+}
+
+// Resolve the "unit" form value of the request with [UnitSystem.MatchByName].
+// On failure, an error response is written and nil is returned.
+func resolveUnitParam(w http.ResponseWriter, req *http.Request) *Unit {
+	unit, err := unitsys.MatchByName(req.FormValue("unit"))
+	if err != nil {
+		var noSuchUnit *NoSuchUnitError
+		var ambiguous *AmbiguousUnitError
+		switch {
+		case errors.As(err, &noSuchUnit):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.As(err, &ambiguous):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		return nil
+	}
+	return unit
+}
+
+func newApiUnit(unit *Unit) apiUnit {
+	status := unit.v.status()
+	res := apiUnit{
+		Name:             unit.Name,
+		Description:      unit.Description,
+		Status:           status.String(),
+		Hidden:           unit.Hidden,
+		Template:         unit.Template,
+		Instance:         unit.Instance,
+		ForceStopAllowed: unit.v.forceStopAllowed(),
+	}
+
+	switch v := unit.v.(type) {
+	case *Unitv4Service:
+		res.Kind = "service"
+		res.TmuxSession = v.tmuxSession
+		res.TmuxSocket = v.session.SocketPath
+		res.TmuxExecutable = TmuxExecutable
+		for _, proc := range v.procs {
+			res.Panes = append(res.Panes, apiPane{
+				Name:   proc.Name,
+				PaneId: proc.targetPane(),
+				Pid:    proc.Pid,
+			})
+		}
+		res.Exited = v.exitSummary()
+		res.Unhealthy = v.unhealthy
+		res.Game = v.gameStatus()
+		res.Orphans = v.orphans
+		for _, proc := range v.deadPanes {
+			res.DeadPanes = append(res.DeadPanes, apiPane{
+				Name:   proc.Name,
+				PaneId: proc.targetPane(),
+				Pid:    proc.Pid,
+				Exit:   proc.Exit.String(),
+			})
+		}
+	case *Unitv4Group:
+		res.Kind = "target"
+		res.RunningSubparts = v.numReqsRunning()
+		res.TotalSubparts = len(v.requirements)
+	}
+
+	return res
+}
+
+// GET /api/units[?unit=<name>|match=<query>]
+//
+// With unit=, returns the single unit resolved by [UnitSystem.MatchByName]. With match=, returns every candidate of
+// [UnitSystem.MatchUnits], best first.
+func apiListUnits(w http.ResponseWriter, req *http.Request) {
+	modelLock.RLock()
+	defer modelLock.RUnlock()
+
+	res := apiStatus{
+		TmuxSessions: []apiTmuxSession{},
+		MaxUnits:     unitsys.MaxUnits,
+		Units:        []apiUnit{},
+	}
+	for _, ts := range unitsys.sessions {
+		res.TmuxSessions = append(res.TmuxSessions, apiTmuxSession{Name: ts.Name, SessionName: ts.SessionName, Socket: ts.SocketPath})
+	}
+
+	if req.FormValue("unit") != "" {
+		unit := resolveUnitParam(w, req)
+		if unit == nil {
+			return
+		}
+		res.Units = append(res.Units, newApiUnit(unit))
+	} else if query := req.FormValue("match"); query != "" {
+		candidates, err := unitsys.MatchUnits(query)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, c := range candidates {
+			res.Units = append(res.Units, newApiUnit(c.Unit))
+		}
+	} else {
+		for _, unit := range unitsys.units {
+			res.Units = append(res.Units, newApiUnit(unit))
+		}
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+// GET /api/unit-logs?unit=<name>[&lines=<n>][&follow=true]
+//
+// Serves the scrollback of every pane of a service unit as plain text. With follow=true, keeps the response open and
+// streams newly appeared lines until the unit stops or the client goes away. If the service isn't running but left
+// dead panes behind, serves their final output instead.
+//
+// New lines are read from the unit's output log if every pane is archived to it, see [outputLogFollower]. Otherwise
+// they are worked out from captures of the whole pane history, see [newPaneLines].
+func apiUnitLogs(w http.ResponseWriter, req *http.Request) {
+	unit := resolveUnitParam(w, req)
+	if unit == nil {
+		return
+	}
+	serv, ok := unit.v.(*Unitv4Service)
+	if !ok {
+		http.Error(w, "logs are only available for service units", http.StatusBadRequest)
+		return
+	}
+
+	lines := 100
+	if linesOpt := req.FormValue("lines"); linesOpt != "" {
+		n, err := strconv.Atoi(linesOpt)
+		if err != nil {
+			http.Error(w, "invalid option: lines='"+linesOpt+"'", http.StatusBadRequest)
+			return
+		}
+		lines = n
+	}
+	follow := req.FormValue("follow") == "true"
+
+	// Returns the dead panes if there are no live ones, along with alive=false
+	snapshotProcs := func() (procs []*TmuxProcess, alive bool) {
+		modelLock.RLock()
+		defer modelLock.RUnlock()
+		if len(serv.procs) == 0 {
+			return append([]*TmuxProcess(nil), serv.deadPanes...), false
+		}
+		return append([]*TmuxProcess(nil), serv.procs...), true
+	}
+
+	// Opened before the first capture, so that nothing printed in between is lost
+	var follower *outputLogFollower
+	if follow {
+		if path := outputLogOfPanes(serv); path != "" {
+			var err error
+			follower, err = followOutputLog(path)
+			if err == nil {
+				defer follower.close()
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	flusher, _ := w.(http.Flusher)
+
+	// LUT from [TmuxProcess.PaneId] to the last capture of that pane
+	seen := make(map[int][]string)
+	for first := true; ; first = false {
+		procs, alive := snapshotProcs()
+		if !first && follower != nil {
+			newLines, err := follower.poll()
+			for _, line := range newLines {
+				fmt.Fprintln(w, line)
+			}
+			if err != nil {
+				fmt.Fprintf(w, "[failed to follow the output log: %s]\n", err)
+				return
+			}
+			procs = nil
+		}
+		for _, proc := range procs {
+			historyLines := lines
+			if !first {
+				// The more there is to look for the previous capture in, the less likely it's scrolled out of it
+				historyLines = -1
+			}
+			captured, err := serv.session.CapturePane(proc, historyLines)
+			if err != nil {
+				// Most likely the pane just died, and PollAndPrune hasn't caught up yet
+				continue
+			}
+
+			prev, known := seen[proc.PaneId]
+			seen[proc.PaneId] = captured
+			newLines, found := captured, false
+			if known {
+				newLines, found = newPaneLines(prev, captured)
+				if !found {
+					fmt.Fprintf(w, "[%s: lost track of the output, some may be missing]\n", proc.Name)
+				}
+			}
+			if !found && lines >= 0 {
+				// The capture also contains the whole visible screen on top of the requested scrollback
+				newLines = captured[max(0, len(captured)-lines):]
+			}
+			for _, line := range newLines {
+				if len(procs) > 1 {
+					fmt.Fprintf(w, "%s | ", proc.Name)
+				}
+				fmt.Fprintln(w, line)
+			}
+		}
+
+		if !follow || !alive {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		select {
+		case <-req.Context().Done():
+			return
+		case <-time.After(1 * time.Second):
+		}
+	}
+}
+
+// Figure out which lines of cur have appeared since prev was captured, for two captures of the same pane.
+//
+// Tmux doesn't give us a stable line numbering (the history gets trimmed when it hits history-limit), so this works
+// by locating the tail of prev inside cur. The last line is allowed to have changed, since it is usually a prompt
+// that has been typed into. Returns false if the tail of prev isn't there anymore.
+func newPaneLines(prev, cur []string) ([]string, bool) {
+	const anchorLen = 3
+
+	find := func(anchor []string) int {
+		if len(anchor) == 0 {
+			return -1
+		}
+	outer:
+		for end := len(cur); end >= len(anchor); end-- {
+			for i := range anchor {
+				if cur[end-len(anchor)+i] != anchor[i] {
+					continue outer
+				}
+			}
+			return end
+		}
+		return -1
+	}
+
+	if len(prev) == 0 {
+		return cur, true
+	}
+	if end := find(prev[max(0, len(prev)-anchorLen):]); end != -1 {
+		return cur[end:], true
+	}
+	if end := find(prev[max(0, len(prev)-1-anchorLen) : len(prev)-1]); end != -1 {
+		return cur[end:], true
+	}
+	// History got cleared or scrolled way past what we've seen
+	return nil, false
+}
+
+// Path of the output log of serv, if every pane of it is archived there. Empty otherwise.
+func outputLogOfPanes(serv *Unitv4Service) string {
+	modelLock.RLock()
+	defer modelLock.RUnlock()
+	if unitsys.OutputLog == nil || len(serv.procs) == 0 {
+		return ""
+	}
+	for _, proc := range serv.procs {
+		if !proc.OutputPiped {
+			return ""
+		}
+	}
+	return filepath.Join(unitsys.outputLogDirOf(serv.unit), outputLogName)
+}
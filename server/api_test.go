@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestApiListUnitsTmux(t *testing.T) {
+	alice := &TmuxSession{Name: "alice", SessionName: "alice-games", SocketPath: "/tmp/tmux-1001/default"}
+	unit := &Unit{Name: "minecraft"}
+	unit.v = &Unitv4Service{unit: unit, session: alice, tmuxSession: "alice"}
+
+	prev, prevExe := unitsys, TmuxExecutable
+	unitsys = &UnitSystem{
+		units: []*Unit{unit},
+		sessions: []*TmuxSession{
+			{Name: defaultTmuxSession, SessionName: "tmaxhoc-managed", SocketPath: "/tmp/tmux-0/default"},
+			alice,
+		},
+	}
+	TmuxExecutable = "/opt/tmux/bin/tmux"
+	t.Cleanup(func() { unitsys, TmuxExecutable = prev, prevExe })
+
+	w := httptest.NewRecorder()
+	apiListUnits(w, httptest.NewRequest("GET", "/api/units", nil))
+	var res apiStatus
+	err := json.Unmarshal(w.Body.Bytes(), &res)
+	if err != nil {
+		t.Fatalf("response %q isn't JSON: %s", w.Body.String(), err)
+	}
+
+	wantSessions := []apiTmuxSession{
+		{Name: defaultTmuxSession, SessionName: "tmaxhoc-managed", Socket: "/tmp/tmux-0/default"},
+		{Name: "alice", SessionName: "alice-games", Socket: "/tmp/tmux-1001/default"},
+	}
+	if !reflect.DeepEqual(res.TmuxSessions, wantSessions) {
+		t.Errorf("tmuxSessions = %+v, want %+v", res.TmuxSessions, wantSessions)
+	}
+	if len(res.Units) != 1 {
+		t.Fatalf("units = %+v, want minecraft", res.Units)
+	}
+	u := res.Units[0]
+	if u.TmuxSession != "alice" || u.TmuxSocket != alice.SocketPath || u.TmuxExecutable != TmuxExecutable {
+		t.Errorf("minecraft is in %q on %q with %q, want alice on %s with %s", u.TmuxSession, u.TmuxSocket, u.TmuxExecutable, alice.SocketPath, TmuxExecutable)
+	}
+}
+
+func TestNewPaneLines(t *testing.T) {
+	tests := []struct {
+		name      string
+		prev, cur []string
+		want      []string
+		found     bool
+	}{
+		{name: "nothing new", prev: []string{"a", "b", "c"}, cur: []string{"a", "b", "c"}, want: []string{}, found: true},
+		{name: "appended", prev: []string{"a", "b", "c"}, cur: []string{"a", "b", "c", "d", "e"}, want: []string{"d", "e"}, found: true},
+		{name: "scrolled", prev: []string{"a", "b", "c", "d"}, cur: []string{"b", "c", "d", "e"}, want: []string{"e"}, found: true},
+		{name: "prompt typed into", prev: []string{"a", "b", "> "}, cur: []string{"a", "b", "> list", "nobody online", "> "}, want: []string{"> list", "nobody online", "> "}, found: true},
+		{name: "repeated lines", prev: []string{"tick", "tick", "tick"}, cur: []string{"tick", "tick", "tick", "tick"}, want: []string{}, found: true},
+		{name: "first capture", cur: []string{"a"}, want: []string{"a"}, found: true},
+		{name: "scrolled past", prev: []string{"a", "b", "c"}, cur: []string{"x", "y", "z"}, found: false},
+	}
+	for _, tt := range tests {
+		got, found := newPaneLines(tt.prev, tt.cur)
+		if found != tt.found || (found && strings.Join(got, "|") != strings.Join(tt.want, "|")) {
+			t.Errorf("%s: newPaneLines() = %q, %v, want %q, %v", tt.name, got, found, tt.want, tt.found)
+		}
+	}
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Periodic backups of a service's data, configured per unit.
+type BackupPolicy struct {
+	// Files or directories to put into the archive. Each is stored under its base name.
+	Paths []string
+	// Time between backups. Backups happen at multiples of this since the unix epoch, e.g. "1h" is on the hour.
+	Interval time.Duration
+
+	// How many of the most recent hours/days/weeks to keep one backup for, each.
+	// A backup is deleted once no rule wants to keep it. If all zero, backups are kept forever.
+	KeepHourly int
+	KeepDaily  int
+	KeepWeekly int
+
+	// Console commands typed into every pane of the service before the backup, e.g. "save-off", "save-all".
+	PreCommands []string
+	// How long to wait after PreCommands, for the server to finish writing out its data.
+	PreCommandsWait time.Duration
+	// Console commands typed into every pane of the service after the backup, e.g. "save-on".
+	PostCommands []string
+
+	// Don't make backups while the service isn't running, since the data couldn't have changed.
+	SkipWhenStopped bool
+
+	lastRun time.Time
+	// Error of the last backup, nil if it succeeded.
+	LastError error
+}
+
+// Written as manifest.json into every backup archive.
+type BackupManifest struct {
+	Unit    string               `json:"unit"`
+	Created time.Time            `json:"created"`
+	Paths   []string             `json:"paths"`
+	Files   []BackupManifestFile `json:"files"`
+}
+
+type BackupManifestFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256"`
+}
+
+const backupManifestName = "manifest.json"
+const backupTimeFormat = "20060102-150405"
+const backupSuffix = ".tar.gz"
+
+// Directory holding the backups of a unit.
+func (cfg *UnitSystem) backupDirOf(unit *Unit) string {
+	return filepath.Join(cfg.BackupDir, sanitizeTmuxName(unit.Name))
+}
+
+type backupArchive struct {
+	Path    string
+	Created time.Time
+
+	// Of archives made within the same second, see [backupArchiveName].
+	seq int
+}
+
+// e.g. minecraft-20240501-120000.tar.gz, or minecraft-20240501-120000-2.tar.gz for the second archive of that second.
+func backupArchiveName(unitName string, t time.Time, seq int) string {
+	name := sanitizeTmuxName(unitName) + "-" + t.Format(backupTimeFormat)
+	if seq > 1 {
+		name += "-" + strconv.Itoa(seq)
+	}
+	return name + backupSuffix
+}
+
+// Inverse of [backupArchiveName], except for the unit name which may contain anything.
+func parseBackupArchiveName(name string) (time.Time, int, bool) {
+	stamp, ok := strings.CutSuffix(name, backupSuffix)
+	if !ok {
+		return time.Time{}, 0, false
+	}
+	seq := 1
+	created, err := time.ParseInLocation(backupTimeFormat, stamp[max(0, len(stamp)-len(backupTimeFormat)):], time.Local)
+	if err != nil {
+		i := strings.LastIndexByte(stamp, '-')
+		if i < 0 {
+			return time.Time{}, 0, false
+		}
+		digits := stamp[i+1:]
+		seq, err = strconv.Atoi(digits)
+		if err != nil || seq < 2 || digits != strconv.Itoa(seq) {
+			return time.Time{}, 0, false
+		}
+		stamp = stamp[:i]
+		created, err = time.ParseInLocation(backupTimeFormat, stamp[max(0, len(stamp)-len(backupTimeFormat)):], time.Local)
+		if err != nil {
+			return time.Time{}, 0, false
+		}
+	}
+	return created, seq, true
+}
+
+// Existing backups of a unit, newest first.
+func listBackupArchives(dir string) ([]backupArchive, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var res []backupArchive
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, backupSuffix) {
+			continue
+		}
+		created, seq, ok := parseBackupArchiveName(name)
+		if !ok {
+			continue
+		}
+		res = append(res, backupArchive{Path: filepath.Join(dir, name), Created: created, seq: seq})
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Created.Equal(res[j].Created) {
+			return res[i].seq > res[j].seq
+		}
+		return res[i].Created.After(res[j].Created)
+	})
+	return res, nil
+}
+
+// Write a gzipped tarball of paths into dir, with a [BackupManifest] as its last entry. Returns the path of the archive,
+// named by [backupArchiveName]. The archive is written to a temporary file first, so it either doesn't exist or is
+// complete.
+func writeBackupArchive(dir string, unitName string, paths []string) (string, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	// Unique, in case another archive of the unit is being written at the same time
+	f, err := os.CreateTemp(dir, sanitizeTmuxName(unitName)+"-*.partial")
+	if err != nil {
+		return "", err
+	}
+	partial := f.Name()
+	defer os.Remove(partial)
+	// CreateTemp makes the file private, but archives are readable like any other file in the backup directory
+	err = f.Chmod(0644)
+	if err != nil {
+		f.Close()
+		return "", err
+	}
+
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	manifest := BackupManifest{
+		Unit:    unitName,
+		Created: time.Now(),
+		Paths:   paths,
+	}
+
+	for _, root := range paths {
+		root = filepath.Clean(root)
+		prefix := filepath.Base(root)
+		err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(root, p)
+			if err != nil {
+				return err
+			}
+			name := filepath.ToSlash(filepath.Join(prefix, rel))
+
+			mf, err := addToTar(tw, p, name, d)
+			if err != nil {
+				return fmt.Errorf("%s: %w", p, err)
+			}
+			if mf != nil {
+				manifest.Files = append(manifest.Files, *mf)
+			}
+			return nil
+		})
+		if err != nil {
+			f.Close()
+			return "", err
+		}
+	}
+
+	manifestJson, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		f.Close()
+		return "", err
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Name:    backupManifestName,
+		Mode:    0644,
+		Size:    int64(len(manifestJson)),
+		ModTime: manifest.Created,
+	})
+	if err == nil {
+		_, err = tw.Write(manifestJson)
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		f.Close()
+		return "", err
+	}
+	err = f.Close()
+	if err != nil {
+		return "", err
+	}
+
+	// Names only have a resolution of one second, so number archives made within the same second past the newest one
+	seq := 1
+	archives, _ := listBackupArchives(dir)
+	for _, a := range archives {
+		if a.Created.Equal(manifest.Created.Truncate(time.Second)) {
+			seq = max(seq, a.seq+1)
+		}
+	}
+	for ; ; seq++ {
+		dest := filepath.Join(dir, backupArchiveName(unitName, manifest.Created, seq))
+		// Unlike renaming, linking never replaces an archive that another writer just put there
+		err = os.Link(partial, dest)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return dest, nil
+	}
+}
+
+// Add a single file system entry to the archive. Returns the manifest entry for regular files, nil otherwise.
+func addToTar(tw *tar.Writer, p string, name string, d fs.DirEntry) (*BackupManifestFile, error) {
+	info, err := d.Info()
+	if err != nil {
+		return nil, err
+	}
+
+	link := ""
+	if info.Mode()&fs.ModeSymlink != 0 {
+		link, err = os.Readlink(p)
+		if err != nil {
+			return nil, err
+		}
+	} else if !info.Mode().IsRegular() && !info.IsDir() {
+		// Sockets, fifos and the like; nothing worth backing up
+		return nil, nil
+	}
+
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return nil, err
+	}
+	hdr.Name = name
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	err = tw.WriteHeader(hdr)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, nil
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	// The file may grow while we're reading it, if the server wasn't told to stop writing; the header is already
+	// written, so stick to the size in there
+	n, err := io.Copy(tw, io.TeeReader(io.LimitReader(f, hdr.Size), h))
+	if err != nil {
+		return nil, err
+	}
+	if n < hdr.Size {
+		return nil, fmt.Errorf("file shrunk while being backed up")
+	}
+
+	return &BackupManifestFile{
+		Name:   name,
+		Size:   n,
+		Sha256: hex.EncodeToString(h.Sum(nil)),
+	}, nil
+}
+
+// Pick which backups to delete under the Keep* rules of the policy, given archives newest first.
+func (bp *BackupPolicy) expiredArchives(archives []backupArchive) []backupArchive {
+	if bp.KeepHourly == 0 && bp.KeepDaily == 0 && bp.KeepWeekly == 0 {
+		return nil
+	}
+
+	keep := make([]bool, len(archives))
+	rule := func(n int, period func(time.Time) string) {
+		seen := make(map[string]bool)
+		for i, a := range archives {
+			if len(seen) >= n {
+				break
+			}
+			p := period(a.Created)
+			if !seen[p] {
+				// Newest backup of the period
+				seen[p] = true
+				keep[i] = true
+			}
+		}
+	}
+	rule(bp.KeepHourly, func(t time.Time) string { return t.Format("2006010215") })
+	rule(bp.KeepDaily, func(t time.Time) string { return t.Format("20060102") })
+	rule(bp.KeepWeekly, func(t time.Time) string {
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-%d", year, week)
+	})
+
+	var res []backupArchive
+	for i, a := range archives {
+		// Never delete the latest backup, no matter what the rules say
+		if !keep[i] && i != 0 {
+			res = append(res, a)
+		}
+	}
+	return res
+}
+
+// When the next backup is due: the first multiple of Interval since the unix epoch after the last run.
+func (bp *BackupPolicy) nextRun() time.Time {
+	if bp.lastRun.IsZero() {
+		return time.Time{}
+	}
+	epoch := time.Unix(0, 0)
+	since := bp.lastRun.Sub(epoch)
+	return epoch.Add(since - since%bp.Interval + bp.Interval)
+}
+
+func sendConsoleCommands(serv *Unitv4Service, commands []string) {
+	for _, proc := range serv.procs {
+		for _, command := range commands {
+			err := serv.session.SendKeys(proc, command, "Enter")
+			if err != nil {
+				fmt.Printf("[WARN] failed to send '%s' to %s: %s\n", command, proc.targetPane(), err)
+			}
+		}
+	}
+}
+
+// Make a backup of the unit now, and then delete old backups according to the retention rules.
+// Must be called without holding modelLock, since archiving may take a long time.
+func (cfg *UnitSystem) RunBackup(unit *Unit) error {
+	serv := unit.v.(*Unitv4Service)
+	bp := serv.backup
+
+	modelLock.Lock()
+	running := serv.status() == Running
+	if running {
+		sendConsoleCommands(serv, bp.PreCommands)
+	}
+	modelLock.Unlock()
+
+	if running && len(bp.PreCommands) > 0 {
+		time.Sleep(bp.PreCommandsWait)
+	}
+
+	dir := cfg.backupDirOf(unit)
+	dest, err := writeBackupArchive(dir, unit.Name, bp.Paths)
+
+	if running {
+		modelLock.Lock()
+		sendConsoleCommands(serv, bp.PostCommands)
+		modelLock.Unlock()
+	}
+
+	if err != nil {
+		return err
+	}
+	fmt.Printf("backed up %s to %s\n", unit.Name, dest)
+
+	archives, err := listBackupArchives(dir)
+	if err != nil {
+		return err
+	}
+	for _, a := range bp.expiredArchives(archives) {
+		err := os.Remove(a.Path)
+		if err != nil {
+			fmt.Printf("[WARN] failed to delete expired backup %s: %s\n", a.Path, err)
+		} else {
+			fmt.Printf("deleted expired backup %s\n", a.Path)
+		}
+	}
+
+	return nil
+}
+
+// Units with a [BackupPolicy], which may change as templates are instantiated at runtime.
+func (cfg *UnitSystem) backedUpUnits() []*Unit {
+	modelLock.RLock()
+	defer modelLock.RUnlock()
+
+	var res []*Unit
+	for _, unit := range cfg.units {
+		if serv, ok := unit.v.(*Unitv4Service); ok && serv.backup != nil {
+			res = append(res, unit)
+		}
+	}
+	return res
+}
+
+// Run scheduled backups until stop is closed.
+func runBackupScheduler(unitsys *UnitSystem, stop <-chan bool) {
+	ticker := time.NewTicker(1 * time.Minute)
+	defer ticker.Stop()
+	for {
+		for _, unit := range unitsys.backedUpUnits() {
+			serv := unit.v.(*Unitv4Service)
+			bp := serv.backup
+			if bp.lastRun.IsZero() {
+				// Pick up where we left off before a restart
+				archives, err := listBackupArchives(unitsys.backupDirOf(unit))
+				if err == nil && len(archives) > 0 {
+					bp.lastRun = archives[0].Created
+				}
+			}
+			if time.Now().Before(bp.nextRun()) {
+				continue
+			}
+
+			modelLock.RLock()
+			busy := serv.busy
+			skip := bp.SkipWhenStopped && serv.status() == Stopped
+			modelLock.RUnlock()
+			if busy != "" {
+				// Try again next tick, once e.g. a snapshot restore is done with the data
+				fmt.Printf("postponing backup of %s while %s\n", unit.Name, busy)
+				continue
+			}
+			bp.lastRun = time.Now()
+			if skip {
+				continue
+			}
+
+			bp.LastError = unitsys.RunBackup(unit)
+			if bp.LastError != nil {
+				fmt.Printf("[ERROR] backup of %s failed: %s\n", unit.Name, bp.LastError)
+				modelLock.Lock()
+				unitsys.emit(UnitEvent{Unit: unit.Name, Kind: EventBackupFailed, Detail: bp.LastError.Error()})
+				modelLock.Unlock()
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
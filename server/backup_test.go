@@ -0,0 +1,183 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestExpiredArchives(t *testing.T) {
+	at := func(s string) backupArchive {
+		created, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return backupArchive{Path: s, Created: created}
+	}
+
+	tests := []struct {
+		name   string
+		policy BackupPolicy
+		// Newest first
+		archives []backupArchive
+		want     []string
+	}{
+		{
+			name:     "keep forever",
+			policy:   BackupPolicy{},
+			archives: []backupArchive{at("2024-01-10 12:00"), at("2020-01-01 00:00")},
+			want:     nil,
+		},
+		{
+			name:   "hourly",
+			policy: BackupPolicy{KeepHourly: 2},
+			archives: []backupArchive{
+				at("2024-01-10 12:30"), at("2024-01-10 12:00"), at("2024-01-10 11:00"), at("2024-01-10 10:00"),
+			},
+			want: []string{"2024-01-10 12:00", "2024-01-10 10:00"},
+		},
+		{
+			name:   "daily",
+			policy: BackupPolicy{KeepDaily: 2},
+			archives: []backupArchive{
+				at("2024-01-10 10:00"), at("2024-01-10 09:00"), at("2024-01-09 23:00"), at("2024-01-08 12:00"),
+			},
+			want: []string{"2024-01-10 09:00", "2024-01-08 12:00"},
+		},
+		{
+			name:   "weekly",
+			policy: BackupPolicy{KeepWeekly: 2},
+			archives: []backupArchive{
+				// Wednesday, Tuesday of the same week, the week before, and the one before that
+				at("2024-01-10 10:00"), at("2024-01-09 10:00"), at("2024-01-03 10:00"), at("2023-12-27 10:00"),
+			},
+			want: []string{"2024-01-09 10:00", "2023-12-27 10:00"},
+		},
+		{
+			name:   "rules combined",
+			policy: BackupPolicy{KeepHourly: 2, KeepDaily: 2},
+			archives: []backupArchive{
+				at("2024-01-10 12:00"), at("2024-01-10 11:00"), at("2024-01-10 10:00"), at("2024-01-09 23:00"),
+				at("2024-01-09 22:00"), at("2024-01-08 12:00"),
+			},
+			want: []string{"2024-01-10 10:00", "2024-01-09 22:00", "2024-01-08 12:00"},
+		},
+		{
+			name:     "nothing to delete",
+			policy:   BackupPolicy{KeepDaily: 7},
+			archives: []backupArchive{at("2024-01-10 12:00"), at("2024-01-09 12:00")},
+			want:     nil,
+		},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, a := range tt.policy.expiredArchives(tt.archives) {
+			got = append(got, a.Path)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: expiredArchives() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBackupNextRun(t *testing.T) {
+	at := func(s string) time.Time {
+		res, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	tests := []struct {
+		lastRun  string
+		interval time.Duration
+		want     string
+	}{
+		{lastRun: "2024-05-01 12:34", interval: time.Hour, want: "2024-05-01 13:00"},
+		{lastRun: "2024-05-01 13:00", interval: time.Hour, want: "2024-05-01 14:00"},
+		{lastRun: "2024-05-01 12:34", interval: 6 * time.Hour, want: "2024-05-01 18:00"},
+		// The unix epoch was a Thursday, unlike year 1 that Go's zero time is in
+		{lastRun: "2024-05-01 12:34", interval: 7 * 24 * time.Hour, want: "2024-05-02 00:00"},
+	}
+	for _, tt := range tests {
+		bp := &BackupPolicy{Interval: tt.interval, lastRun: at(tt.lastRun)}
+		if got := bp.nextRun(); !got.Equal(at(tt.want)) {
+			t.Errorf("nextRun() after %s every %s = %s, want %s", tt.lastRun, tt.interval, got, tt.want)
+		}
+	}
+	if got := (&BackupPolicy{Interval: time.Hour}).nextRun(); !got.IsZero() {
+		t.Errorf("nextRun() without a last run = %s, want right away", got)
+	}
+}
+
+func TestBackupArchiveName(t *testing.T) {
+	created := time.Date(2024, 5, 1, 12, 0, 0, 0, time.Local)
+	tests := []struct {
+		unit string
+		seq  int
+		want string
+	}{
+		{unit: "minecraft", seq: 1, want: "minecraft-20240501-120000.tar.gz"},
+		{unit: "minecraft", seq: 2, want: "minecraft-20240501-120000-2.tar.gz"},
+		// Dashes in the unit name don't get in the way
+		{unit: "dst-2", seq: 13, want: "dst-2-20240501-120000-13.tar.gz"},
+	}
+	for _, tt := range tests {
+		name := backupArchiveName(tt.unit, created, tt.seq)
+		if name != tt.want {
+			t.Errorf("backupArchiveName(%q, %d) = %q, want %q", tt.unit, tt.seq, name, tt.want)
+		}
+		got, seq, ok := parseBackupArchiveName(name)
+		if !ok || !got.Equal(created) || seq != tt.seq {
+			t.Errorf("parseBackupArchiveName(%q) = %s, %d, %v", name, got, seq, ok)
+		}
+	}
+
+	for _, name := range []string{"minecraft.tar.gz", "minecraft-20240501-120000-1.tar.gz", "minecraft-20240501-120000-02.tar.gz", "minecraft-20240501-120000-x.tar.gz", "minecraft-20240501-120000.partial"} {
+		if _, _, ok := parseBackupArchiveName(name); ok {
+			t.Errorf("parseBackupArchiveName(%q) succeeded", name)
+		}
+	}
+}
+
+func TestWriteBackupArchiveSameSecond(t *testing.T) {
+	data := t.TempDir()
+	err := os.WriteFile(filepath.Join(data, "level.dat"), []byte("hello"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+
+	var written []string
+	for i := 0; i < 3; i++ {
+		p, err := writeBackupArchive(dir, "minecraft", []string{data})
+		if err != nil {
+			t.Fatal(err)
+		}
+		written = append(written, p)
+	}
+
+	archives, err := listBackupArchives(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var listed []string
+	for _, a := range archives {
+		listed = append(listed, a.Path)
+	}
+	// Newest first. Could cross into the next second, but names must never be reused either way
+	slices.Reverse(written)
+	if !slices.Equal(listed, written) {
+		t.Errorf("listBackupArchives() = %v, want %v", listed, written)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Errorf("backup directory has %d entries, want 3 archives and no leftovers", len(entries))
+	}
+}
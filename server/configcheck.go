@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+	"github.com/pelletier/go-toml/v2/unstable"
+)
+
+// A single thing wrong with the config file.
+type ConfigProblem struct {
+	File string
+	// Position in the file, starting at 1. Zero if not known.
+	Line   int
+	Column int
+	// Name of the unit this problem is about, if any.
+	Unit string
+	Msg  string
+	// If true, the panel can still run with this problem; only `check-config` fails on warnings.
+	Warning bool
+}
+
+func (p ConfigProblem) String() string {
+	var sb strings.Builder
+	sb.WriteString(p.File)
+	if p.Line > 0 {
+		fmt.Fprintf(&sb, ":%d", p.Line)
+		if p.Column > 0 {
+			fmt.Fprintf(&sb, ":%d", p.Column)
+		}
+	}
+	sb.WriteString(": ")
+	if p.Warning {
+		sb.WriteString("warning: ")
+	}
+	if p.Unit != "" {
+		sb.WriteString("unit '" + p.Unit + "': ")
+	}
+	sb.WriteString(p.Msg)
+	return sb.String()
+}
+
+type ConfigErrors struct {
+	Problems []ConfigProblem
+}
+
+func (e *ConfigErrors) Error() string {
+	lines := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		lines[i] = p.String()
+	}
+	return "invalid config:\n" + strings.Join(lines, "\n")
+}
+
+// Where something was defined in the config files.
+type configOrigin struct {
+	File string
+	Line int
+}
+
+// Collects [ConfigProblem]s while loading the config.
+type configChecker struct {
+	file string
+	// Location of the [[Units]] header of the i-th unit, across the main config file and all included files.
+	unitOrigins []configOrigin
+
+	// Set for checkers made by forUnit()
+	unitIndex int
+	unitName  string
+	parent    *configChecker
+
+	problems []ConfigProblem
+}
+
+func (ck *configChecker) add(p ConfigProblem) {
+	if ck.parent != nil {
+		ck.parent.add(p)
+		return
+	}
+	if p.File == "" {
+		p.File = ck.file
+	}
+	ck.problems = append(ck.problems, p)
+}
+
+func (ck *configChecker) report(warning bool, format string, args ...any) {
+	p := ConfigProblem{
+		Msg:     fmt.Sprintf(format, args...),
+		Warning: warning,
+	}
+	if ck.parent != nil {
+		p.Unit = ck.unitName
+		if p.Unit == "" {
+			p.Unit = fmt.Sprintf("#%d", ck.unitIndex+1)
+		}
+		if ck.unitIndex < len(ck.parent.unitOrigins) {
+			origin := ck.parent.unitOrigins[ck.unitIndex]
+			p.File = origin.File
+			p.Line = origin.Line
+		}
+	}
+	ck.add(p)
+}
+
+func (ck *configChecker) errorf(format string, args ...any) {
+	ck.report(false, format, args...)
+}
+
+func (ck *configChecker) warnf(format string, args ...any) {
+	ck.report(true, format, args...)
+}
+
+// Make a checker that attributes its problems to the i-th unit of the config.
+func (ck *configChecker) forUnit(i int, name string) *configChecker {
+	return &configChecker{
+		unitIndex: i,
+		unitName:  name,
+		parent:    ck,
+	}
+}
+
+// Decode a config file strictly, reporting unknown keys as warnings and anything else as errors.
+// Returns false if the file couldn't be decoded at all.
+func (ck *configChecker) decodeFile(file string, data []byte, v any) bool {
+	err := toml.NewDecoder(bytes.NewReader(data)).DisallowUnknownFields().Decode(v)
+	if err == nil {
+		return true
+	}
+
+	var strictErr *toml.StrictMissingError
+	var decodeErr *toml.DecodeError
+	switch {
+	case errors.As(err, &strictErr):
+		// Everything else is still decoded, so keep going
+		for _, e := range strictErr.Errors {
+			line, col := e.Position()
+			ck.add(ConfigProblem{
+				File:    file,
+				Line:    line,
+				Column:  col,
+				Msg:     "unknown key '" + strings.Join(e.Key(), ".") + "'",
+				Warning: true,
+			})
+		}
+		return true
+	case errors.As(err, &decodeErr):
+		line, col := decodeErr.Position()
+		ck.add(ConfigProblem{File: file, Line: line, Column: col, Msg: decodeErr.Error()})
+	default:
+		ck.add(ConfigProblem{File: file, Msg: err.Error()})
+	}
+	return false
+}
+
+// Record where the next n units come from, which are all the units defined in the file.
+func (ck *configChecker) addUnitOrigins(file string, data []byte, n int) {
+	lines := tomlArrayTableLines(data, "Units")
+	for i := 0; i < n; i++ {
+		origin := configOrigin{File: file}
+		if i < len(lines) {
+			origin.Line = lines[i]
+		}
+		ck.unitOrigins = append(ck.unitOrigins, origin)
+	}
+}
+
+// Find the line of every [[name]] array table header in the document, in order.
+// Stops at the first syntax error, which the decoder will report on its own.
+func tomlArrayTableLines(data []byte, name string) []int {
+	var res []int
+
+	p := unstable.Parser{}
+	p.Reset(data)
+	for p.NextExpression() {
+		expr := p.Expression()
+		if expr.Kind != unstable.ArrayTable {
+			continue
+		}
+
+		it := expr.Key()
+		if !it.Next() {
+			continue
+		}
+		first := it.Node()
+		if string(first.Data) != name || !it.IsLast() {
+			continue
+		}
+		res = append(res, p.Shape(first.Raw).Start.Line)
+	}
+
+	return res
+}
+
+// Names of the units along a cycle of requirements that starts and ends at start, or nil if there is none.
+func findRequirementCycle(start *Unit) []string {
+	var path []string
+	visited := make(map[*Unit]bool)
+
+	var visit func(unit *Unit) bool
+	visit = func(unit *Unit) bool {
+		path = append(path, unit.Name)
+		if grp, ok := unit.v.(*Unitv4Group); ok {
+			for _, req := range grp.requirements {
+				if req == start {
+					path = append(path, req.Name)
+					return true
+				}
+				if !visited[req] {
+					visited[req] = true
+					if visit(req) {
+						return true
+					}
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		return false
+	}
+
+	if visit(start) {
+		return path
+	}
+	return nil
+}
+
+// `tmaxhoc check-config`: report everything wrong with the config file, and exit non-zero if there is anything.
+func checkConfigMain(args []string) int {
+	fs := flag.NewFlagSet("check-config", flag.ExitOnError)
+	configFile := fs.String("config", "config.toml", "Path to the config file")
+	fs.Parse(args)
+
+	_, problems := loadConfig(*configFile)
+	for _, p := range problems {
+		fmt.Fprintln(os.Stderr, p.String())
+	}
+
+	if len(problems) > 0 {
+		fmt.Fprintf(os.Stderr, "%d problem(s) found\n", len(problems))
+		return 1
+	}
+	fmt.Printf("%s: OK\n", *configFile)
+	return 0
+}
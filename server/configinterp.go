@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// Interpolation of ${...} references in config strings, so that secrets can live outside of the config file:
+//
+//	${NAME}             value of the environment variable NAME, which must be set
+//	${NAME:-default}    value of NAME, or default if it is unset or empty
+//	${file:/some/path}  contents of the file, without the trailing newline; relative to the config file's directory
+//	$${                 a literal "${", e.g. for shell commands
+//
+// The config as written, before interpolation, is what gets echoed back by /api/config, so the values never leave
+// the panel. On top of that, /api/config masks the references themselves and every field tagged `secret:"true"`.
+
+// Call f on every string reachable from v, which must be settable, and replace the string with its result.
+func mapConfigStrings(v reflect.Value, f func(string) string) {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(f(v.String()))
+	case reflect.Pointer:
+		if !v.IsNil() {
+			mapConfigStrings(v.Elem(), f)
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).IsExported() {
+				mapConfigStrings(v.Field(i), f)
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			mapConfigStrings(v.Index(i), f)
+		}
+	case reflect.Map:
+		// Map elements aren't addressable, so copy them out and back in
+		iter := v.MapRange()
+		for iter.Next() {
+			elem := reflect.New(iter.Value().Type()).Elem()
+			elem.Set(iter.Value())
+			mapConfigStrings(elem, f)
+			v.SetMapIndex(iter.Key(), elem)
+		}
+	}
+}
+
+// Copy of a config struct that shares nothing with the original.
+func cloneConfig[T any](v *T) (*T, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var res T
+	err = json.Unmarshal(data, &res)
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Resolve a single ${...} reference, given what's between the braces.
+func resolveConfigRef(ref string, configDir string) (string, error) {
+	if path, ok := strings.CutPrefix(ref, "file:"); ok {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(configDir, path)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+
+	name, def, hasDefault := strings.Cut(ref, ":-")
+	if len(name) == 0 {
+		return "", errors.New("empty variable name in '${" + ref + "}'")
+	}
+	value, set := os.LookupEnv(name)
+	if hasDefault && len(value) == 0 {
+		return def, nil
+	}
+	if !set {
+		return "", errors.New("environment variable " + name + " is not set")
+	}
+	return value, nil
+}
+
+// Expand every ${...} reference in s.
+func interpolateConfigString(s string, configDir string) (string, error) {
+	if !strings.Contains(s, "$") {
+		return s, nil
+	}
+
+	var sb strings.Builder
+	for {
+		i := strings.Index(s, "${")
+		if i == -1 {
+			sb.WriteString(s)
+			break
+		}
+		if i > 0 && s[i-1] == '$' {
+			// Escaped, drop one of the $
+			sb.WriteString(s[:i])
+			sb.WriteString("{")
+			s = s[i+2:]
+			continue
+		}
+		sb.WriteString(s[:i])
+
+		end := strings.IndexByte(s[i:], '}')
+		if end == -1 {
+			return "", errors.New("unterminated '${' in '" + s[i:] + "'")
+		}
+		value, err := resolveConfigRef(s[i+2:i+end], configDir)
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString(value)
+		s = s[i+end+1:]
+	}
+	return sb.String(), nil
+}
+
+// Expand references in every string of the config, reporting the ones that can't be resolved.
+func interpolateConfig(ck *configChecker, configFile string, cfg *config) {
+	configDir := filepath.Dir(configFile)
+	interpolate := func(ck *configChecker) func(string) string {
+		return func(s string) string {
+			res, err := interpolateConfigString(s, configDir)
+			if err != nil {
+				ck.errorf("%s", err)
+				return s
+			}
+			return res
+		}
+	}
+
+	v := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		switch {
+		case !field.IsExported():
+		case field.Name == "Units":
+			for j := range cfg.Units {
+				mapConfigStrings(reflect.ValueOf(&cfg.Units[j]).Elem(), interpolate(ck.forUnit(j, cfg.Units[j].Name)))
+			}
+		default:
+			mapConfigStrings(v.Field(i), interpolate(ck))
+		}
+	}
+}
+
+// Shown by /api/config instead of secrets.
+const maskedSecret = "********"
+
+// Replace the strings reachable from v, which must be settable, that are or might be secret with [maskedSecret]: those
+// in fields tagged `secret:"true"`, and those with ${...} references in them. Empty strings are left alone, so that it
+// still shows whether they are set.
+func maskConfigSecrets(v reflect.Value) {
+	mask := func(s string) string {
+		if len(s) == 0 {
+			return s
+		}
+		return maskedSecret
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		if strings.Contains(v.String(), "${") {
+			v.SetString(maskedSecret)
+		}
+	case reflect.Pointer:
+		if !v.IsNil() {
+			maskConfigSecrets(v.Elem())
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			switch {
+			case !field.IsExported():
+			case field.Tag.Get("secret") == "true":
+				mapConfigStrings(v.Field(i), mask)
+			default:
+				maskConfigSecrets(v.Field(i))
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			maskConfigSecrets(v.Index(i))
+		}
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			elem := reflect.New(iter.Value().Type()).Elem()
+			elem.Set(iter.Value())
+			maskConfigSecrets(elem)
+			v.SetMapIndex(iter.Key(), elem)
+		}
+	}
+}
+
+// GET /api/config
+//
+// The config the panel is running with, as JSON. Strings are shown as written in the config file, except for secrets,
+// see [maskConfigSecrets].
+func apiShowConfig(w http.ResponseWriter, req *http.Request) {
+	masked, err := cloneConfig(unitsys.rawConfig)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	maskConfigSecrets(reflect.ValueOf(masked).Elem())
+	writeJSON(w, http.StatusOK, masked)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestInterpolateConfigString(t *testing.T) {
+	dir := t.TempDir()
+	secret := filepath.Join(dir, "secret.txt")
+	err := os.WriteFile(secret, []byte("hunter2\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TMAXHOC_TEST_VAR", "value")
+	t.Setenv("TMAXHOC_TEST_EMPTY", "")
+
+	tests := []struct {
+		in   string
+		want string
+		// Whether interpolation should fail
+		err bool
+	}{
+		{in: "plain", want: "plain"},
+		{in: "costs $5", want: "costs $5"},
+		{in: "${TMAXHOC_TEST_VAR}", want: "value"},
+		{in: "a-${TMAXHOC_TEST_VAR}-b-${TMAXHOC_TEST_VAR}", want: "a-value-b-value"},
+		{in: "${TMAXHOC_TEST_UNSET:-default}", want: "default"},
+		{in: "${TMAXHOC_TEST_EMPTY:-default}", want: "default"},
+		{in: "${TMAXHOC_TEST_VAR:-default}", want: "value"},
+		{in: "${TMAXHOC_TEST_EMPTY}", want: ""},
+		{in: "${file:secret.txt}", want: "hunter2"},
+		{in: "${file:" + secret + "}", want: "hunter2"},
+		{in: "$${HOME}", want: "${HOME}"},
+		{in: "echo $${TMAXHOC_TEST_VAR} ${TMAXHOC_TEST_VAR}", want: "echo ${TMAXHOC_TEST_VAR} value"},
+		{in: "${TMAXHOC_TEST_UNSET}", err: true},
+		{in: "${}", err: true},
+		{in: "${:-default}", err: true},
+		{in: "${TMAXHOC_TEST_VAR", err: true},
+		{in: "${file:missing.txt}", err: true},
+	}
+	for _, tt := range tests {
+		got, err := interpolateConfigString(tt.in, dir)
+		switch {
+		case tt.err && err == nil:
+			t.Errorf("interpolateConfigString(%q) = %q, want an error", tt.in, got)
+		case !tt.err && (err != nil || got != tt.want):
+			t.Errorf("interpolateConfigString(%q) = %q, %v, want %q", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestApiShowConfigMasksSecrets(t *testing.T) {
+	secrets := []string{"smtp-hunter2", "rcon-hunter2", "valheim-hunter2", "Bearer webhook-token", "discord-token"}
+	cfg := &config{
+		Tmux: configTmux{SessionName: "tmaxhoc-managed"},
+		Units: []configUnit{
+			{Name: "Factorio", Service: &configServiceUnit{Factorio: &SlfdrvFactorio{RconPort: 27015, RconPassword: "rcon-hunter2"}}},
+			{Name: "Valheim", Service: &configServiceUnit{Valheim: &SlfdrvValheim{Name: "My server", Password: "valheim-hunter2"}}},
+			{Name: "Minecraft", Service: &configServiceUnit{StartCommand: []string{"./server", "--password", "${MC_PASSWORD}"}}},
+		},
+		Notify: []configNotify{
+			{Name: "mail", Kind: "smtp", SMTP: &configSMTP{Username: "panel", Password: "smtp-hunter2"}},
+			{Name: "hook", Kind: "webhook", URL: "https://example.org/hook", Headers: map[string]string{"Authorization": "Bearer webhook-token"}},
+			{Name: "discord", Kind: "discord", URL: "https://discord.com/api/webhooks/1/discord-token"},
+		},
+	}
+	prev := unitsys
+	unitsys = &UnitSystem{rawConfig: cfg}
+	t.Cleanup(func() { unitsys = prev })
+
+	rec := httptest.NewRecorder()
+	apiShowConfig(rec, httptest.NewRequest(http.MethodGet, "/api/config", nil))
+	body := rec.Body.String()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /api/config = %d %s", rec.Code, body)
+	}
+	for _, secret := range append(secrets, "${MC_PASSWORD}") {
+		if strings.Contains(body, secret) {
+			t.Errorf("GET /api/config shows %q", secret)
+		}
+	}
+	for _, shown := range []string{"tmaxhoc-managed", "My server", "./server", "Authorization"} {
+		if !strings.Contains(body, shown) {
+			t.Errorf("GET /api/config doesn't show %q", shown)
+		}
+	}
+
+	// The config the panel runs with is left alone
+	if cfg.Notify[0].SMTP.Password != "smtp-hunter2" || cfg.Units[0].Service.Factorio.RconPassword != "rcon-hunter2" {
+		t.Errorf("GET /api/config masked the config itself")
+	}
+}
@@ -0,0 +1,542 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// `tmaxhoc ctl`: command line client talking to a running panel through its HTTP API.
+
+const ctlUsage = `usage: %s ctl [-addr <address>] [-json] <command> [args...]
+
+Commands:
+  status [query]              Show status of all units, or those matching the query
+  start <unit>                Start a unit
+  stop [--force] <unit>       Stop a unit, or force kill one that is stuck stopping
+  restart [-timeout 1m] <unit>
+                              Stop a unit, wait for it to exit, and start it again
+  logs [-n 100] [-f] <unit>   Print the console output of a service unit
+  attach [-pane <name>] <unit>
+                              Attach to the tmux pane of a service unit (must run on the same host)
+  history [-n 20] <unit>      Show uptime stats and recent events of a service unit
+  instantiate <template> <instance>
+                              Create a unit from a template
+  remove <unit>               Remove a stopped unit created by instantiate
+  dismiss <unit>              Close the panes a service left behind when it exited (see KeepDeadPanes)
+
+Unit names may be abbreviated as long as they are unambiguous: matching ignores case, whitespace, '-' and '_', and
+falls back to fuzzy matching. status also accepts a regex written as /.../.
+
+The address is either http://host:port or unix:///path/to/socket, and defaults to $TMAXHOC_ADDR or %s.
+`
+
+const ctlDefaultAddr = "http://127.0.0.1:8005"
+
+type ctlClient struct {
+	base   string
+	hc     *http.Client
+	asJSON bool
+}
+
+func newCtlClient(addr string, insecure bool) *ctlClient {
+	transport := &http.Transport{}
+	c := &ctlClient{hc: &http.Client{Transport: transport}}
+
+	if insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	switch {
+	case strings.HasPrefix(addr, "unix://"):
+		sockPath := strings.TrimPrefix(addr, "unix://")
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", sockPath)
+		}
+		// Host part is ignored by the dialer above
+		c.base = "http://unix"
+	case strings.HasPrefix(addr, "http://"), strings.HasPrefix(addr, "https://"):
+		c.base = strings.TrimSuffix(addr, "/")
+	default:
+		c.base = "http://" + addr
+	}
+
+	return c
+}
+
+func (c *ctlClient) do(req *http.Request) (*http.Response, error) {
+	req.Header.Set("Accept", "application/json")
+	// Shows up as who did things in the unit history
+	if user := os.Getenv("USER"); user != "" {
+		req.Header.Set("X-Tmaxhoc-User", user)
+	}
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(resp.Body)
+		var failed apiActionError
+		if json.Unmarshal(msg, &failed) == nil && failed.Error != "" {
+			return nil, errors.New(formatActionError(failed))
+		}
+		return nil, errors.New(strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+// One line per problem, under the unit it's about.
+func formatActionError(failed apiActionError) string {
+	if len(failed.Failures) == 0 {
+		return failed.Error
+	}
+	var sb strings.Builder
+	for i, ue := range failed.Failures {
+		if i > 0 {
+			sb.WriteString("\n")
+		}
+		fmt.Fprintf(&sb, "failed to %s %s:", ue.Action, ue.Unit)
+		for _, problem := range ue.Problems {
+			sb.WriteString("\n  " + strings.ReplaceAll(problem, "\n", "\n    "))
+		}
+	}
+	return sb.String()
+}
+
+func (c *ctlClient) get(path string, query url.Values) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, c.base+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.do(req)
+}
+
+func (c *ctlClient) post(path string, form url.Values) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, c.base+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return c.do(req)
+}
+
+func (c *ctlClient) getJSON(path string, query url.Values, v any) error {
+	resp, err := c.get(path, query)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (c *ctlClient) postJSON(path string, form url.Values, v any) error {
+	resp, err := c.post(path, form)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (c *ctlClient) printJSON(v any) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func (c *ctlClient) queryUnit(unitName string) (*apiUnit, error) {
+	var status apiStatus
+	err := c.getJSON("/api/units", url.Values{"unit": {unitName}}, &status)
+	if err != nil {
+		return nil, err
+	}
+	if len(status.Units) == 0 {
+		return nil, errors.New("no such unit: " + unitName)
+	}
+	return &status.Units[0], nil
+}
+
+func ctlMain(args []string) int {
+	fs := flag.NewFlagSet("ctl", flag.ExitOnError)
+	defaultAddr := os.Getenv("TMAXHOC_ADDR")
+	if defaultAddr == "" {
+		defaultAddr = ctlDefaultAddr
+	}
+	addr := fs.String("addr", defaultAddr, "Address of the panel")
+	asJSON := fs.Bool("json", false, "Print raw JSON responses instead of tables")
+	insecure := fs.Bool("insecure", false, "Don't verify the TLS certificate of the panel, e.g. when it is self-signed")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), ctlUsage, os.Args[0], ctlDefaultAddr)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	c := newCtlClient(*addr, *insecure)
+	c.asJSON = *asJSON
+
+	var err error
+	cmd, cmdArgs := fs.Arg(0), fs.Args()[1:]
+	switch cmd {
+	case "status":
+		err = c.cmdStatus(cmdArgs)
+	case "start":
+		err = c.cmdStart(cmdArgs)
+	case "stop":
+		err = c.cmdStop(cmdArgs)
+	case "restart":
+		err = c.cmdRestart(cmdArgs)
+	case "logs":
+		err = c.cmdLogs(cmdArgs)
+	case "attach":
+		err = c.cmdAttach(cmdArgs)
+	case "history":
+		err = c.cmdHistory(cmdArgs)
+	case "instantiate":
+		err = c.cmdInstantiate(cmdArgs)
+	case "remove":
+		err = c.cmdRemove(cmdArgs)
+	case "dismiss":
+		err = c.cmdDismiss(cmdArgs)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command '%s'\n", cmd)
+		fs.Usage()
+		return 2
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", cmd, err)
+		return 1
+	}
+	return 0
+}
+
+// Parse the flags of a subcommand, which must be followed by exactly one unit name.
+func ctlParseUnitArgs(fs *flag.FlagSet, args []string) (string, error) {
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return "", errors.New("expected exactly one unit name")
+	}
+	return fs.Arg(0), nil
+}
+
+func (c *ctlClient) cmdStatus(args []string) error {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	all := fs.Bool("a", false, "Also show hidden units")
+	fs.Parse(args)
+
+	var status apiStatus
+	query := url.Values{}
+	if fs.NArg() > 0 {
+		query.Set("match", fs.Arg(0))
+	}
+	err := c.getJSON("/api/units", query, &status)
+	if err != nil {
+		return err
+	}
+
+	if c.asJSON {
+		c.printJSON(status)
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tKIND\tSTATUS\tDETAIL")
+	for _, u := range status.Units {
+		if u.Hidden && !*all && fs.NArg() == 0 {
+			continue
+		}
+		var detail string
+		switch u.Kind {
+		case "service":
+			panes := make([]string, len(u.Panes))
+			for i, pane := range u.Panes {
+				panes[i] = fmt.Sprintf("%s(pid=%d)", pane.PaneId, pane.Pid)
+			}
+			detail = strings.Join(panes, " ")
+			if u.Game != nil {
+				if u.Game.World != "" {
+					detail += " world=" + u.Game.World
+				}
+				if u.Game.Players != nil {
+					detail += fmt.Sprintf(" players=%d", len(u.Game.Players))
+				}
+			}
+		case "target":
+			detail = fmt.Sprintf("subparts: %d/%d", u.RunningSubparts, u.TotalSubparts)
+		}
+		status := u.Status
+		if u.Exited != "" {
+			status += ", " + strings.ToLower(u.Exited)
+		}
+		if len(u.Orphans) > 0 {
+			status += fmt.Sprintf(", orphans: %d", len(u.Orphans))
+		}
+		if u.Unhealthy != "" {
+			status += ", unhealthy (" + u.Unhealthy + ")"
+		}
+		if u.ForceStopAllowed {
+			status += " (force stop allowed)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", u.Name, u.Kind, status, detail)
+	}
+	return tw.Flush()
+}
+
+func (c *ctlClient) unitAction(path string, form url.Values, verb string) (string, error) {
+	var res apiResult
+	err := c.postJSON(path, form, &res)
+	if err != nil {
+		return "", err
+	}
+	if c.asJSON {
+		c.printJSON(res)
+	} else {
+		fmt.Printf("%s %s\n", verb, res.Unit)
+	}
+	return res.Unit, nil
+}
+
+func (c *ctlClient) cmdStart(args []string) error {
+	fs := flag.NewFlagSet("start", flag.ExitOnError)
+	unitName, err := ctlParseUnitArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.unitAction("/api/start-unit", url.Values{"unit": {unitName}}, "started")
+	return err
+}
+
+func (c *ctlClient) cmdHistory(args []string) error {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	n := fs.Int("n", 20, "Number of most recent events to show")
+	unitName, err := ctlParseUnitArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	var hist unitPageData
+	err = c.getJSON("/unit", url.Values{"unit": {unitName}}, &hist)
+	if err != nil {
+		return err
+	}
+	if c.asJSON {
+		c.printJSON(hist)
+		return nil
+	}
+
+	fmt.Printf("%s: %s\n\n", hist.Unit, hist.Status)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "LAST\tUPTIME\tSESSIONS\tMEAN SESSION\tCRASHES")
+	for _, st := range hist.Stats {
+		fmt.Fprintf(tw, "%dd\t%.1f%%\t%d\t%s\t%d\n", int(st.Window.Hours()/24), st.Uptime*100, st.Sessions, st.MeanSession.Round(time.Second), st.Crashes)
+	}
+	tw.Flush()
+	fmt.Println()
+
+	tw = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tEVENT\tRAN FOR\tBY\tDETAIL")
+	for i, ev := range hist.Events {
+		if i >= *n {
+			break
+		}
+		ranFor := ""
+		if ev.Duration > 0 {
+			ranFor = ev.Duration.Round(time.Second).String()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", ev.Time.Local().Format("2006-01-02 15:04:05"), ev.Kind, ranFor, ev.Actor, ev.Detail)
+	}
+	return tw.Flush()
+}
+
+func (c *ctlClient) cmdInstantiate(args []string) error {
+	fs := flag.NewFlagSet("instantiate", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		return errors.New("expected a template name and an instance name")
+	}
+
+	form := url.Values{"template": {fs.Arg(0)}, "instance": {fs.Arg(1)}}
+	_, err := c.unitAction("/api/instantiate-unit", form, "instantiated")
+	return err
+}
+
+func (c *ctlClient) cmdRemove(args []string) error {
+	fs := flag.NewFlagSet("remove", flag.ExitOnError)
+	unitName, err := ctlParseUnitArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.unitAction("/api/remove-instance", url.Values{"unit": {unitName}}, "removed")
+	return err
+}
+
+func (c *ctlClient) cmdDismiss(args []string) error {
+	fs := flag.NewFlagSet("dismiss", flag.ExitOnError)
+	unitName, err := ctlParseUnitArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.unitAction("/api/dismiss-unit", url.Values{"unit": {unitName}}, "dismissed")
+	return err
+}
+
+func (c *ctlClient) cmdStop(args []string) error {
+	fs := flag.NewFlagSet("stop", flag.ExitOnError)
+	force := fs.Bool("force", false, "Force kill the unit; only allowed some time after a regular stop")
+	unitName, err := ctlParseUnitArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	form := url.Values{"unit": {unitName}}
+	verb := "stopping"
+	if *force {
+		form.Set("force", "true")
+		verb = "force stopped"
+	}
+	_, err = c.unitAction("/api/stop-unit", form, verb)
+	return err
+}
+
+func (c *ctlClient) cmdRestart(args []string) error {
+	fs := flag.NewFlagSet("restart", flag.ExitOnError)
+	timeout := fs.Duration("timeout", 1*time.Minute, "How long to wait for the unit to stop")
+	unitName, err := ctlParseUnitArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	unitName, err = c.unitAction("/api/stop-unit", url.Values{"unit": {unitName}}, "stopping")
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(*timeout)
+	for {
+		u, err := c.queryUnit(unitName)
+		if err != nil {
+			return err
+		}
+		if u.Status == Stopped.String() {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("unit %s did not stop within %s (currently %s)", unitName, *timeout, u.Status)
+		}
+		time.Sleep(1 * time.Second)
+	}
+
+	_, err = c.unitAction("/api/start-unit", url.Values{"unit": {unitName}}, "started")
+	return err
+}
+
+func (c *ctlClient) cmdLogs(args []string) error {
+	fs := flag.NewFlagSet("logs", flag.ExitOnError)
+	lines := fs.Int("n", 100, "Number of scrollback lines to print, or -1 for everything")
+	follow := fs.Bool("f", false, "Keep printing new output until the unit stops")
+	unitName, err := ctlParseUnitArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{
+		"unit":  {unitName},
+		"lines": {fmt.Sprint(*lines)},
+	}
+	if *follow {
+		query.Set("follow", "true")
+	}
+	resp, err := c.get("/api/unit-logs", query)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	_, err = io.Copy(os.Stdout, resp.Body)
+	return err
+}
+
+func (c *ctlClient) cmdAttach(args []string) error {
+	fs := flag.NewFlagSet("attach", flag.ExitOnError)
+	paneName := fs.String("pane", "", "Window name of the pane to attach to, for units with multiple processes")
+	unitName, err := ctlParseUnitArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	u, err := c.queryUnit(unitName)
+	if err != nil {
+		return err
+	}
+	if len(u.Panes) == 0 {
+		return fmt.Errorf("unit %s has no running processes", u.Name)
+	}
+
+	pane := u.Panes[0]
+	if *paneName != "" {
+		found := false
+		for _, p := range u.Panes {
+			_, extra := UndecorateTmuxName(p.Name)
+			if p.Name == *paneName || extra == *paneName {
+				pane, found = p, true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("unit %s has no pane named '%s'", u.Name, *paneName)
+		}
+	}
+
+	// ctl doesn't read the config, the panel knows which tmux it uses
+	tmux := u.TmuxExecutable
+	if tmux == "" {
+		tmux = TmuxExecutable
+	}
+	exe, err := exec.LookPath(tmux)
+	if err != nil {
+		return err
+	}
+	tmuxArgs := []string{tmux}
+	if u.TmuxSocket != "" {
+		tmuxArgs = append(tmuxArgs, "-S", u.TmuxSocket)
+	}
+	env := os.Environ()
+	// $TMUX is "<socket path>,<server pid>,<session index>"
+	currentSocket, _, _ := strings.Cut(os.Getenv("TMUX"), ",")
+	switch {
+	case currentSocket == "":
+		tmuxArgs = append(tmuxArgs, "attach-session", "-t", pane.PaneId)
+	case u.TmuxSocket == "" || currentSocket == u.TmuxSocket:
+		// Nested attach is refused by tmux, switch the current client over instead
+		tmuxArgs = append(tmuxArgs, "switch-client", "-t", pane.PaneId)
+	default:
+		// A client can't switch to another server, nest one in the current pane instead
+		env = slices.DeleteFunc(env, func(kv string) bool { return strings.HasPrefix(kv, "TMUX=") })
+		tmuxArgs = append(tmuxArgs, "attach-session", "-t", pane.PaneId)
+	}
+	return syscall.Exec(exe, tmuxArgs, env)
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"path"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -91,6 +95,8 @@ func (drv *SlfdrvDontStarveTogether) start(serv *Unitv4Service, ts *TmuxSession)
 		}
 	}
 
+	// Keep going if a shard fails, so that the others are up and the cluster can at least be stopped properly
+	var errs []error
 	for _, shard := range drv.Shards {
 		cmdParts := makeCommand(
 			"-cluster", drv.Cluster, "-shard", shard,
@@ -101,16 +107,45 @@ func (drv *SlfdrvDontStarveTogether) start(serv *Unitv4Service, ts *TmuxSession)
 		}
 		_, err := ts.spawnProcess(DecorateTmuxName(serv.TmuxName, shard), cmdParts...)
 		if err != nil {
-			fmt.Printf("[WARN] [DST] spawning shard %s failed: %s\n", shard, err)
+			errs = append(errs, fmt.Errorf("shard %s: %w", shard, err))
 		}
 	}
 
-	return nil
+	return errors.Join(errs...)
 }
 
-func (drv *SlfdrvDontStarveTogether) stop(serv *Unitv4Service, ts *TmuxSession) {
+// The server_port of every shard, from the [NETWORK] section of its server.ini.
+func (drv *SlfdrvDontStarveTogether) declaredPorts() []portSpec {
+	var res []portSpec
+	for _, shard := range drv.Shards {
+		f, err := os.Open(path.Join(drv.DataDir, drv.Cluster, shard, "server.ini"))
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			key, value, ok := strings.Cut(scanner.Text(), "=")
+			if !ok || strings.TrimSpace(key) != "server_port" {
+				continue
+			}
+			port, err := strconv.Atoi(strings.TrimSpace(value))
+			if err == nil {
+				res = append(res, portSpec{Proto: "udp", First: port, Last: port})
+			}
+		}
+		f.Close()
+	}
+	return res
+}
+
+func (drv *SlfdrvDontStarveTogether) stop(serv *Unitv4Service, ts *TmuxSession) error {
+	var errs []error
 	for _, proc := range serv.procs {
-		ts.SendKeys(proc, "c_shutdown()", "Enter")
+		err := ts.SendKeys(proc, "c_shutdown()", "Enter")
+		if err != nil {
+			_, shard := UndecorateTmuxName(proc.Name)
+			errs = append(errs, fmt.Errorf("shard %s: %w", shard, err))
+		}
 	}
 	// DST server doesn't exit after stopping, for some reason
 	time.Sleep(2 * time.Second)
@@ -121,4 +156,5 @@ func (drv *SlfdrvDontStarveTogether) stop(serv *Unitv4Service, ts *TmuxSession)
 	for _, proc := range serv.procs {
 		ts.SendKeys(proc, "C-c")
 	}
+	return errors.Join(errs...)
 }
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type SlfdrvFactorio struct {
+	GameInstall string
+
+	// Created with `--create` if it doesn't exist. With LoadLatest, only created if there is no save to load at all.
+	Save string
+	// Load whichever save in the saves directory (the one Save is in, or saves/ of GameInstall) is newest.
+	LoadLatest bool
+
+	ServerSettings string
+	ModDir         string
+	// Zero for the game's default.
+	Port int
+
+	// Zero to talk to the server through its console instead.
+	RconPort int
+	// Handed to the server through config/rconpw in GameInstall, see [SlfdrvFactorio.rconPasswordFile].
+	RconPassword string `secret:"true"`
+
+	// Set up by newServiceUnit.
+	state *factorioState
+}
+
+type factorioState struct {
+	status gameStatusCache
+	// Name of the save loaded by the last start, empty if the service was adopted.
+	loaded string
+}
+
+const factorioDefaultPort = 34197
+
+// Logged by the server as players come and go, e.g. "2024-01-02 03:04:05 [JOIN] alice joined the game".
+var factorioJoinLeave = regexp.MustCompile(`\[(JOIN|LEAVE)\] (\S+) (?:joined|left) the game`)
+
+func (drv *SlfdrvFactorio) executable() string {
+	return filepath.Join(drv.GameInstall, "bin", "x64", "factorio")
+}
+
+func (drv *SlfdrvFactorio) savesDir() string {
+	if len(drv.Save) > 0 {
+		return filepath.Dir(drv.Save)
+	}
+	return filepath.Join(drv.GameInstall, "saves")
+}
+
+// The most recently written save, empty if there are none.
+func (drv *SlfdrvFactorio) latestSave() string {
+	entries, err := os.ReadDir(drv.savesDir())
+	if err != nil {
+		return ""
+	}
+	var latest string
+	var latestInfo os.FileInfo
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".zip") {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		if latestInfo == nil || fi.ModTime().After(latestInfo.ModTime()) {
+			latest, latestInfo = filepath.Join(drv.savesDir(), e.Name()), fi
+		}
+	}
+	return latest
+}
+
+// Where the server reads its RCON password from when there's no --rcon-password, which would show it to anybody
+// who can list processes. Relative to the write data directory, which is GameInstall unless config-path.cfg says
+// otherwise.
+func (drv *SlfdrvFactorio) rconPasswordFile() string {
+	return filepath.Join(drv.GameInstall, "config", "rconpw")
+}
+
+func (drv *SlfdrvFactorio) rconAddr() string {
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(drv.RconPort))
+}
+
+func (drv *SlfdrvFactorio) declaredPorts() []portSpec {
+	port := drv.Port
+	if port == 0 {
+		port = factorioDefaultPort
+	}
+	res := []portSpec{{Proto: "udp", First: port, Last: port}}
+	if drv.RconPort != 0 {
+		res = append(res, portSpec{Proto: "tcp", First: drv.RconPort, Last: drv.RconPort})
+	}
+	return res
+}
+
+func (drv *SlfdrvFactorio) start(serv *Unitv4Service, ts *TmuxSession) error {
+	exe := drv.executable()
+	serverCommand := []string{exe}
+
+	var save, create string
+	if drv.LoadLatest {
+		// Rather than --start-server-load-latest, which only looks in the saves directory of the game itself
+		save = drv.latestSave()
+		if len(save) == 0 {
+			if len(drv.Save) == 0 {
+				return fmt.Errorf("no save to load in %s", drv.savesDir())
+			}
+			create, save = drv.Save, drv.Save
+		}
+	} else {
+		save = drv.Save
+		if _, err := os.Stat(save); err != nil {
+			create = save
+		}
+	}
+	drv.state.loaded = save
+	serverCommand = append(serverCommand, "--start-server", save)
+
+	if len(drv.ServerSettings) > 0 {
+		serverCommand = append(serverCommand, "--server-settings", drv.ServerSettings)
+	}
+	if len(drv.ModDir) > 0 {
+		serverCommand = append(serverCommand, "--mod-directory", drv.ModDir)
+	}
+	if drv.Port != 0 {
+		serverCommand = append(serverCommand, "--port", strconv.Itoa(drv.Port))
+	}
+	if drv.RconPort != 0 {
+		p := drv.rconPasswordFile()
+		err := os.MkdirAll(filepath.Dir(p), 0755)
+		if err == nil {
+			err = writeFileAtomic(p, []byte(drv.RconPassword), 0600)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write RCON password: %w", err)
+		}
+		serverCommand = append(serverCommand, "--rcon-port", strconv.Itoa(drv.RconPort))
+	}
+
+	command := serverCommand
+	if len(create) > 0 {
+		// Create the map in the same window, so its progress is visible and the panel isn't held up
+		fmt.Printf("[Factorio] creating new save %s\n", create)
+		quoted := make([]string, len(serverCommand))
+		for i, part := range serverCommand {
+			quoted[i] = shellQuote(part)
+		}
+		command = []string{"sh", "-c", shellQuote(exe) + " --create " + shellQuote(create) + " && exec " + strings.Join(quoted, " ")}
+	}
+
+	drv.state.status.reset()
+	_, err := ts.spawnProcess(serv.TmuxName, command...)
+	return err
+}
+
+// The server saves the map before quitting, which can take a while, so don't interrupt it afterwards.
+func (drv *SlfdrvFactorio) stop(serv *Unitv4Service, ts *TmuxSession) error {
+	if drv.RconPort == 0 {
+		return drv.quitOnConsole(serv, ts)
+	}
+
+	// Connecting and waiting for the reply may take a couple of rconTimeout, too long to hold modelLock for
+	go func() {
+		_, err := rconCommand(drv.rconAddr(), drv.RconPassword, "/quit")
+		if err == nil || errors.Is(err, errRconNoReply) {
+			// The server may well close the connection as it quits instead of replying. Either way it got the command,
+			// so don't send it a second time through the console.
+			return
+		}
+		fmt.Printf("[WARN] [Factorio] RCON /quit failed, using the console instead: %s\n", err)
+
+		modelLock.Lock()
+		defer modelLock.Unlock()
+		if serv.status() != Stopping {
+			// Gone already, or started again after being force stopped
+			return
+		}
+		serv.noteError("stop", drv.quitOnConsole(serv, ts))
+	}()
+	return nil
+}
+
+func (drv *SlfdrvFactorio) quitOnConsole(serv *Unitv4Service, ts *TmuxSession) error {
+	var errs []error
+	for _, proc := range serv.procs {
+		errs = append(errs, ts.SendKeys(proc, "/quit", "Enter"))
+	}
+	return errors.Join(errs...)
+}
+
+func (drv *SlfdrvFactorio) gameStatus(serv *Unitv4Service, ts *TmuxSession) *GameStatus {
+	proc := serv.procs[0]
+	loaded := drv.state.loaded
+	return drv.state.status.get(func() *GameStatus {
+		save := loaded
+		if len(save) == 0 {
+			save = drv.latestSave()
+		}
+		status := &GameStatus{}
+		if len(save) > 0 {
+			status.World = strings.TrimSuffix(filepath.Base(save), ".zip")
+		}
+
+		if drv.RconPort != 0 {
+			out, err := rconCommand(drv.rconAddr(), drv.RconPassword, "/players online")
+			if err == nil {
+				status.Players = parseFactorioPlayers(out)
+			}
+		} else {
+			lines, err := ts.CapturePane(proc, -1)
+			if err == nil {
+				status.Players = factorioPlayersFromConsole(lines)
+			}
+		}
+		return status
+	})
+}
+
+// Parse the output of `/players online`, which looks like "Online players (1):\n  alice (online)".
+func parseFactorioPlayers(out string) []string {
+	players := []string{}
+	for _, line := range strings.Split(out, "\n")[1:] {
+		name := strings.TrimSuffix(strings.TrimSpace(line), " (online)")
+		if len(name) > 0 {
+			players = append(players, name)
+		}
+	}
+	return players
+}
+
+// Replay the joins and leaves in the console scrollback. Misses players who joined before what's left of it.
+func factorioPlayersFromConsole(lines []string) []string {
+	players := []string{}
+	for _, line := range lines {
+		m := factorioJoinLeave.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		i := slices.Index(players, m[2])
+		switch {
+		case m[1] == "JOIN" && i == -1:
+			players = append(players, m[2])
+		case m[1] == "LEAVE" && i != -1:
+			players = slices.Delete(players, i, i+1)
+		}
+	}
+	return players
+}
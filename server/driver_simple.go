@@ -1,8 +1,13 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"os/exec"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
 type ServiceUnitStartMode int
@@ -24,14 +29,98 @@ const (
 	ServiceInputStop ServiceUnitStopMode = iota
 	// Run as stop script, passing #{pane_id} and #{pane_pid} as additional arguments for each process in this unit.
 	ServiceScriptStop
+	// Send [SlfdrvSimple.StopSignal] to every process in this unit.
+	ServiceSignalStop
+	// Go through [SlfdrvSimple.StopSequence], escalating until the processes are gone.
+	ServiceSequenceStop
 )
 
+// Which process of a pane gets a signal.
+type SignalTarget int
+
+const (
+	// The process tmux started in the pane.
+	SignalPane SignalTarget = iota
+	// The whole process group of the pane's process.
+	SignalGroup
+	// The most deeply nested descendant of the pane's process, e.g. the server behind a couple of wrapper scripts.
+	SignalDeepest
+)
+
+func parseSignalTarget(s string) (SignalTarget, error) {
+	switch s {
+	case "", "pane":
+		return SignalPane, nil
+	case "group":
+		return SignalGroup, nil
+	case "deepest":
+		return SignalDeepest, nil
+	}
+	return 0, fmt.Errorf("unknown signal target '%s', expected 'pane', 'group' or 'deepest'", s)
+}
+
+var signalsByName = map[string]syscall.Signal{
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGINT":  syscall.SIGINT,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGKILL": syscall.SIGKILL,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+	"SIGTERM": syscall.SIGTERM,
+}
+
+// e.g. "SIGTERM", for the ones in signalsByName.
+func signalName(sig syscall.Signal) string {
+	for name, s := range signalsByName {
+		if s == sig {
+			return name
+		}
+	}
+	return sig.String()
+}
+
+// Accepts e.g. "SIGTERM" and "TERM".
+func parseSignal(s string) (syscall.Signal, error) {
+	name := strings.ToUpper(s)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	sig, ok := signalsByName[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown signal '%s'", s)
+	}
+	return sig, nil
+}
+
+// A step of [SlfdrvSimple.StopSequence]. Exactly one of Input, Signal and Wait is set.
+type StopStep struct {
+	// Keys to type into every pane.
+	Input  []string
+	Signal syscall.Signal
+	Target SignalTarget
+	// Give the processes this long to exit before moving on to the next step.
+	Wait time.Duration
+}
+
 type SlfdrvSimple struct {
 	Start []string
 	Stop  []string
 
 	StartMode ServiceUnitStartMode
 	StopMode  ServiceUnitStopMode
+
+	// For ServiceSignalStop.
+	StopSignal       syscall.Signal
+	StopSignalTarget SignalTarget
+	// For ServiceSequenceStop.
+	StopSequence []StopStep
+
+	// The sequence currently being gone through, guarded by modelLock. Nil if none.
+	stopping *stopSequenceRun
+}
+
+type stopSequenceRun struct {
+	timer *time.Timer
 }
 
 func (drv *SlfdrvSimple) start(serv *Unitv4Service, ts *TmuxSession) error {
@@ -52,12 +141,14 @@ func (drv *SlfdrvSimple) start(serv *Unitv4Service, ts *TmuxSession) error {
 	return nil
 }
 
-func (drv *SlfdrvSimple) stop(serv *Unitv4Service, ts *TmuxSession) {
+func (drv *SlfdrvSimple) stop(serv *Unitv4Service, ts *TmuxSession) error {
 	switch drv.StopMode {
 	case ServiceInputStop:
+		var errs []error
 		for _, proc := range serv.procs {
-			ts.SendKeys(proc, drv.Stop...)
+			errs = append(errs, ts.SendKeys(proc, drv.Stop...))
 		}
+		return errors.Join(errs...)
 
 	case ServiceScriptStop:
 		args := drv.Stop[1:]
@@ -66,6 +157,94 @@ func (drv *SlfdrvSimple) stop(serv *Unitv4Service, ts *TmuxSession) {
 			args = append(args, strconv.Itoa(proc.Pid))
 		}
 		cmd := exec.Command(drv.Stop[0], args...)
-		cmd.Run()
+		cmd.Env = ts.scriptEnv()
+		_, err := cmd.Output()
+		if err != nil {
+			return newCommandError(drv.Stop[0], err)
+		}
+
+	case ServiceSignalStop:
+		return signalProcs(serv, drv.StopSignal, drv.StopSignalTarget)
+
+	case ServiceSequenceStop:
+		if drv.stopping != nil && serv.status() == Stopping {
+			// Asked again while at it, the sequence is going to escalate anyways
+			return nil
+		}
+		if drv.stopping != nil {
+			drv.stopping.timer.Stop()
+		}
+		run := &stopSequenceRun{}
+		drv.stopping = run
+		return drv.continueStopSequence(serv, ts, run, 0)
+	}
+	return nil
+}
+
+// Go through the steps of the stop sequence from the i-th one, until the next wait. Steps that fail don't hold up the
+// rest, which are likely to be more forceful anyways.
+// Must be called with modelLock held exclusively.
+func (drv *SlfdrvSimple) continueStopSequence(serv *Unitv4Service, ts *TmuxSession, run *stopSequenceRun, i int) error {
+	var errs []error
+	for ; i < len(drv.StopSequence); i++ {
+		step := drv.StopSequence[i]
+		switch {
+		case len(step.Input) > 0:
+			for _, proc := range serv.procs {
+				errs = append(errs, ts.SendKeys(proc, step.Input...))
+			}
+		case step.Signal != 0:
+			fmt.Printf("stop sequence of %s: sending %s\n", serv.unit.Name, signalName(step.Signal))
+			errs = append(errs, signalProcs(serv, step.Signal, step.Target))
+		case step.Wait > 0:
+			next := i + 1
+			run.timer = time.AfterFunc(step.Wait, func() {
+				modelLock.Lock()
+				defer modelLock.Unlock()
+				// Gone already, or stopped and started again since
+				if drv.stopping != run || len(serv.procs) == 0 {
+					return
+				}
+				// Nobody to return the error to at this point
+				serv.noteError("stop", drv.continueStopSequence(serv, ts, run, next))
+			})
+			return errors.Join(errs...)
+		}
+	}
+	drv.stopping = nil
+	return errors.Join(errs...)
+}
+
+// Send sig to the processes of serv.
+func signalProcs(serv *Unitv4Service, sig syscall.Signal, target SignalTarget) error {
+	var errs []error
+	for _, proc := range serv.procs {
+		pid := proc.Pid
+		switch target {
+		case SignalGroup:
+			pgid, err := syscall.Getpgid(proc.Pid)
+			if err == nil {
+				pid = -pgid
+			}
+		case SignalDeepest:
+			tree, err := processTree(proc.Pid)
+			if err == nil {
+				pid = tree[len(tree)-1]
+			}
+		}
+		err := syscall.Kill(pid, sig)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to send %s to pid=%d: %w", signalName(sig), pid, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// How long the sequence takes to run out.
+func stopSequenceDuration(steps []StopStep) time.Duration {
+	var res time.Duration
+	for _, step := range steps {
+		res += step.Wait
 	}
+	return res
 }
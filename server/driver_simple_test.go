@@ -0,0 +1,56 @@
+package main
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestParseSignal(t *testing.T) {
+	tests := []struct {
+		in   string
+		want syscall.Signal
+		err  bool
+	}{
+		{in: "SIGTERM", want: syscall.SIGTERM},
+		{in: "TERM", want: syscall.SIGTERM},
+		{in: "int", want: syscall.SIGINT},
+		{in: "SigKill", want: syscall.SIGKILL},
+		{in: "USR1", want: syscall.SIGUSR1},
+		{in: "SIGFOO", err: true},
+		{in: "15", err: true},
+		{in: "", err: true},
+	}
+	for _, tt := range tests {
+		got, err := parseSignal(tt.in)
+		switch {
+		case tt.err && err == nil:
+			t.Errorf("parseSignal(%q) = %v, want an error", tt.in, got)
+		case !tt.err && (err != nil || got != tt.want):
+			t.Errorf("parseSignal(%q) = %v, %v, want %v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseSignalTarget(t *testing.T) {
+	tests := []struct {
+		in   string
+		want SignalTarget
+		err  bool
+	}{
+		{in: "", want: SignalPane},
+		{in: "pane", want: SignalPane},
+		{in: "group", want: SignalGroup},
+		{in: "deepest", want: SignalDeepest},
+		{in: "Group", err: true},
+		{in: "all", err: true},
+	}
+	for _, tt := range tests {
+		got, err := parseSignalTarget(tt.in)
+		switch {
+		case tt.err && err == nil:
+			t.Errorf("parseSignalTarget(%q) = %v, want an error", tt.in, got)
+		case !tt.err && (err != nil || got != tt.want):
+			t.Errorf("parseSignalTarget(%q) = %v, %v, want %v", tt.in, got, err, tt.want)
+		}
+	}
+}
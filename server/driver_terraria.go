@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+type SlfdrvTerraria struct {
+	GameInstall string
+	// "vanilla" (the default), "tshock" or "tmodloader"
+	Flavor string
+	// Relative to GameInstall. Defaults to the server executable of Flavor.
+	Executable string
+
+	// Passed with -config, e.g. serverconfig.txt. Relative paths are relative to GameInstall.
+	Config    string
+	ExtraArgs []string
+}
+
+const terrariaDefaultPort = 7777
+
+var terrariaExecutables = map[string]string{
+	"vanilla":    "TerrariaServer.bin.x86_64",
+	"tshock":     "TShock.Server",
+	"tmodloader": "start-tModLoaderServer.sh",
+}
+
+func (drv *SlfdrvTerraria) executable() string {
+	exe := drv.Executable
+	if len(exe) == 0 {
+		exe = terrariaExecutables[drv.Flavor]
+	}
+	return filepath.Join(drv.GameInstall, exe)
+}
+
+func (drv *SlfdrvTerraria) configPath() string {
+	if filepath.IsAbs(drv.Config) {
+		return drv.Config
+	}
+	return filepath.Join(drv.GameInstall, drv.Config)
+}
+
+func (drv *SlfdrvTerraria) start(serv *Unitv4Service, ts *TmuxSession) error {
+	command := []string{drv.executable(), "-config", drv.configPath()}
+	command = append(command, drv.ExtraArgs...)
+	// The servers look for their assemblies and content relative to the working directory
+	_, err := ts.spawnProcessIn(serv.TmuxName, drv.GameInstall, command...)
+	return err
+}
+
+func (drv *SlfdrvTerraria) stop(serv *Unitv4Service, ts *TmuxSession) error {
+	// Saves the world, then exits
+	var errs []error
+	for _, proc := range serv.procs {
+		errs = append(errs, ts.SendKeys(proc, "exit", "Enter"))
+	}
+	return errors.Join(errs...)
+}
+
+// Read a key=value setting from the server config. Empty if it isn't set.
+func (drv *SlfdrvTerraria) configValue(key string) string {
+	f, err := os.Open(drv.configPath())
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		k, v, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if ok && k == key {
+			return v
+		}
+	}
+	return ""
+}
+
+func (drv *SlfdrvTerraria) gameStatus(serv *Unitv4Service, ts *TmuxSession) *GameStatus {
+	world := drv.configValue("world")
+	if len(world) == 0 {
+		return nil
+	}
+	return &GameStatus{World: strings.TrimSuffix(filepath.Base(world), ".wld")}
+}
+
+func (drv *SlfdrvTerraria) declaredPorts() []portSpec {
+	port, err := strconv.Atoi(drv.configValue("port"))
+	if err != nil {
+		port = terrariaDefaultPort
+	}
+	return []portSpec{{Proto: "tcp", First: port, Last: port}}
+}
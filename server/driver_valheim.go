@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+type SlfdrvValheim struct {
+	GameInstall string
+
+	// Shown in the server browser.
+	Name  string
+	World string
+	// At least 5 characters, and not part of Name. Empty for none.
+	Password string `secret:"true"`
+	// Zero for the game's default, 2456. The server also uses the port after it.
+	Port int
+	// Empty for the game's default, ~/.config/unity3d/IronGate/Valheim
+	SaveDir string
+	// List the server in the server browser.
+	Public bool
+
+	ExtraArgs []string
+}
+
+const valheimExecutable = "valheim_server.x86_64"
+const valheimDefaultPort = 2456
+
+// Steam app id of Valheim, which the server wants to know when not started through Steam.
+const valheimSteamAppId = "892970"
+
+func (drv *SlfdrvValheim) start(serv *Unitv4Service, ts *TmuxSession) error {
+	// The equivalent of start_server.sh, which runs the server in the background where it can't be stopped properly
+	command := []string{
+		"env",
+		"LD_LIBRARY_PATH=" + filepath.Join(drv.GameInstall, "linux64") + ":" + os.Getenv("LD_LIBRARY_PATH"),
+		"SteamAppId=" + valheimSteamAppId,
+		filepath.Join(drv.GameInstall, valheimExecutable),
+		"-nographics", "-batchmode",
+		"-name", drv.Name,
+		"-world", drv.World,
+	}
+	if len(drv.Password) > 0 {
+		command = append(command, "-password", drv.Password)
+	}
+	if drv.Port != 0 {
+		command = append(command, "-port", strconv.Itoa(drv.Port))
+	}
+	if len(drv.SaveDir) > 0 {
+		command = append(command, "-savedir", drv.SaveDir)
+	}
+	if drv.Public {
+		command = append(command, "-public", "1")
+	} else {
+		command = append(command, "-public", "0")
+	}
+	command = append(command, drv.ExtraArgs...)
+
+	_, err := ts.spawnProcessIn(serv.TmuxName, drv.GameInstall, command...)
+	return err
+}
+
+func (drv *SlfdrvValheim) stop(serv *Unitv4Service, ts *TmuxSession) error {
+	// The server doesn't read its console, but saves the world on SIGINT. Anything else loses everything since the last autosave.
+	var errs []error
+	for _, proc := range serv.procs {
+		errs = append(errs, signalServer(proc, valheimExecutable, syscall.SIGINT))
+	}
+	return errors.Join(errs...)
+}
+
+func (drv *SlfdrvValheim) declaredPorts() []portSpec {
+	port := drv.Port
+	if port == 0 {
+		port = valheimDefaultPort
+	}
+	return []portSpec{{Proto: "udp", First: port, Last: port + 1}}
+}
+
+func (drv *SlfdrvValheim) gameStatus(serv *Unitv4Service, ts *TmuxSession) *GameStatus {
+	return &GameStatus{World: drv.World}
+}
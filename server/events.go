@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+type UnitEventKind string
+
+const (
+	// Service was started from the panel
+	EventStart UnitEventKind = "start"
+	// Service was found running without having been started from the panel, e.g. when the panel starts up
+	EventAdopt UnitEventKind = "adopt"
+	// Service exited after being asked to stop
+	EventStop UnitEventKind = "stop"
+	// Service was force killed
+	EventForceStop UnitEventKind = "force-stop"
+	// Service exited without being asked to
+	EventCrash UnitEventKind = "crash"
+	// Service crashed [crashLoopCount] times within [crashLoopWindow]; sent along with the last [EventCrash]
+	EventRestartLoop UnitEventKind = "restart-loop"
+	// A scheduled backup of the service failed
+	EventBackupFailed UnitEventKind = "backup-failure"
+	// A line of output matched a [LogRule] with the notify action
+	EventLogMatch UnitEventKind = "log-match"
+)
+
+// See [EventRestartLoop].
+const crashLoopCount = 3
+const crashLoopWindow = 10 * time.Minute
+
+// Something that happened to a unit.
+type UnitEvent struct {
+	Time time.Time     `json:"time"`
+	Unit string        `json:"unit"`
+	Kind UnitEventKind `json:"kind"`
+	// For events ending a session of the service, how long it had been running. Zero if not known.
+	Duration time.Duration `json:"duration,omitempty"`
+	// Who caused the event, e.g. the address of whoever pressed the button. Empty if nobody in particular.
+	Actor  string `json:"actor,omitempty"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Whether this event begins a session of the service.
+func (ev *UnitEvent) beginsSession() bool {
+	return ev.Kind == EventStart || ev.Kind == EventAdopt
+}
+
+// Whether this event ends a session of the service.
+func (ev *UnitEvent) endsSession() bool {
+	return ev.Kind == EventStop || ev.Kind == EventForceStop || ev.Kind == EventCrash
+}
+
+// Register f to be called on every [UnitEvent].
+// f is called with modelLock held, so it must not block; anything slow has to be handed off to another goroutine.
+func (cfg *UnitSystem) subscribe(f func(UnitEvent)) {
+	cfg.subscribers = append(cfg.subscribers, f)
+}
+
+// Must be called with modelLock held.
+func (cfg *UnitSystem) emit(ev UnitEvent) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	for _, f := range cfg.subscribers {
+		f(ev)
+	}
+}
+
+// Run f, attributing the events it causes to actor. Starts are attributed immediately, stops once the processes are
+// actually gone.
+// Must be called with modelLock held exclusively.
+func (cfg *UnitSystem) actAs(actor string, f func()) {
+	cfg.actor = actor
+	f()
+	cfg.actor = ""
+
+	for _, unit := range cfg.units {
+		if serv, ok := unit.v.(*Unitv4Service); ok && serv.pendingStopReason != "" && serv.stopActor == "" {
+			serv.stopActor = actor
+		}
+	}
+}
+
+// Whether the request came in on a listener whose clients may say who they are: admin listeners, and unix sockets,
+// which are only reachable by whoever the socket's permissions let in. Anybody can claim to be anyone on a panel
+// listener open to the network.
+func trustsUserHeader(req *http.Request) bool {
+	if isAdminRequest(req) {
+		return true
+	}
+	addr, _ := req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return addr != nil && addr.Network() == "unix"
+}
+
+// Describe who made a request, for [UnitEvent.Actor].
+// `tmaxhoc ctl` tells us the user running it, which is taken at its word where [trustsUserHeader].
+func requestActor(req *http.Request) string {
+	addr := req.RemoteAddr
+	if addr == "" || addr == "@" {
+		addr = "unix socket"
+	}
+	if user := req.Header.Get("X-Tmaxhoc-User"); user != "" && trustsUserHeader(req) {
+		return user + " via " + addr
+	}
+	return addr
+}
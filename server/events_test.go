@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestActor(t *testing.T) {
+	tcpAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8005}
+	unixAddr := &net.UnixAddr{Name: "/run/tmaxhoc.sock", Net: "unix"}
+
+	tests := []struct {
+		name       string
+		role       ListenerRole
+		localAddr  net.Addr
+		remoteAddr string
+		user       string
+		want       string
+	}{
+		{name: "panel", role: ListenPanel, localAddr: tcpAddr, remoteAddr: "192.0.2.1:1234", want: "192.0.2.1:1234"},
+		{name: "panel claiming a user", role: ListenPanel, localAddr: tcpAddr, remoteAddr: "192.0.2.1:1234", user: "alice", want: "192.0.2.1:1234"},
+		{name: "admin", role: ListenAdmin, localAddr: tcpAddr, remoteAddr: "127.0.0.1:1234", user: "alice", want: "alice via 127.0.0.1:1234"},
+		{name: "panel on a unix socket", role: ListenPanel, localAddr: unixAddr, remoteAddr: "@", user: "alice", want: "alice via unix socket"},
+		{name: "unix socket without a user", role: ListenAdmin, localAddr: unixAddr, remoteAddr: "", want: "unix socket"},
+	}
+	for _, tt := range tests {
+		ctx := withListener(context.Background(), &ListenerConfig{Role: tt.role})
+		ctx = context.WithValue(ctx, http.LocalAddrContextKey, tt.localAddr)
+		req := httptest.NewRequest(http.MethodPost, "/api/start-unit", nil).WithContext(ctx)
+		req.RemoteAddr = tt.remoteAddr
+		if tt.user != "" {
+			req.Header.Set("X-Tmaxhoc-User", tt.user)
+		}
+		if got := requestActor(req); got != tt.want {
+			t.Errorf("%s: requestActor() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
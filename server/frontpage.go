@@ -1,42 +1,56 @@
 package main
 
 import (
+	"html/template"
 	"io"
 	"path/filepath"
-	"text/template"
 )
 
 var frontpage *template.Template
 
 type frontpageData struct {
+	// Nullable, see [flashMessage].
+	Flash *flashMessage
 	Units []frontpageUnit
 }
 
 type frontpageUnit struct {
-	Name             string
-	Description      string
-	UserDefinedAttrs string
-	Class            string
-	Tooltip          string
-	IsStopped        bool
+	Name        string
+	Description string
+	// From the config, which is trusted to not smuggle anything into it.
+	Style     template.CSS
+	Class     string
+	Tooltip   string
+	IsStopped bool
+	// See [Unitv4Service.exitSummary].
+	Exited string
+	// Name of the log rule that marked the service unhealthy.
+	Unhealthy string
+	// Processes left behind by the service, see [Unitv4Service.orphans].
+	Orphans int
+	// Nullable, see [GameStatusReporter].
+	Game             *GameStatus
 	IsStopping       bool
 	IsRunning        bool
 	ForceStopAllowed bool
 	IsGroup          bool
 	RunningSubparts  int
 	TotalSubparts    int
+	SnapshotsURL     string
+	DetailsURL       string
 }
 
 func parseFrontpageTemplate(unitsys *UnitSystem) (*template.Template, error) {
 	return template.ParseFiles(filepath.Join(unitsys.StaticFilesDir, "index.html"))
 }
 
-func renderFrontpage(w io.Writer, unitsys *UnitSystem) error {
-	return frontpage.Execute(w, newFrontpageData(unitsys))
+func renderFrontpage(w io.Writer, unitsys *UnitSystem, flash *flashMessage) error {
+	return frontpage.Execute(w, newFrontpageData(unitsys, flash))
 }
 
-func newFrontpageData(unitsys *UnitSystem) frontpageData {
+func newFrontpageData(unitsys *UnitSystem, flash *flashMessage) frontpageData {
 	data := frontpageData{
+		Flash: flash,
 		Units: make([]frontpageUnit, 0, len(unitsys.units)),
 	}
 
@@ -55,7 +69,7 @@ func newFrontpageUnit(unit *Unit) frontpageUnit {
 	view := frontpageUnit{
 		Name:             unit.Name,
 		Description:      unit.Description,
-		UserDefinedAttrs: userDefinedAttributes(unit),
+		Style:            template.CSS(unit.Styles),
 		IsStopped:        status == Stopped,
 		IsStopping:       status == Stopping,
 		IsRunning:        status == Running,
@@ -66,6 +80,14 @@ func newFrontpageUnit(unit *Unit) frontpageUnit {
 	case *Unitv4Service:
 		view.Class = "unitservice"
 		view.Tooltip = "A standalone service"
+		view.DetailsURL = unitPageURL(unit)
+		view.Exited = v.exitSummary()
+		view.Unhealthy = v.unhealthy
+		view.Orphans = len(v.orphans)
+		view.Game = v.gameStatus()
+		if len(v.dataPaths) > 0 {
+			view.SnapshotsURL = snapshotsPageURL(unit)
+		}
 	case *Unitv4Group:
 		view.Class = "unitgroup"
 		view.Tooltip = "Many subpart services grouped together"
@@ -76,10 +98,3 @@ func newFrontpageUnit(unit *Unit) frontpageUnit {
 
 	return view
 }
-
-func userDefinedAttributes(unit *Unit) string {
-	if len(unit.Styles) > 0 {
-		return `style="` + unit.Styles + `"`
-	}
-	return ""
-}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// Markup that must come out escaped wherever it's shown.
+const hostileText = `<script>alert("x")</script>`
+
+func TestFrontpageEscapes(t *testing.T) {
+	tmpl, err := parseFrontpageTemplate(&UnitSystem{StaticFilesDir: "../static"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := frontpageData{
+		Flash: &flashMessage{Lines: []string{hostileText}, URL: "/unit?unit=a#errors"},
+		Units: []frontpageUnit{{
+			Name:        hostileText,
+			Description: hostileText,
+			Style:       "background: red",
+			IsRunning:   true,
+			Unhealthy:   hostileText,
+			DetailsURL:  "/unit?unit=a",
+			Game:        &GameStatus{World: hostileText, Players: []string{hostileText}},
+		}},
+	}
+
+	var sb strings.Builder
+	err = tmpl.Execute(&sb, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := sb.String()
+	if strings.Contains(page, "<script>alert") {
+		t.Errorf("frontpage contains unescaped markup:\n%s", page)
+	}
+	if !strings.Contains(page, `style="background: red"`) {
+		t.Errorf("frontpage lost the unit's Styles:\n%s", page)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// What a game server is up to, as far as its lifecycle driver can tell.
+type GameStatus struct {
+	// The save or world being played, empty if unknown.
+	World string `json:"world,omitempty"`
+	// Names of the connected players. Nil if unknown.
+	Players []string `json:"players"`
+}
+
+// Implemented by lifecycle drivers that can look inside the game server.
+type GameStatusReporter interface {
+	// Nullable. Must not block, it is called with modelLock held while rendering pages.
+	gameStatus(serv *Unitv4Service, ts *TmuxSession) *GameStatus
+}
+
+// How long a [GameStatus] is reused before it's queried again.
+const gameStatusMaxAge = 10 * time.Second
+
+// Last known [GameStatus] of a service, refreshed in the background as it's asked for.
+type gameStatusCache struct {
+	mu         sync.Mutex
+	status     *GameStatus
+	updated    time.Time
+	refreshing bool
+}
+
+// Returns the cached status, and starts refreshing it with query if it's stale.
+func (c *gameStatusCache) get(query func() *GameStatus) *GameStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.refreshing && time.Since(c.updated) > gameStatusMaxAge {
+		c.refreshing = true
+		go func() {
+			status := query()
+			c.mu.Lock()
+			c.status = status
+			c.updated = time.Now()
+			c.refreshing = false
+			c.mu.Unlock()
+		}()
+	}
+	return c.status
+}
+
+// Forget the status of the previous run of the service.
+func (c *gameStatusCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.status = nil
+	c.updated = time.Time{}
+}
+
+// Nullable, if the service isn't running or its driver doesn't know.
+// Must be called with modelLock held.
+func (serv *Unitv4Service) gameStatus() *GameStatus {
+	reporter, ok := serv.lifecycleDriver.(GameStatusReporter)
+	if !ok || len(serv.procs) == 0 {
+		return nil
+	}
+	return reporter.gameStatus(serv, serv.session)
+}
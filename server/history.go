@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// How long events are kept around. A little over the longest window of [UptimeStats] shown on the unit page.
+const historyRetention = 31 * 24 * time.Hour
+
+// How much of the scrollback of dead panes is shown on the unit page.
+const finalOutputLines = 200
+
+// Windows of the [UptimeStats] shown on the unit page.
+var historyStatsWindows = []time.Duration{7 * 24 * time.Hour, 30 * 24 * time.Hour}
+
+// Log of [UnitEvent]s, kept in memory and appended to a file as JSON lines.
+// Guarded by modelLock, like the rest of the model.
+type UnitHistory struct {
+	// Empty if the history is not persisted.
+	file string
+	// Oldest first.
+	events []UnitEvent
+}
+
+// Load the history from file, dropping events older than [historyRetention].
+func openUnitHistory(file string) (*UnitHistory, error) {
+	h := &UnitHistory{file: file}
+	if file == "" {
+		return h, nil
+	}
+
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cutoff := time.Now().Add(-historyRetention)
+	dropped := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var ev UnitEvent
+		err := json.Unmarshal(scanner.Bytes(), &ev)
+		if err != nil || ev.Time.Before(cutoff) {
+			// A torn last line from a crash is not worth failing over
+			dropped++
+			continue
+		}
+		h.events = append(h.events, ev)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if dropped > 0 {
+		err := h.rewrite()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// Replace the file with the events kept in memory.
+func (h *UnitHistory) rewrite() error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for i := range h.events {
+		enc.Encode(&h.events[i])
+	}
+	return writeFileAtomic(h.file, buf.Bytes(), 0644)
+}
+
+// Drop events older than [historyRetention] as of now. Returns whether there were any.
+func (h *UnitHistory) prune(now time.Time) bool {
+	cutoff := now.Add(-historyRetention)
+	n := 0
+	for n < len(h.events) && h.events[n].Time.Before(cutoff) {
+		n++
+	}
+	if n == 0 {
+		return false
+	}
+	// Copied, so that the dropped events don't stay around at the front of the array forever
+	h.events = append([]UnitEvent(nil), h.events[n:]...)
+	return true
+}
+
+// Subscriber of [UnitSystem.emit].
+func (h *UnitHistory) record(ev UnitEvent) {
+	h.events = append(h.events, ev)
+	// The panel may run for much longer than the retention
+	pruned := h.prune(time.Now())
+	if h.file == "" {
+		return
+	}
+
+	var err error
+	if pruned {
+		err = h.rewrite()
+	} else {
+		var line []byte
+		line, err = json.Marshal(ev)
+		if err == nil {
+			var f *os.File
+			f, err = os.OpenFile(h.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+			if err == nil {
+				_, err = f.Write(append(line, '\n'))
+				f.Close()
+			}
+		}
+	}
+	if err != nil {
+		fmt.Printf("[WARN] failed to record event in %s: %s\n", h.file, err)
+	}
+}
+
+// Events of a unit, oldest first.
+func (h *UnitHistory) unitEvents(unitName string) []UnitEvent {
+	var res []UnitEvent
+	for _, ev := range h.events {
+		if ev.Unit == unitName {
+			res = append(res, ev)
+		}
+	}
+	return res
+}
+
+type UptimeStats struct {
+	Window time.Duration `json:"window"`
+	// Fraction of the window the service was running, between 0 and 1.
+	Uptime float64 `json:"uptime"`
+	// Number of sessions that ended within the window, and their mean length.
+	Sessions    int           `json:"sessions"`
+	MeanSession time.Duration `json:"meanSession"`
+	Crashes     int           `json:"crashes"`
+}
+
+// Length of the part of [start, end) that lies within [from, to).
+func overlap(start, end, from, to time.Time) time.Duration {
+	if start.Before(from) {
+		start = from
+	}
+	if end.After(to) {
+		end = to
+	}
+	if !end.After(start) {
+		return 0
+	}
+	return end.Sub(start)
+}
+
+// Aggregate the events of a unit (oldest first) over the window ending at now.
+func computeUptimeStats(events []UnitEvent, window time.Duration, now time.Time) UptimeStats {
+	from := now.Add(-window)
+	res := UptimeStats{Window: window}
+
+	var up, total time.Duration
+	inSession := false
+	var sessionStart time.Time
+	seenSession := false
+	for _, ev := range events {
+		if !seenSession && ev.endsSession() {
+			// The session started before the oldest event we still have
+			inSession = true
+		}
+		seenSession = seenSession || ev.beginsSession() || ev.endsSession()
+
+		switch {
+		case ev.beginsSession() && !inSession:
+			inSession = true
+			sessionStart = ev.Time
+		case ev.endsSession() && inSession:
+			inSession = false
+			up += overlap(sessionStart, ev.Time, from, now)
+			if ev.Time.Before(from) {
+				break
+			}
+			res.Sessions++
+			if ev.Duration > 0 {
+				total += ev.Duration
+			} else if !sessionStart.IsZero() {
+				total += ev.Time.Sub(sessionStart)
+			}
+			if ev.Kind == EventCrash {
+				res.Crashes++
+			}
+		}
+	}
+	if inSession {
+		up += overlap(sessionStart, now, from, now)
+	}
+
+	res.Uptime = float64(up) / float64(window)
+	if res.Sessions > 0 {
+		res.MeanSession = total / time.Duration(res.Sessions)
+	}
+	return res
+}
+
+var unitPage *template.Template
+
+type unitPageData struct {
+	Unit         string        `json:"unit"`
+	Description  string        `json:"description,omitempty"`
+	Status       string        `json:"status"`
+	Exited       string        `json:"exited,omitempty"`
+	Stats        []UptimeStats `json:"stats"`
+	Events       []UnitEvent   `json:"events"`
+	SnapshotsURL string        `json:"-"`
+	// Archived console output, current log first.
+	OutputLogs []outputLogLink `json:"outputLogs,omitempty"`
+	// What the panes the service left behind last showed.
+	FinalOutput []finalOutput `json:"finalOutput,omitempty"`
+	// Name of the log rule that marked the service unhealthy.
+	Unhealthy string `json:"unhealthy,omitempty"`
+	// Processes left behind by the service, see [Unitv4Service.orphans].
+	Orphans []trackedProcess `json:"orphans,omitempty"`
+	// What the game server reports, see [GameStatusReporter].
+	Game     *GameStatus    `json:"game,omitempty"`
+	LogRules []logRuleStats `json:"logRules,omitempty"`
+	// Newest first.
+	LogMatches []logMatch `json:"logMatches,omitempty"`
+	// Recent failures to start or stop, newest first.
+	Errors []unitError `json:"errors,omitempty"`
+}
+
+type logRuleStats struct {
+	Name      string    `json:"name"`
+	Pattern   string    `json:"pattern"`
+	Matches   int       `json:"matches"`
+	LastMatch time.Time `json:"lastMatch"`
+}
+
+type finalOutput struct {
+	Pane  string   `json:"pane"`
+	Exit  string   `json:"exit"`
+	Lines []string `json:"lines"`
+}
+
+type outputLogLink struct {
+	outputLogInfo
+	URL string `json:"url"`
+}
+
+func parseUnitPageTemplate(unitsys *UnitSystem) (*template.Template, error) {
+	funcs := template.FuncMap{
+		"percent":   func(f float64) float64 { return f * 100 },
+		"days":      func(d time.Duration) int { return int(d.Hours() / 24) },
+		"kibibytes": func(n int64) float64 { return float64(n) / (1 << 10) },
+		"roundDuration": func(d time.Duration) time.Duration {
+			if d > time.Hour {
+				return d.Round(time.Minute)
+			}
+			return d.Round(time.Second)
+		},
+	}
+	return template.New("unit.html").Funcs(funcs).ParseFiles(filepath.Join(unitsys.StaticFilesDir, "unit.html"))
+}
+
+func unitPageURL(unit *Unit) string {
+	return "/unit?unit=" + url.QueryEscape(unit.Name)
+}
+
+// GET /unit?unit=<name>
+//
+// History and uptime of a service unit, newest events first. Responds with JSON if asked to.
+func httpUnitPage(w http.ResponseWriter, req *http.Request) {
+	unit := resolveUnitParam(w, req)
+	if unit == nil {
+		return
+	}
+	serv, ok := unit.v.(*Unitv4Service)
+	if !ok {
+		http.Error(w, "unit '"+unit.Name+"' is not a service", http.StatusBadRequest)
+		return
+	}
+
+	modelLock.RLock()
+	events := unitsys.history.unitEvents(unit.Name)
+	data := unitPageData{
+		Unit:        unit.Name,
+		Description: unit.Description,
+		Status:      serv.status().String(),
+		Exited:      serv.exitSummary(),
+		Events:      make([]UnitEvent, 0, len(events)),
+	}
+	deadPanes := append([]*TmuxProcess(nil), serv.deadPanes...)
+	data.Unhealthy = serv.unhealthy
+	data.Game = serv.gameStatus()
+	data.Orphans = append([]trackedProcess(nil), serv.orphans...)
+	for _, rule := range serv.logRules {
+		data.LogRules = append(data.LogRules, logRuleStats{Name: rule.Name, Pattern: rule.Pattern.String(), Matches: rule.count, LastMatch: rule.lastMatch})
+	}
+	for i := len(serv.logMatches) - 1; i >= 0; i-- {
+		data.LogMatches = append(data.LogMatches, serv.logMatches[i])
+	}
+	for i := len(serv.recentErrors) - 1; i >= 0; i-- {
+		data.Errors = append(data.Errors, serv.recentErrors[i])
+	}
+	modelLock.RUnlock()
+
+	for _, proc := range deadPanes {
+		lines, err := serv.session.CapturePane(proc, finalOutputLines)
+		if err != nil {
+			// Dismissed in the meantime
+			continue
+		}
+		data.FinalOutput = append(data.FinalOutput, finalOutput{Pane: proc.Name, Exit: proc.Exit.String(), Lines: lines})
+	}
+
+	now := time.Now()
+	for _, window := range historyStatsWindows {
+		data.Stats = append(data.Stats, computeUptimeStats(events, window, now))
+	}
+	for i := len(events) - 1; i >= 0; i-- {
+		data.Events = append(data.Events, events[i])
+	}
+	if len(serv.dataPaths) > 0 {
+		data.SnapshotsURL = snapshotsPageURL(unit)
+	}
+	for _, log := range unitsys.listOutputLogs(unit) {
+		data.OutputLogs = append(data.OutputLogs, outputLogLink{outputLogInfo: log, URL: outputLogURL(unit, log.Name)})
+	}
+
+	if wantsJSON(req) {
+		writeJSON(w, http.StatusOK, data)
+		return
+	}
+	err := unitPage.Execute(w, data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
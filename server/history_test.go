@@ -0,0 +1,145 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestComputeUptimeStats(t *testing.T) {
+	now := time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)
+	ago := func(h float64) time.Time {
+		return now.Add(-time.Duration(h * float64(time.Hour)))
+	}
+	ev := func(kind UnitEventKind, h float64) UnitEvent {
+		return UnitEvent{Time: ago(h), Kind: kind}
+	}
+	withDuration := func(e UnitEvent, d time.Duration) UnitEvent {
+		e.Duration = d
+		return e
+	}
+
+	tests := []struct {
+		name   string
+		events []UnitEvent
+		want   UptimeStats
+	}{
+		{
+			name: "no events",
+			want: UptimeStats{},
+		},
+		{
+			name:   "running for half the window",
+			events: []UnitEvent{ev(EventStart, 12)},
+			want:   UptimeStats{Uptime: 0.5},
+		},
+		{
+			name:   "running since before the window",
+			events: []UnitEvent{ev(EventStart, 30)},
+			want:   UptimeStats{Uptime: 1},
+		},
+		{
+			name:   "adopted",
+			events: []UnitEvent{ev(EventAdopt, 6)},
+			want:   UptimeStats{Uptime: 0.25},
+		},
+		{
+			name:   "one session",
+			events: []UnitEvent{ev(EventStart, 10), withDuration(ev(EventStop, 4), 6*time.Hour)},
+			want:   UptimeStats{Uptime: 0.25, Sessions: 1, MeanSession: 6 * time.Hour},
+		},
+		{
+			name: "crash and restart",
+			events: []UnitEvent{
+				ev(EventStart, 20), ev(EventCrash, 18),
+				ev(EventStart, 10), ev(EventForceStop, 9),
+			},
+			want: UptimeStats{Uptime: 0.125, Sessions: 2, MeanSession: 90 * time.Minute, Crashes: 1},
+		},
+		{
+			name:   "session started before the oldest event",
+			events: []UnitEvent{withDuration(ev(EventStop, 12), 100*time.Hour)},
+			want:   UptimeStats{Uptime: 0.5, Sessions: 1, MeanSession: 100 * time.Hour},
+		},
+		{
+			name:   "session over before the window",
+			events: []UnitEvent{ev(EventStart, 40), ev(EventStop, 30)},
+			want:   UptimeStats{},
+		},
+		{
+			name:   "session overlapping the start of the window",
+			events: []UnitEvent{ev(EventStart, 30), ev(EventStop, 18)},
+			want:   UptimeStats{Uptime: 0.25, Sessions: 1, MeanSession: 12 * time.Hour},
+		},
+		{
+			name:   "repeated starts",
+			events: []UnitEvent{ev(EventStart, 12), ev(EventStart, 6), ev(EventStop, 0)},
+			want:   UptimeStats{Uptime: 0.5, Sessions: 1, MeanSession: 12 * time.Hour},
+		},
+	}
+	for _, tt := range tests {
+		tt.want.Window = 24 * time.Hour
+		got := computeUptimeStats(tt.events, 24*time.Hour, now)
+		if got != tt.want {
+			t.Errorf("%s: computeUptimeStats() = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUnitPageEscapes(t *testing.T) {
+	tmpl, err := parseUnitPageTemplate(&UnitSystem{StaticFilesDir: "../static"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := unitPageData{
+		Unit:        hostileText,
+		Description: hostileText,
+		Status:      "stopped",
+		Stats:       []UptimeStats{{Window: 7 * 24 * time.Hour}},
+		Events:      []UnitEvent{{Kind: EventStart, Actor: hostileText, Detail: hostileText}},
+		FinalOutput: []finalOutput{{Pane: "%1", Exit: "exit status 1", Lines: []string{hostileText}}},
+		Orphans:     []trackedProcess{{Pid: 1234, Name: hostileText}},
+		Errors:      []unitError{{Action: "start", Problems: []string{hostileText}}},
+		LogRules:    []logRuleStats{{Name: hostileText, Pattern: hostileText}},
+		LogMatches:  []logMatch{{Rule: hostileText, Line: hostileText}},
+	}
+
+	var sb strings.Builder
+	err = tmpl.Execute(&sb, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(sb.String(), "<script>alert") {
+		t.Errorf("unit page contains unescaped markup:\n%s", sb.String())
+	}
+}
+
+func TestUnitHistoryPrunesWhileRunning(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "history.jsonl")
+	h, err := openUnitHistory(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	// Recorded back when they were fresh, the panel has been running ever since
+	h.record(UnitEvent{Time: now.Add(-historyRetention - time.Hour), Unit: "minecraft", Kind: EventStart})
+	h.record(UnitEvent{Time: now.Add(-historyRetention + time.Hour), Unit: "minecraft", Kind: EventStop})
+	h.record(UnitEvent{Time: now, Unit: "minecraft", Kind: EventStart})
+
+	if len(h.events) != 2 || h.events[0].Kind != EventStop {
+		t.Errorf("events in memory = %+v, want the last two", h.events)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(data), "\n"); n != 2 {
+		t.Errorf("history file has %d events, want 2:\n%s", n, data)
+	}
+	if h, err = openUnitHistory(file); err != nil || len(h.events) != 2 {
+		t.Errorf("reopened history has %d events (%v), want 2", len(h.events), err)
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+type ListenerRole int
+
+const (
+	// Serves the panel frontpage, static files, and the start/stop actions available on the panel.
+	ListenPanel ListenerRole = iota
+	// Serves everything the panel does, plus the API used by `tmaxhoc ctl`.
+	ListenAdmin
+)
+
+type ListenerConfig struct {
+	// One of
+	// - tcp://<host>:<port>
+	// - unix://<path>
+	// - systemd:// for all sockets passed by systemd socket activation, or systemd://<name> for the ones with a
+	//   matching FileDescriptorName=
+	Address string
+	Role    ListenerRole
+
+	// Permission bits to set on the socket file, for unix sockets only. Left as is if zero.
+	Mode os.FileMode
+	// User and group name to chown the socket file to, for unix sockets only. Left as is if empty.
+	Owner string
+	Group string
+
+	// Serve HTTPS on this listener, with the certificate from [UnitSystem.TLS].
+	TLS bool
+	// Don't serve anything on this listener, only redirect visitors to the first TLS listener.
+	RedirectToHTTPS bool
+}
+
+// Used when no listener is configured. Only on loopback, since the admin role lets anybody who can connect change the
+// units and read the config; exposing the panel to the network takes a listener of its own.
+var defaultListener = ListenerConfig{
+	Address: "tcp://127.0.0.1:8005",
+	Role:    ListenAdmin,
+}
+
+type listenerCtxKey struct{}
+
+// Context of the requests coming in on a listener opened for lcfg, see [requestListener].
+func withListener(ctx context.Context, lcfg *ListenerConfig) context.Context {
+	return context.WithValue(ctx, listenerCtxKey{}, lcfg)
+}
+
+// Config of the listener the request came in on. Nil if not known.
+func requestListener(req *http.Request) *ListenerConfig {
+	lcfg, _ := req.Context().Value(listenerCtxKey{}).(*ListenerConfig)
+	return lcfg
+}
+
+// Whether the request came in on a [ListenAdmin] listener.
+func isAdminRequest(req *http.Request) bool {
+	lcfg := requestListener(req)
+	return lcfg != nil && lcfg.Role == ListenAdmin
+}
+
+func parseListenerRole(s string) (ListenerRole, error) {
+	switch s {
+	case "panel", "":
+		return ListenPanel, nil
+	case "admin":
+		return ListenAdmin, nil
+	}
+	return 0, fmt.Errorf("invalid listener role '%s', accepted 'panel' or 'admin'", s)
+}
+
+func (r ListenerRole) String() string {
+	switch r {
+	case ListenPanel:
+		return "panel"
+	case ListenAdmin:
+		return "admin"
+	}
+	return "unknown"
+}
+
+// Open every configured listener, alongside the config each of them came from.
+// Note a single systemd:// config may expand into any number of listeners.
+func openListeners(cfgs []ListenerConfig) ([]net.Listener, []*ListenerConfig, error) {
+	var listeners []net.Listener
+	var origins []*ListenerConfig
+	closeAll := func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}
+
+	for i := range cfgs {
+		cfg := &cfgs[i]
+		ls, err := openListener(cfg)
+		if err != nil {
+			closeAll()
+			return nil, nil, fmt.Errorf("failed to listen on '%s': %w", cfg.Address, err)
+		}
+		for _, l := range ls {
+			listeners = append(listeners, l)
+			origins = append(origins, cfg)
+		}
+	}
+
+	return listeners, origins, nil
+}
+
+func openListener(cfg *ListenerConfig) ([]net.Listener, error) {
+	scheme, rest, found := strings.Cut(cfg.Address, "://")
+	if !found {
+		// Allow the bare Go style ":8005" and "127.0.0.1:8005"
+		scheme, rest = "tcp", cfg.Address
+	}
+
+	switch scheme {
+	case "tcp", "tcp4", "tcp6":
+		l, err := net.Listen(scheme, rest)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{l}, nil
+
+	case "unix":
+		l, err := listenUnix(rest, cfg)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{l}, nil
+
+	case "systemd":
+		return takeSystemdListeners(rest)
+	}
+
+	return nil, fmt.Errorf("unknown address scheme '%s'", scheme)
+}
+
+func listenUnix(sockPath string, cfg *ListenerConfig) (net.Listener, error) {
+	// Clean up socket left behind by a previous instance that didn't exit cleanly, but don't clobber regular files
+	if fi, err := os.Lstat(sockPath); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, errors.New("path exists and is not a socket")
+		}
+		os.Remove(sockPath)
+	}
+
+	l, err := net.Listen("unix", sockPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Mode != 0 {
+		if err := os.Chmod(sockPath, cfg.Mode); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+
+	if cfg.Owner != "" || cfg.Group != "" {
+		uid, gid := -1, -1
+		if cfg.Owner != "" {
+			u, err := user.Lookup(cfg.Owner)
+			if err != nil {
+				l.Close()
+				return nil, err
+			}
+			uid, _ = strconv.Atoi(u.Uid)
+		}
+		if cfg.Group != "" {
+			g, err := user.LookupGroup(cfg.Group)
+			if err != nil {
+				l.Close()
+				return nil, err
+			}
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+		if err := os.Lchown(sockPath, uid, gid); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+
+	return l, nil
+}
+
+// First fd passed by systemd, see sd_listen_fds(3)
+const systemdListenFdsStart = 3
+
+type systemdSocket struct {
+	name     string
+	listener net.Listener
+	taken    bool
+}
+
+// Sockets passed in through systemd socket activation, parsed on first use.
+var systemdSockets []*systemdSocket
+var systemdSocketsParsed bool
+
+func parseSystemdSockets() error {
+	if systemdSocketsParsed {
+		return nil
+	}
+	systemdSocketsParsed = true
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil
+	}
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		return nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	// Don't let these leak into the processes we spawn
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	for i := 0; i < nfds; i++ {
+		fd := systemdListenFdsStart + i
+		syscall.CloseOnExec(fd)
+
+		name := "LISTEN_FD_" + strconv.Itoa(fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		f := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(f)
+		// FileListener dups the fd
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("systemd socket %s (fd %d): %w", name, fd, err)
+		}
+		systemdSockets = append(systemdSockets, &systemdSocket{name: name, listener: l})
+	}
+
+	return nil
+}
+
+// Claim the systemd sockets with the given name, or all sockets not claimed yet if name is empty.
+func takeSystemdListeners(name string) ([]net.Listener, error) {
+	if err := parseSystemdSockets(); err != nil {
+		return nil, err
+	}
+
+	var res []net.Listener
+	for _, sock := range systemdSockets {
+		if sock.taken || (name != "" && sock.name != name) {
+			continue
+		}
+		sock.taken = true
+		res = append(res, sock.listener)
+	}
+
+	if len(res) == 0 {
+		return nil, errors.New("no matching socket passed in by systemd (is the service socket activated?)")
+	}
+	return res, nil
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Rules matching the console output of services, read back from the log files of [OutputLogPolicy] as they grow.
+
+// How often the log files are checked for new output.
+const logWatchInterval = 1 * time.Second
+
+// How many matches per unit are kept for the unit page.
+const logMatchesKept = 50
+
+type LogRuleAction int
+
+const (
+	// Emit [EventLogMatch], which goes to notification sinks like any other event
+	LogRuleNotify LogRuleAction = iota
+	// Mark the service as unhealthy, until it's restarted or a [LogRuleHealthy] rule matches
+	LogRuleUnhealthy
+	LogRuleHealthy
+	// Stop the service, and start it again once it's gone
+	LogRuleRestart
+)
+
+func parseLogRuleAction(s string) (LogRuleAction, error) {
+	switch s {
+	case "notify":
+		return LogRuleNotify, nil
+	case "unhealthy":
+		return LogRuleUnhealthy, nil
+	case "healthy":
+		return LogRuleHealthy, nil
+	case "restart":
+		return LogRuleRestart, nil
+	}
+	return 0, fmt.Errorf("unknown log rule action '%s', expected 'notify', 'unhealthy', 'healthy' or 'restart'", s)
+}
+
+type LogRule struct {
+	Name    string
+	Pattern *regexp.Regexp
+	// Every match is counted, actions are optional.
+	Actions []LogRuleAction
+	// Minimum time between two matches that trigger the actions. Matches within the cooldown are only counted.
+	Cooldown time.Duration
+
+	// Since the panel started. Guarded by modelLock.
+	count     int
+	lastMatch time.Time
+	lastFired time.Time
+}
+
+type logMatch struct {
+	Time time.Time `json:"time"`
+	Rule string    `json:"rule"`
+	Line string    `json:"line"`
+}
+
+// Reads the lines appended to a log file, following it across rotations.
+type logTail struct {
+	path string
+	// Nil until the file exists.
+	f *os.File
+	// Incomplete last line of the previous read.
+	partial []byte
+}
+
+// Start following path. Output already in the file is skipped, so a restarted panel doesn't match it again.
+func newLogTail(path string) *logTail {
+	t := &logTail{path: path}
+	f, err := os.Open(path)
+	if err == nil {
+		f.Seek(0, io.SeekEnd)
+		t.f = f
+	}
+	return t
+}
+
+// Lines appended since the last call, with terminal control sequences stripped.
+func (t *logTail) readLines() []string {
+	var data []byte
+	for {
+		if t.f == nil {
+			f, err := os.Open(t.path)
+			if err != nil {
+				break
+			}
+			t.f = f
+		}
+
+		// Rotated files stay readable through the open descriptor, so nothing written before the rotation is lost
+		chunk, _ := io.ReadAll(t.f)
+		data = append(data, chunk...)
+
+		cur, err1 := t.f.Stat()
+		onDisk, err2 := os.Stat(t.path)
+		if err1 == nil && err2 == nil && os.SameFile(cur, onDisk) {
+			break
+		}
+		t.f.Close()
+		t.f = nil
+		if err2 != nil {
+			break
+		}
+	}
+
+	data = append(t.partial, data...)
+	end := bytes.LastIndexByte(data, '\n')
+	if end == -1 {
+		t.partial = data
+		return nil
+	}
+	t.partial = append([]byte(nil), data[end+1:]...)
+
+	var res []string
+	for _, line := range bytes.Split(data[:end+1], []byte("\n")) {
+		line = stripANSI(line)
+		if len(line) > 0 {
+			res = append(res, string(line))
+		}
+	}
+	return res
+}
+
+func (t *logTail) close() {
+	if t.f != nil {
+		t.f.Close()
+	}
+}
+
+// Apply a match of rule on a line of serv's output.
+// Must be called with modelLock held exclusively.
+func (cfg *UnitSystem) applyLogRule(serv *Unitv4Service, rule *LogRule, line string, now time.Time) {
+	rule.count++
+	rule.lastMatch = now
+	serv.logMatches = append(serv.logMatches, logMatch{Time: now, Rule: rule.Name, Line: line})
+	if len(serv.logMatches) > logMatchesKept {
+		serv.logMatches = serv.logMatches[len(serv.logMatches)-logMatchesKept:]
+	}
+
+	if len(rule.Actions) == 0 || now.Sub(rule.lastFired) < rule.Cooldown {
+		return
+	}
+	rule.lastFired = now
+	fmt.Printf("log rule %s of %s matched: %s\n", rule.Name, serv.unit.Name, line)
+
+	for _, action := range rule.Actions {
+		switch action {
+		case LogRuleNotify:
+			cfg.emit(UnitEvent{Time: now, Unit: serv.unit.Name, Kind: EventLogMatch, Detail: rule.Name + ": " + line})
+		case LogRuleUnhealthy:
+			serv.unhealthy = rule.Name
+		case LogRuleHealthy:
+			serv.unhealthy = ""
+		case LogRuleRestart:
+			if serv.status() != Running || serv.restartPending != "" {
+				continue
+			}
+			serv.restartPending = "log rule " + rule.Name
+			cfg.actAs(serv.restartPending, func() {
+				serv.stop()
+			})
+		}
+	}
+}
+
+// Start the services that were stopped by a [LogRuleRestart], once they are gone.
+// Must be called with modelLock held exclusively.
+func (cfg *UnitSystem) runPendingRestarts() {
+	for _, unit := range cfg.units {
+		serv, ok := unit.v.(*Unitv4Service)
+		if !ok || serv.restartPending == "" || serv.status() != Stopped {
+			continue
+		}
+		actor := serv.restartPending
+		serv.restartPending = ""
+		fmt.Printf("restarting %s\n", unit.Name)
+		cfg.actAs(actor, func() {
+			// Recorded with the service
+			serv.start()
+		})
+	}
+}
+
+// Services with log rules, which may change as templates are instantiated at runtime.
+func (cfg *UnitSystem) watchedServices() []*Unitv4Service {
+	modelLock.RLock()
+	defer modelLock.RUnlock()
+
+	var res []*Unitv4Service
+	for _, unit := range cfg.units {
+		if serv, ok := unit.v.(*Unitv4Service); ok && len(serv.logRules) > 0 {
+			res = append(res, serv)
+		}
+	}
+	return res
+}
+
+// Match the output of services against their log rules until stop is closed.
+func runLogWatcher(unitsys *UnitSystem, stop <-chan bool) {
+	ticker := time.NewTicker(logWatchInterval)
+	defer ticker.Stop()
+
+	tails := make(map[*Unitv4Service]*logTail)
+	defer func() {
+		for _, t := range tails {
+			t.close()
+		}
+	}()
+
+	for {
+		watched := unitsys.watchedServices()
+		current := make(map[*Unitv4Service]bool)
+		newLines := make(map[*Unitv4Service][]string)
+		for _, serv := range watched {
+			current[serv] = true
+			t := tails[serv]
+			if t == nil {
+				path := filepath.Join(unitsys.outputLogDirOf(serv.unit), outputLogName)
+				tails[serv] = newLogTail(path)
+				continue
+			}
+			newLines[serv] = t.readLines()
+		}
+		for serv, t := range tails {
+			if !current[serv] {
+				t.close()
+				delete(tails, serv)
+			}
+		}
+
+		now := time.Now()
+		modelLock.Lock()
+		for serv, lines := range newLines {
+			for _, line := range lines {
+				for _, rule := range serv.logRules {
+					if rule.Pattern.MatchString(line) {
+						unitsys.applyLogRule(serv, rule, strings.TrimSpace(line), now)
+					}
+				}
+			}
+		}
+		modelLock.Unlock()
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
@@ -1,28 +1,37 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
 	"sync"
+	"syscall"
 	"time"
 )
 
 var unitsys *UnitSystem
-var ts *TmuxSession
 var modelLock sync.RWMutex
 
 func httpHandler(w http.ResponseWriter, req *http.Request) {
 	modelLock.RLock()
 	defer modelLock.RUnlock()
 
-	if err := renderFrontpage(w, unitsys); err != nil {
+	if err := renderFrontpage(w, unitsys, takeFlash(w, req)); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
 func apiStartUnit(w http.ResponseWriter, req *http.Request) {
-	if unitsys.MaxUnits > 0 && unitsys.RunningServicesCount() >= unitsys.MaxUnits {
+	modelLock.RLock()
+	running := unitsys.RunningServicesCount()
+	modelLock.RUnlock()
+	if unitsys.MaxUnits > 0 && running >= unitsys.MaxUnits {
 		http.Error(w, fmt.Sprintf(`
 Failed to start unit:
 Cannot run more than %d server at the same time. Please stop something else before starting this server.
@@ -30,23 +39,34 @@ Use the browser back button to go to the server panel again.`, unitsys.MaxUnits)
 		return
 	}
 
-	unitName := req.FormValue("unit")
-	unit := unitsys.unitsLut[unitName]
-	fmt.Printf("got /api/start-unit for unit=%s\n", unitName)
-
-	if unit != nil {
-		modelLock.Lock()
-		unit.v.start(ts)
-		modelLock.Unlock()
+	fmt.Printf("got /api/start-unit for unit=%s\n", req.FormValue("unit"))
+	unit := resolveUnitParam(w, req)
+	if unit == nil {
+		return
 	}
 
-	http.Redirect(w, req, "/", http.StatusFound)
+	var err error
+	modelLock.Lock()
+	unitsys.actAs(requestActor(req), func() {
+		err = unit.v.start()
+	})
+	unitsys.saveState()
+	modelLock.Unlock()
+
+	if err != nil {
+		code := http.StatusInternalServerError
+		if isPreStartError(err) {
+			code = http.StatusConflict
+		}
+		respondFailed(w, req, unit, code, err)
+		return
+	}
+	respondDone(w, req, unit)
 }
 
 func apiStopUnit(w http.ResponseWriter, req *http.Request) {
-	unitName := req.FormValue("unit")
-	unit := unitsys.unitsLut[unitName]
-	fmt.Printf("got /api/stop-unit for unit=%s\n", unitName)
+	fmt.Printf("got /api/stop-unit for unit=%s\n", req.FormValue("unit"))
+	unit := resolveUnitParam(w, req)
 	if unit == nil {
 		return
 	}
@@ -68,6 +88,7 @@ func apiStopUnit(w http.ResponseWriter, req *http.Request) {
 	// wasting some time per request, since call to Redirect()/Error() doesn't need to be locked
 	// but doesn't really matter
 	defer modelLock.Unlock()
+	defer unitsys.saveState()
 
 	if force {
 		// TODO somehow abstract this away in virtual methods?
@@ -75,10 +96,19 @@ func apiStopUnit(w http.ResponseWriter, req *http.Request) {
 		case *Unitv4Service:
 			d := unit.v.(*Unitv4Service)
 			if d.forceStopAllowed() {
-				d.forceStop(ts)
-				http.Redirect(w, req, "/", http.StatusFound)
+				var err error
+				unitsys.actAs(requestActor(req), func() {
+					err = d.forceStop()
+				})
+				if err != nil {
+					respondFailed(w, req, unit, http.StatusInternalServerError, err)
+				} else {
+					respondDone(w, req, unit)
+				}
+			} else if d.status() == Stopped {
+				http.Error(w, "force kill not allowed: nothing is running", http.StatusBadRequest)
 			} else {
-				http.Error(w, "force kill not allowed: not enough time has passed since stopping attempt", http.StatusBadRequest)
+				http.Error(w, "force kill not allowed: not enough time has passed since stopping attempt ("+d.forceStopAfter.String()+")", http.StatusBadRequest)
 			}
 		case *Unitv4Group:
 			http.Error(w, "force kill not allowed on target units", http.StatusBadRequest)
@@ -86,11 +116,51 @@ func apiStopUnit(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	unit.v.stop(ts)
-	http.Redirect(w, req, "/", http.StatusFound)
+	var err error
+	unitsys.actAs(requestActor(req), func() {
+		err = unit.v.stop()
+	})
+	if err != nil {
+		respondFailed(w, req, unit, http.StatusInternalServerError, err)
+		return
+	}
+	respondDone(w, req, unit)
+}
+
+// POST /api/dismiss-unit unit=<name>
+//
+// Close the panes a service left behind when it exited.
+func apiDismissUnit(w http.ResponseWriter, req *http.Request) {
+	fmt.Printf("got /api/dismiss-unit for unit=%s\n", req.FormValue("unit"))
+	unit := resolveUnitParam(w, req)
+	if unit == nil {
+		return
+	}
+	serv, ok := unit.v.(*Unitv4Service)
+	if !ok {
+		http.Error(w, "unit '"+unit.Name+"' is not a service", http.StatusBadRequest)
+		return
+	}
+
+	modelLock.Lock()
+	serv.dismissDeadPanes()
+	modelLock.Unlock()
+
+	respondDone(w, req, unit)
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "ctl":
+			os.Exit(ctlMain(os.Args[2:]))
+		case "check-config":
+			os.Exit(checkConfigMain(os.Args[2:]))
+		case "pipe-output":
+			os.Exit(pipeOutputMain(os.Args[2:]))
+		}
+	}
+
 	var err error
 
 	configFile := flag.String("config", "config.toml", "Path to the config file")
@@ -98,20 +168,46 @@ func main() {
 
 	unitsys, err = NewUnitSystemFromConfig(*configFile)
 	if err != nil {
-		panic(err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
 
-	ts, err = NewTmuxSession(unitsys.SessionName)
+	TmuxExecutable = unitsys.TmuxExecutable
+	var sessions []*TmuxSession
+	for _, conf := range unitsys.TmuxSessions {
+		ts, err := NewTmuxSession(conf)
+		if err != nil {
+			panic(err)
+		}
+		sessions = append(sessions, ts)
+	}
+
+	unitsys.history, err = openUnitHistory(unitsys.HistoryFile)
 	if err != nil {
 		panic(err)
 	}
-
-	unitsys.BindTmuxSession(ts)
+	unitsys.subscribe(unitsys.history.record)
+	for _, sink := range unitsys.NotifySinks {
+		sink.start()
+		unitsys.subscribe(sink.enqueue)
+	}
+	for _, ts := range sessions {
+		unitsys.BindTmuxSession(ts)
+	}
+	state := unitsys.loadState()
 
 	frontpage, err = parseFrontpageTemplate(unitsys)
 	if err != nil {
 		panic(err)
 	}
+	snapshotsPage, err = parseSnapshotsTemplate(unitsys)
+	if err != nil {
+		panic(err)
+	}
+	unitPage, err = parseUnitPageTemplate(unitsys)
+	if err != nil {
+		panic(err)
+	}
 
 	// TODO event loop, and instead of tracking a "suspect dead list", don't store newly spawned processes at all,
 	//   but instead immediately queue a PollAndPrune() to detect the new proc group (and reset the timer)
@@ -119,23 +215,176 @@ func main() {
 	//   for a state update.
 	tsPollTimer := time.NewTicker(5 * time.Second)
 	tsPollStop := make(chan bool)
-	ts.PollAndPrune()
+	tsPollDone := make(chan bool)
+	unitsys.PollAndPrune()
+	unitsys.reconcileState(state)
+	unitsys.saveState()
 	go func() {
+		defer close(tsPollDone)
 		for {
 			select {
 			case <-tsPollTimer.C:
 				modelLock.Lock()
-				ts.PollAndPrune()
+				unitsys.PollAndPrune()
+				unitsys.pruneOrphans()
+				unitsys.runPendingRestarts()
+				unitsys.saveState()
 				modelLock.Unlock()
 			case <-tsPollStop:
+				tsPollTimer.Stop()
 				return
 			}
 		}
 	}()
 
-	http.HandleFunc("/", httpHandler)
-	http.HandleFunc("POST /api/start-unit", apiStartUnit)
-	http.HandleFunc("POST /api/stop-unit", apiStopUnit)
-	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir(unitsys.StaticFilesDir))))
-	http.ListenAndServe(":8005", nil)
+	backupStop := make(chan bool)
+	backupDone := make(chan bool)
+	go func() {
+		defer close(backupDone)
+		runBackupScheduler(unitsys, backupStop)
+	}()
+
+	logWatchStop := make(chan bool)
+	logWatchDone := make(chan bool)
+	go func() {
+		defer close(logWatchDone)
+		runLogWatcher(unitsys, logWatchStop)
+	}()
+
+	listeners, listenerCfgs, err := openListeners(unitsys.Listeners)
+	if err != nil {
+		panic(err)
+	}
+
+	var certs *certReloader
+	if unitsys.TLS != nil {
+		certs, err = newCertReloader(unitsys.TLS)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	// Where plaintext listeners with RedirectToHTTPS send people
+	httpsPort := ""
+	for i, l := range listeners {
+		if addr, ok := l.Addr().(*net.TCPAddr); ok && listenerCfgs[i].TLS {
+			httpsPort = strconv.Itoa(addr.Port)
+			break
+		}
+	}
+
+	panelMux := http.NewServeMux()
+	registerPanelRoutes(panelMux)
+	adminMux := http.NewServeMux()
+	registerPanelRoutes(adminMux)
+	registerAdminRoutes(adminMux)
+
+	// Cancelled on shutdown, so that long running requests (e.g. following logs) wrap up
+	baseCtx, cancelBaseCtx := context.WithCancel(context.Background())
+	servers := make([]*http.Server, 0, len(listeners))
+	serveErrs := make(chan error, len(listeners))
+	for i, l := range listeners {
+		lcfg := listenerCfgs[i]
+		srv := &http.Server{
+			BaseContext: func(net.Listener) context.Context { return withListener(baseCtx, lcfg) },
+		}
+		servers = append(servers, srv)
+		what := lcfg.Role.String()
+
+		switch {
+		case lcfg.RedirectToHTTPS:
+			if httpsPort == "" {
+				panic("listener '" + lcfg.Address + "' redirects to HTTPS, but no TCP listener serves TLS")
+			}
+			srv.Handler = redirectToHTTPS(httpsPort)
+			what = "redirect to HTTPS"
+		case lcfg.Role == ListenAdmin:
+			srv.Handler = adminMux
+		default:
+			srv.Handler = panelMux
+		}
+
+		if lcfg.TLS {
+			if unitsys.TLS.HSTSMaxAge > 0 {
+				srv.Handler = withHSTS(srv.Handler, unitsys.TLS.HSTSMaxAge)
+			}
+			l = tls.NewListener(l, certs.tlsConfig())
+			what += " over TLS"
+		}
+
+		fmt.Printf("serving %s on %s\n", what, l.Addr())
+		go func() {
+			serveErrs <- srv.Serve(l)
+		}()
+	}
+
+	sigCtx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-serveErrs:
+		panic(err)
+	case <-sigCtx.Done():
+	}
+	// Let a second Ctrl-C kill us for real, in case shutting down gets stuck
+	stopSignals()
+	fmt.Println("shutting down")
+
+	cancelBaseCtx()
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 10*time.Second)
+	for _, srv := range servers {
+		err := srv.Shutdown(shutdownCtx)
+		if err != nil {
+			fmt.Printf("[WARN] failed to drain HTTP requests: %s\n", err)
+		}
+	}
+	cancelShutdown()
+
+	close(tsPollStop)
+	<-tsPollDone
+	close(logWatchStop)
+	<-logWatchDone
+	// Let a backup that is already underway finish, it'd just leave a .partial file otherwise
+	close(backupStop)
+	<-backupDone
+
+	switch unitsys.OnExit {
+	case ExitLeaveRunning:
+		fmt.Println("leaving units running, they will be adopted on the next start")
+	case ExitStopAll:
+		modelLock.Lock()
+		unitsys.actAs("panel shutdown", func() {
+			unitsys.StopAll(unitsys.OnExitTimeout)
+		})
+		unitsys.saveState()
+		modelLock.Unlock()
+	}
+
+	// Deliver whatever the shutdown itself caused
+	for _, sink := range unitsys.NotifySinks {
+		sink.close(10 * time.Second)
+	}
+}
+
+// Routes for everybody who can see the panel.
+func registerPanelRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/{$}", httpHandler)
+	mux.HandleFunc("POST /api/start-unit", apiStartUnit)
+	mux.HandleFunc("POST /api/stop-unit", apiStopUnit)
+	mux.HandleFunc("POST /api/dismiss-unit", apiDismissUnit)
+	mux.HandleFunc("GET /unit", httpUnitPage)
+	mux.HandleFunc("GET /snapshots", httpSnapshotsPage)
+	mux.HandleFunc("GET /api/snapshot-download", apiDownloadSnapshot)
+	mux.HandleFunc("GET /api/output-log", apiDownloadOutputLog)
+	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir(unitsys.StaticFilesDir))))
+}
+
+// Routes only served on [ListenAdmin] listeners.
+func registerAdminRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/units", apiListUnits)
+	mux.HandleFunc("GET /api/unit-logs", apiUnitLogs)
+	mux.HandleFunc("GET /api/config", apiShowConfig)
+	mux.HandleFunc("POST /api/test-notifications", apiTestNotifications)
+	mux.HandleFunc("POST /api/instantiate-unit", apiInstantiateUnit)
+	mux.HandleFunc("POST /api/remove-instance", apiRemoveInstance)
+	mux.HandleFunc("POST /api/snapshot-unit", apiSnapshotUnit)
+	mux.HandleFunc("POST /api/restore-snapshot", apiRestoreSnapshot)
 }
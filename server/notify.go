@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+type NotifyKind int
+
+const (
+	// POST [NotifySink.Body] to a URL
+	NotifyWebhook NotifyKind = iota
+	// POST the message to a Discord webhook
+	NotifyDiscord
+	// POST the message to a Slack incoming webhook
+	NotifySlack
+	// Run a command with the event as JSON on stdin
+	NotifyExec
+	// Send an email, see [SMTPConfig]
+	NotifySMTP
+)
+
+func parseNotifyKind(s string) (NotifyKind, error) {
+	switch s {
+	case "webhook":
+		return NotifyWebhook, nil
+	case "discord":
+		return NotifyDiscord, nil
+	case "slack":
+		return NotifySlack, nil
+	case "exec":
+		return NotifyExec, nil
+	case "smtp":
+		return NotifySMTP, nil
+	}
+	return 0, fmt.Errorf("unknown notification kind '%s', expected 'webhook', 'discord', 'slack', 'exec' or 'smtp'", s)
+}
+
+// Sent to sinks by POST /api/test-notifications, regardless of their filters.
+const EventTest UnitEventKind = "test"
+
+const defaultNotifyMessage = `{{.Unit}} {{.Verb}}{{if .Actor}} by {{.Actor}}{{end}}{{if .Detail}} ({{.Detail}}){{end}}`
+
+// How many notifications a sink holds on to while it can't keep up, before dropping new ones.
+const notifyQueueSize = 64
+
+// Somewhere to send notices about [UnitEvent]s to.
+type NotifySink struct {
+	Name string
+	Kind NotifyKind
+
+	// Webhook, Discord and Slack
+	URL     string
+	Headers map[string]string
+	// Webhook: renders the request body, given a [notifyData]. If nil, the body is the [notifyData] as JSON.
+	// SMTP: renders the mail body, given a [notifyDigest].
+	Body *template.Template
+
+	// Exec only. Gets the event as JSON on stdin, and the [notifyData] fields in TMAXHOC_* environment variables.
+	Command []string
+
+	// SMTP only.
+	SMTP *SMTPConfig
+
+	// Renders the message of Discord and Slack, and [notifyData.Message] for everything else.
+	Message *template.Template
+
+	// Nullable, if every kind of event is sent.
+	Events map[UnitEventKind]bool
+	// Nullable, if events of every unit are sent.
+	Units map[string]bool
+
+	// How many times to retry a failed notification, with exponential backoff.
+	MaxRetries int
+	// Wait before the first retry, doubled for each one after.
+	RetryBackoff time.Duration
+	// Minimum time between two notifications, to not get rate limited (or banned) by the receiving end.
+	MinInterval time.Duration
+	Timeout     time.Duration
+
+	queue    chan UnitEvent
+	done     chan bool
+	lastSent time.Time
+
+	// Set once the queue is closed, after which events are dropped. Guarded by closeLock.
+	closed    bool
+	closeLock sync.Mutex
+}
+
+// What templates of a [NotifySink] are executed with.
+type notifyData struct {
+	UnitEvent
+	// e.g. "started", "crashed"
+	Verb string `json:"verb"`
+	// Rendered [NotifySink.Message], empty while rendering the message itself.
+	Message string `json:"message"`
+}
+
+func eventVerb(kind UnitEventKind) string {
+	switch kind {
+	case EventStart:
+		return "started"
+	case EventAdopt:
+		return "was found running"
+	case EventStop:
+		return "stopped"
+	case EventForceStop:
+		return "was force stopped"
+	case EventCrash:
+		return "crashed"
+	case EventRestartLoop:
+		return "is crashing repeatedly"
+	case EventBackupFailed:
+		return "failed to back up"
+	case EventLogMatch:
+		return "matched a log rule"
+	case EventTest:
+		return "is testing notifications"
+	}
+	return string(kind)
+}
+
+func (sink *NotifySink) wants(ev UnitEvent) bool {
+	if ev.Kind == EventTest {
+		return true
+	}
+	if sink.Events != nil && !sink.Events[ev.Kind] {
+		return false
+	}
+	if sink.Units != nil && !sink.Units[ev.Unit] {
+		return false
+	}
+	return true
+}
+
+// Subscriber of [UnitSystem.emit]. Never blocks.
+func (sink *NotifySink) enqueue(ev UnitEvent) {
+	if !sink.wants(ev) {
+		return
+	}
+
+	sink.closeLock.Lock()
+	defer sink.closeLock.Unlock()
+	if sink.closed {
+		return
+	}
+	select {
+	case sink.queue <- ev:
+	default:
+		fmt.Printf("[WARN] notification sink %s is falling behind, dropping %s event of %s\n", sink.Name, ev.Kind, ev.Unit)
+	}
+}
+
+// Send notifications until [NotifySink.close] is called.
+func (sink *NotifySink) start() {
+	sink.queue = make(chan UnitEvent, notifyQueueSize)
+	sink.done = make(chan bool)
+	go func() {
+		defer close(sink.done)
+		if sink.Kind == NotifySMTP {
+			sink.runDigests()
+			return
+		}
+		for ev := range sink.queue {
+			sink.deliver(ev)
+		}
+	}()
+}
+
+// Stop accepting events, and wait up to timeout for the queued ones to be sent.
+func (sink *NotifySink) close(timeout time.Duration) {
+	sink.closeLock.Lock()
+	sink.closed = true
+	close(sink.queue)
+	sink.closeLock.Unlock()
+
+	select {
+	case <-sink.done:
+	case <-time.After(timeout):
+		fmt.Printf("[WARN] gave up on %d queued notifications of sink %s\n", len(sink.queue), sink.Name)
+	}
+}
+
+func (sink *NotifySink) newNotifyData(ev UnitEvent) (notifyData, error) {
+	data := notifyData{UnitEvent: ev, Verb: eventVerb(ev.Kind)}
+	var sb strings.Builder
+	err := sink.Message.Execute(&sb, data)
+	if err != nil {
+		return data, fmt.Errorf("failed to render message: %w", err)
+	}
+	data.Message = sb.String()
+	return data, nil
+}
+
+func (sink *NotifySink) deliver(ev UnitEvent) {
+	data, err := sink.newNotifyData(ev)
+	if err != nil {
+		fmt.Printf("[ERROR] notification sink %s: %s\n", sink.Name, err)
+		return
+	}
+
+	err = sink.withRetries(func() error {
+		return sink.send(data)
+	})
+	if err != nil {
+		fmt.Printf("[ERROR] notification sink %s: giving up on %s event of %s: %s\n", sink.Name, ev.Kind, ev.Unit, err)
+	}
+}
+
+// Call send until it succeeds, at most [NotifySink.MaxRetries] more times, and no more often than the rate limit.
+func (sink *NotifySink) withRetries(send func() error) error {
+	backoff := sink.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		if wait := sink.MinInterval - time.Since(sink.lastSent); wait > 0 {
+			time.Sleep(wait)
+		}
+		sink.lastSent = time.Now()
+
+		err := send()
+		if err == nil || attempt >= sink.MaxRetries {
+			return err
+		}
+		fmt.Printf("[WARN] notification sink %s: %s, retrying in %s\n", sink.Name, err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (sink *NotifySink) send(data notifyData) error {
+	ctx, cancel := context.WithTimeout(context.Background(), sink.Timeout)
+	defer cancel()
+
+	var body []byte
+	var err error
+	switch sink.Kind {
+	case NotifyWebhook:
+		if sink.Body == nil {
+			body, err = json.Marshal(data)
+		} else {
+			var buf bytes.Buffer
+			err = sink.Body.Execute(&buf, data)
+			body = buf.Bytes()
+		}
+	case NotifyDiscord:
+		body, err = json.Marshal(map[string]string{"content": data.Message})
+	case NotifySlack:
+		body, err = json.Marshal(map[string]string{"text": data.Message})
+	case NotifyExec:
+		return sink.runCommand(ctx, data)
+	}
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sink.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range sink.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return errors.New("webhook responded with " + resp.Status)
+	}
+	return nil
+}
+
+func (sink *NotifySink) runCommand(ctx context.Context, data notifyData) error {
+	stdin, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.CommandContext(ctx, sink.Command[0], sink.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Env = append(os.Environ(),
+		"TMAXHOC_UNIT="+data.Unit,
+		"TMAXHOC_EVENT="+string(data.Kind),
+		"TMAXHOC_ACTOR="+data.Actor,
+		"TMAXHOC_DETAIL="+data.Detail,
+		"TMAXHOC_MESSAGE="+data.Message,
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// POST /api/test-notifications
+//
+// Send a test event to every notification sink, ignoring their filters.
+func apiTestNotifications(w http.ResponseWriter, req *http.Request) {
+	ev := UnitEvent{
+		Time:  time.Now(),
+		Unit:  "tmaxhoc",
+		Kind:  EventTest,
+		Actor: requestActor(req),
+	}
+	for _, sink := range unitsys.NotifySinks {
+		sink.enqueue(ev)
+	}
+	if wantsJSON(req) {
+		writeJSON(w, http.StatusOK, map[string]int{"sinks": len(unitsys.NotifySinks)})
+		return
+	}
+	fmt.Fprintf(w, "sent test notification to %d sinks\n", len(unitsys.NotifySinks))
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+type SMTPTLSMode int
+
+const (
+	// Connect in plaintext, then upgrade with STARTTLS, which the server must support
+	SMTPStartTLS SMTPTLSMode = iota
+	// Connect with TLS right away, usually on port 465
+	SMTPImplicitTLS
+	// Never encrypt. Only sensible for a mail server on the same host.
+	SMTPNoTLS
+)
+
+func parseSMTPTLSMode(s string) (SMTPTLSMode, error) {
+	switch s {
+	case "starttls", "":
+		return SMTPStartTLS, nil
+	case "implicit":
+		return SMTPImplicitTLS, nil
+	case "none":
+		return SMTPNoTLS, nil
+	}
+	return 0, fmt.Errorf("unknown SMTP TLS mode '%s', expected 'starttls', 'implicit' or 'none'", s)
+}
+
+const defaultSMTPSubject = `[tmaxhoc] {{if eq (len .Events) 1}}{{(index .Events 0).Message}}{{else}}{{len .Events}} unit events{{end}}`
+const defaultSMTPBody = `{{range .Events}}{{.Time.Local.Format "2006-01-02 15:04:05"}}  {{.Message}}
+{{end}}`
+
+// Where and how a [NotifySMTP] sink sends its mail.
+type SMTPConfig struct {
+	// host:port of the mail server.
+	Address string
+	TLS     SMTPTLSMode
+	// If empty, don't authenticate.
+	Username string
+	Password string
+
+	From string
+	To   []string
+	// Renders the subject, given a [notifyDigest].
+	Subject *template.Template
+
+	// Events are collected into one mail until none arrive for this long...
+	DigestWindow time.Duration
+	// ...or until the first of them is this old, so that a steady stream of events still gets mailed.
+	MaxDigestDelay time.Duration
+
+	// Nil for the system's. Lets tests trust their own mail server.
+	rootCAs *x509.CertPool
+}
+
+// What the subject and body templates of a [NotifySMTP] sink are executed with.
+type notifyDigest struct {
+	// Oldest first.
+	Events []notifyData
+}
+
+// Collect events into digests and mail them, until the queue is closed.
+func (sink *NotifySink) runDigests() {
+	for ev := range sink.queue {
+		batch := []UnitEvent{ev}
+		quiet := time.NewTimer(sink.SMTP.DigestWindow)
+		deadline := time.NewTimer(sink.SMTP.MaxDigestDelay)
+	collect:
+		for {
+			select {
+			case ev, ok := <-sink.queue:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, ev)
+				quiet.Reset(sink.SMTP.DigestWindow)
+			case <-quiet.C:
+				break collect
+			case <-deadline.C:
+				break collect
+			}
+		}
+		quiet.Stop()
+		deadline.Stop()
+
+		sink.deliverDigest(batch)
+	}
+}
+
+func (sink *NotifySink) deliverDigest(batch []UnitEvent) {
+	var digest notifyDigest
+	for _, ev := range batch {
+		data, err := sink.newNotifyData(ev)
+		if err != nil {
+			fmt.Printf("[ERROR] notification sink %s: %s\n", sink.Name, err)
+			return
+		}
+		digest.Events = append(digest.Events, data)
+	}
+
+	msg, err := sink.renderMail(digest)
+	if err != nil {
+		fmt.Printf("[ERROR] notification sink %s: %s\n", sink.Name, err)
+		return
+	}
+	err = sink.withRetries(func() error {
+		return sink.SMTP.send(msg, sink.Timeout)
+	})
+	if err != nil {
+		fmt.Printf("[ERROR] notification sink %s: giving up on mail with %d events: %s\n", sink.Name, len(batch), err)
+	}
+}
+
+func (sink *NotifySink) renderMail(digest notifyDigest) ([]byte, error) {
+	var subject, body strings.Builder
+	err := sink.SMTP.Subject.Execute(&subject, digest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render subject: %w", err)
+	}
+	err = sink.Body.Execute(&body, digest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render body: %w", err)
+	}
+
+	var msg bytes.Buffer
+	header := func(k, v string) {
+		msg.WriteString(k + ": " + v + "\r\n")
+	}
+	header("From", sink.SMTP.From)
+	header("To", strings.Join(sink.SMTP.To, ", "))
+	// Newlines in the subject would start new headers
+	header("Subject", mime.QEncoding.Encode("utf-8", strings.ReplaceAll(subject.String(), "\n", " ")))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("MIME-Version", "1.0")
+	header("Content-Type", "text/plain; charset=utf-8")
+	header("Content-Transfer-Encoding", "8bit")
+	msg.WriteString("\r\n")
+	msg.WriteString(strings.ReplaceAll(strings.ReplaceAll(body.String(), "\r\n", "\n"), "\n", "\r\n"))
+	return msg.Bytes(), nil
+}
+
+func (sc *SMTPConfig) send(msg []byte, timeout time.Duration) error {
+	host, _, err := net.SplitHostPort(sc.Address)
+	if err != nil {
+		return err
+	}
+	tlsConfig := &tls.Config{ServerName: host, RootCAs: sc.rootCAs}
+
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	if sc.TLS == SMTPImplicitTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", sc.Address, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", sc.Address)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if sc.TLS == SMTPStartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return errors.New("mail server doesn't support STARTTLS")
+		}
+		err = c.StartTLS(tlsConfig)
+		if err != nil {
+			return err
+		}
+	}
+	if sc.Username != "" {
+		// Refuses to send the password unencrypted, unless the server is on localhost
+		err = c.Auth(smtp.PlainAuth("", sc.Username, sc.Password, host))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = c.Mail(sc.From)
+	if err != nil {
+		return err
+	}
+	for _, to := range sc.To {
+		err = c.Rcpt(to)
+		if err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(msg)
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"text/template"
+	"time"
+)
+
+// Just enough of an SMTP server to receive mail from [SMTPConfig.send].
+type fakeSMTPServer struct {
+	listener net.Listener
+	// Nil if STARTTLS isn't offered.
+	tlsConfig *tls.Config
+
+	lock  sync.Mutex
+	mails []fakeMail
+}
+
+type fakeMail struct {
+	Time time.Time
+	TLS  bool
+	// "user:password" as sent with AUTH PLAIN, empty if the client didn't authenticate.
+	Auth string
+	From string
+	To   []string
+	Data string
+}
+
+func newFakeSMTPServer(t *testing.T, tlsConfig *tls.Config) *fakeSMTPServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := &fakeSMTPServer{listener: l, tlsConfig: tlsConfig}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go fs.serve(conn)
+		}
+	}()
+	return fs
+}
+
+func (fs *fakeSMTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) {
+		conn.Write([]byte(line + "\r\n"))
+	}
+
+	var mail fakeMail
+	reply("220 fake ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO":
+			reply("250-fake")
+			if fs.tlsConfig != nil && !mail.TLS {
+				reply("250-STARTTLS")
+			}
+			reply("250 AUTH PLAIN")
+		case "STARTTLS":
+			reply("220 go ahead")
+			tlsConn := tls.Server(conn, fs.tlsConfig)
+			if tlsConn.Handshake() != nil {
+				return
+			}
+			conn = tlsConn
+			r = bufio.NewReader(conn)
+			mail.TLS = true
+		case "AUTH":
+			// AUTH PLAIN <base64 of "\x00user\x00password">
+			_, initial, _ := strings.Cut(arg, " ")
+			creds, err := base64.StdEncoding.DecodeString(initial)
+			if err != nil {
+				reply("501 malformed")
+				continue
+			}
+			parts := strings.Split(string(creds), "\x00")
+			mail.Auth = strings.Join(parts[1:], ":")
+			reply("235 ok")
+		case "MAIL":
+			mail.From = strings.TrimPrefix(arg, "FROM:")
+			reply("250 ok")
+		case "RCPT":
+			mail.To = append(mail.To, strings.TrimPrefix(arg, "TO:"))
+			reply("250 ok")
+		case "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			mail.Data = data.String()
+			mail.Time = time.Now()
+			fs.lock.Lock()
+			fs.mails = append(fs.mails, mail)
+			fs.lock.Unlock()
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+func (fs *fakeSMTPServer) received() []fakeMail {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	return append([]fakeMail(nil), fs.mails...)
+}
+
+// A certificate for 127.0.0.1, and a pool that trusts it.
+func newTestCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	dir := t.TempDir()
+	cfg := &TLSConfig{
+		CertFile: filepath.Join(dir, "cert.pem"),
+		KeyFile:  filepath.Join(dir, "key.pem"),
+		Hosts:    []string{"127.0.0.1"},
+	}
+	err := ensureSelfSignedCert(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return cert, pool
+}
+
+func newTestSMTPSink(address string) *NotifySink {
+	return &NotifySink{
+		Name:    "mail",
+		Kind:    NotifySMTP,
+		Message: template.Must(template.New("message").Parse(defaultNotifyMessage)),
+		Body:    template.Must(template.New("body").Parse(defaultSMTPBody)),
+		Timeout: 5 * time.Second,
+		SMTP: &SMTPConfig{
+			Address:        address,
+			TLS:            SMTPNoTLS,
+			From:           "panel@example.org",
+			To:             []string{"ops@example.org", "oncall@example.org"},
+			Subject:        template.Must(template.New("subject").Parse(defaultSMTPSubject)),
+			DigestWindow:   time.Minute,
+			MaxDigestDelay: time.Hour,
+		},
+	}
+}
+
+func TestSMTPSend(t *testing.T) {
+	cert, pool := newTestCert(t)
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	tests := []struct {
+		name      string
+		mode      SMTPTLSMode
+		offerTLS  bool
+		username  string
+		wantTLS   bool
+		wantError bool
+	}{
+		{name: "none", mode: SMTPNoTLS},
+		{name: "none with auth", mode: SMTPNoTLS, username: "panel"},
+		{name: "starttls", mode: SMTPStartTLS, offerTLS: true, wantTLS: true},
+		{name: "starttls with auth", mode: SMTPStartTLS, offerTLS: true, username: "panel", wantTLS: true},
+		{name: "starttls unsupported", mode: SMTPStartTLS, wantError: true},
+		// Not upgraded just because the server offers it
+		{name: "none with starttls offered", mode: SMTPNoTLS, offerTLS: true},
+	}
+	for _, tt := range tests {
+		var serverTLS *tls.Config
+		if tt.offerTLS {
+			serverTLS = tlsConfig
+		}
+		fs := newFakeSMTPServer(t, serverTLS)
+		sink := newTestSMTPSink(fs.listener.Addr().String())
+		sink.SMTP.TLS = tt.mode
+		sink.SMTP.rootCAs = pool
+		if len(tt.username) > 0 {
+			sink.SMTP.Username = tt.username
+			sink.SMTP.Password = "hunter2"
+		}
+
+		msg, err := sink.renderMail(notifyDigest{Events: []notifyData{{UnitEvent: UnitEvent{Unit: "minecraft"}, Message: "minecraft crashed"}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = sink.SMTP.send(msg, sink.Timeout)
+		if tt.wantError {
+			if err == nil {
+				t.Errorf("%s: send() succeeded", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: send() failed: %s", tt.name, err)
+			continue
+		}
+
+		mails := fs.received()
+		if len(mails) != 1 {
+			t.Errorf("%s: got %d mails, want 1", tt.name, len(mails))
+			continue
+		}
+		mail := mails[0]
+		if mail.TLS != tt.wantTLS {
+			t.Errorf("%s: TLS = %v, want %v", tt.name, mail.TLS, tt.wantTLS)
+		}
+		wantAuth := ""
+		if len(tt.username) > 0 {
+			wantAuth = tt.username + ":hunter2"
+		}
+		if mail.Auth != wantAuth {
+			t.Errorf("%s: AUTH = %q, want %q", tt.name, mail.Auth, wantAuth)
+		}
+		if mail.From != "<panel@example.org>" || strings.Join(mail.To, " ") != "<ops@example.org> <oncall@example.org>" {
+			t.Errorf("%s: from %s to %v", tt.name, mail.From, mail.To)
+		}
+		if !strings.Contains(mail.Data, "Subject: [tmaxhoc] minecraft crashed\r\n") {
+			t.Errorf("%s: mail is missing the subject:\n%s", tt.name, mail.Data)
+		}
+	}
+}
+
+func TestSMTPDigests(t *testing.T) {
+	const window = 200 * time.Millisecond
+	fs := newFakeSMTPServer(t, nil)
+	sink := newTestSMTPSink(fs.listener.Addr().String())
+	sink.SMTP.DigestWindow = window
+	sink.SMTP.MaxDigestDelay = 5 * window
+	sink.start()
+
+	send := func(n int, every time.Duration) {
+		for i := 0; i < n; i++ {
+			sink.enqueue(UnitEvent{Time: time.Now(), Unit: "minecraft", Kind: EventCrash})
+			time.Sleep(every)
+		}
+	}
+	// A burst that lasts longer than the window, but never pauses for it
+	send(6, window/4)
+	time.Sleep(3 * window)
+	// Then one more on its own
+	send(1, 0)
+	time.Sleep(3 * window)
+	// And a stream that never stops, cut off by MaxDigestDelay
+	send(40, window/4)
+	sink.close(5 * time.Second)
+
+	var counts []int
+	for _, mail := range fs.received() {
+		// Body lines are "<time>  <message>"
+		counts = append(counts, strings.Count(mail.Data, "  minecraft crashed\r\n"))
+	}
+	if len(counts) < 4 || counts[0] != 6 || counts[1] != 1 {
+		t.Fatalf("events per mail = %v, want 6, 1, then the stream in at least 2 mails", counts)
+	}
+	for _, n := range counts[2:] {
+		// A quarter window apart, for up to 5 windows
+		if n > 21 {
+			t.Errorf("events per mail = %v, want at most ~20 from the stream", counts)
+		}
+	}
+	total := 0
+	for _, n := range counts {
+		total += n
+	}
+	if total != 47 {
+		t.Errorf("events per mail = %v, want 47 in total", counts)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"text/template"
+	"time"
+)
+
+// A webhook receiver that remembers every request, and answers with the status codes in statuses, then 204s.
+type fakeWebhook struct {
+	*httptest.Server
+
+	lock     sync.Mutex
+	statuses []int
+	requests []fakeWebhookRequest
+}
+
+type fakeWebhookRequest struct {
+	Header http.Header
+	Body   string
+}
+
+func newFakeWebhook(t *testing.T, statuses ...int) *fakeWebhook {
+	fw := &fakeWebhook{statuses: statuses}
+	fw.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		fw.lock.Lock()
+		defer fw.lock.Unlock()
+		fw.requests = append(fw.requests, fakeWebhookRequest{Header: req.Header, Body: string(body)})
+		status := http.StatusNoContent
+		if len(fw.statuses) > 0 {
+			status = fw.statuses[0]
+			fw.statuses = fw.statuses[1:]
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(fw.Close)
+	return fw
+}
+
+func (fw *fakeWebhook) received() []fakeWebhookRequest {
+	fw.lock.Lock()
+	defer fw.lock.Unlock()
+	return append([]fakeWebhookRequest(nil), fw.requests...)
+}
+
+func newTestSink(kind NotifyKind, url string) *NotifySink {
+	return &NotifySink{
+		Name:    "test",
+		Kind:    kind,
+		URL:     url,
+		Message: template.Must(template.New("message").Parse(defaultNotifyMessage)),
+		Timeout: 5 * time.Second,
+	}
+}
+
+func TestNotifyPayloads(t *testing.T) {
+	ev := UnitEvent{
+		Time:   time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		Unit:   "minecraft",
+		Kind:   EventCrash,
+		Actor:  "alice",
+		Detail: "exit status 1",
+	}
+	const message = "minecraft crashed by alice (exit status 1)"
+
+	tests := []struct {
+		name string
+		kind NotifyKind
+		body string
+		want map[string]any
+	}{
+		{name: "webhook", kind: NotifyWebhook, want: map[string]any{
+			"time":    "2024-05-01T12:00:00Z",
+			"unit":    "minecraft",
+			"kind":    "crash",
+			"actor":   "alice",
+			"detail":  "exit status 1",
+			"verb":    "crashed",
+			"message": message,
+		}},
+		{name: "webhook with body", kind: NotifyWebhook, body: `{"unit": "{{.Unit}}", "text": "{{.Message}}"}`, want: map[string]any{
+			"unit": "minecraft",
+			"text": message,
+		}},
+		{name: "discord", kind: NotifyDiscord, want: map[string]any{"content": message}},
+		{name: "slack", kind: NotifySlack, want: map[string]any{"text": message}},
+	}
+	for _, tt := range tests {
+		fw := newFakeWebhook(t)
+		sink := newTestSink(tt.kind, fw.URL)
+		sink.Headers = map[string]string{"Authorization": "Bearer hunter2"}
+		if len(tt.body) > 0 {
+			sink.Body = template.Must(template.New("body").Parse(tt.body))
+		}
+
+		data, err := sink.newNotifyData(ev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = sink.send(data)
+		if err != nil {
+			t.Errorf("%s: send() failed: %s", tt.name, err)
+			continue
+		}
+
+		reqs := fw.received()
+		if len(reqs) != 1 {
+			t.Errorf("%s: got %d requests, want 1", tt.name, len(reqs))
+			continue
+		}
+		if got := reqs[0].Header.Get("Content-Type"); got != "application/json" {
+			t.Errorf("%s: Content-Type = %q", tt.name, got)
+		}
+		if got := reqs[0].Header.Get("Authorization"); got != "Bearer hunter2" {
+			t.Errorf("%s: Authorization = %q", tt.name, got)
+		}
+		var got map[string]any
+		err = json.Unmarshal([]byte(reqs[0].Body), &got)
+		if err != nil {
+			t.Errorf("%s: body %q isn't JSON: %s", tt.name, reqs[0].Body, err)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: body = %v, want %v", tt.name, got, tt.want)
+		}
+		for k, v := range tt.want {
+			if got[k] != v {
+				t.Errorf("%s: body[%q] = %v, want %v", tt.name, k, got[k], v)
+			}
+		}
+	}
+}
+
+func TestNotifyRetries(t *testing.T) {
+	const backoff = 20 * time.Millisecond
+	tests := []struct {
+		name       string
+		maxRetries int
+		statuses   []int
+		wantTries  int
+		wantErr    bool
+	}{
+		{name: "success", maxRetries: 3, wantTries: 1},
+		{name: "recovers", maxRetries: 3, statuses: []int{500, 502}, wantTries: 3},
+		{name: "gives up", maxRetries: 2, statuses: []int{500, 500, 500, 500}, wantTries: 3, wantErr: true},
+		{name: "no retries", maxRetries: 0, statuses: []int{500}, wantTries: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		fw := newFakeWebhook(t, tt.statuses...)
+		sink := newTestSink(NotifySlack, fw.URL)
+		sink.MaxRetries = tt.maxRetries
+		sink.RetryBackoff = backoff
+
+		data, err := sink.newNotifyData(UnitEvent{Unit: "minecraft", Kind: EventCrash})
+		if err != nil {
+			t.Fatal(err)
+		}
+		began := time.Now()
+		err = sink.withRetries(func() error {
+			return sink.send(data)
+		})
+		elapsed := time.Since(began)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: withRetries() = %v, want error = %v", tt.name, err, tt.wantErr)
+		}
+
+		reqs := fw.received()
+		if len(reqs) != tt.wantTries {
+			t.Errorf("%s: got %d requests, want %d", tt.name, len(reqs), tt.wantTries)
+			continue
+		}
+		// Backoff doubles every retry
+		var wantWait time.Duration
+		for i, wait := 1, backoff; i < len(reqs); i, wait = i+1, wait*2 {
+			wantWait += wait
+		}
+		if elapsed < wantWait {
+			t.Errorf("%s: %d attempts took %s, want at least %s", tt.name, len(reqs), elapsed, wantWait)
+		}
+	}
+}
+
+func TestNotifyRateLimit(t *testing.T) {
+	const interval = 50 * time.Millisecond
+	fw := newFakeWebhook(t)
+	sink := newTestSink(NotifyDiscord, fw.URL)
+	sink.MinInterval = interval
+
+	began := time.Now()
+	sink.start()
+	for _, kind := range []UnitEventKind{EventStart, EventCrash, EventStart, EventStop} {
+		sink.enqueue(UnitEvent{Unit: "minecraft", Kind: kind})
+	}
+	sink.close(5 * time.Second)
+	elapsed := time.Since(began)
+
+	reqs := fw.received()
+	if len(reqs) != 4 {
+		t.Fatalf("got %d requests, want 4", len(reqs))
+	}
+	if elapsed < 3*interval {
+		t.Errorf("4 notifications took %s, want at least %s", elapsed, 3*interval)
+	}
+}
+
+func TestLoadNotifyConfigMaxRetries(t *testing.T) {
+	zero, negative := 0, -1
+	tests := []struct {
+		name       string
+		maxRetries *int
+		want       int
+		wantErr    bool
+	}{
+		{name: "default", want: 3},
+		{name: "no retries", maxRetries: &zero, want: 0},
+		{name: "negative", maxRetries: &negative, wantErr: true},
+	}
+	for _, tt := range tests {
+		ck := &configChecker{file: "test.toml"}
+		res := &UnitSystem{}
+		cfg := &config{Notify: []configNotify{{Kind: "slack", URL: "http://localhost", MaxRetries: tt.maxRetries}}}
+		loadNotifyConfig(ck, cfg, res)
+		if tt.wantErr {
+			if len(ck.problems) == 0 {
+				t.Errorf("%s: loadNotifyConfig() reported no problems", tt.name)
+			}
+			continue
+		}
+		if len(ck.problems) > 0 {
+			t.Errorf("%s: loadNotifyConfig() reported %v", tt.name, ck.problems)
+		}
+		if got := res.NotifySinks[0].MaxRetries; got != tt.want {
+			t.Errorf("%s: MaxRetries = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,599 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Archiving of everything services print, so that e.g. the stack trace of a crash outlives the pane.
+//
+// Every pane of a service is piped (with tmux pipe-pane) into `tmaxhoc pipe-output`, which appends it to the
+// service's log file and rotates that. The pipe belongs to the tmux server rather than the panel, so output keeps
+// being archived while the panel is down, and panes adopted on startup are only piped if they aren't already.
+
+const outputLogName = "output.log"
+const outputArchivePrefix = "output-"
+const outputArchiveSuffix = ".log.gz"
+const outputArchiveTimeFormat = "20060102-150405"
+
+type OutputLogPolicy struct {
+	// Log files of a unit go to a subdirectory of this.
+	Dir string
+	// Rotate once the log file gets bigger than this.
+	MaxSize int64
+	// Rotate once the log file is older than this. Zero to only rotate by size.
+	RotateAfter time.Duration
+	// How many rotated (and compressed) log files to keep.
+	KeepFiles int
+	// Drop colors, cursor movement and other terminal control sequences.
+	StripANSI bool
+}
+
+func (cfg *UnitSystem) outputLogDirOf(unit *Unit) string {
+	return filepath.Join(cfg.OutputLog.Dir, sanitizeTmuxName(unit.Name))
+}
+
+// Quote s for /bin/sh.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// Start archiving the output of a pane of serv.
+// Must be called with modelLock held.
+func (cfg *UnitSystem) pipeOutput(ts *TmuxSession, serv *Unitv4Service, proc *TmuxProcess) {
+	op := cfg.OutputLog
+	exe, err := os.Executable()
+	if err == nil {
+		var dir string
+		dir, err = filepath.Abs(cfg.outputLogDirOf(serv.unit))
+		if err == nil {
+			command := []string{
+				"exec", shellQuote(exe), "pipe-output",
+				"-file", shellQuote(filepath.Join(dir, outputLogName)),
+				"-max-size", strconv.FormatInt(op.MaxSize, 10),
+				"-rotate-after", op.RotateAfter.String(),
+				"-keep", strconv.Itoa(op.KeepFiles),
+			}
+			if op.StripANSI {
+				command = append(command, "-strip-ansi")
+			}
+			err = ts.PipePane(proc, strings.Join(command, " "))
+		}
+	}
+	if err != nil {
+		fmt.Printf("[WARN] failed to archive output of %s: %s\n", serv.unit.Name, err)
+	}
+}
+
+// Terminal control sequences: CSI, OSC, DCS/SOS/PM/APC strings, charset selection and the remaining two byte escapes.
+var ansiSequence = regexp.MustCompile(`\x1b\[[0-?]*[ -/]*[@-~]|\x1b\][^\x07\x1b]*(?:\x07|\x1b\\)|\x1b[PX^_][^\x1b]*\x1b\\|\x1b[()][0-9A-Za-z]|\x1b[@-Z\\-_=>]`)
+
+// Turn a line of terminal output into plain text.
+func stripANSI(line []byte) []byte {
+	line = ansiSequence.ReplaceAllLiteral(line, nil)
+
+	// Whatever came before a carriage return got overwritten, e.g. by a progress bar
+	eol := bytes.HasSuffix(line, []byte("\n"))
+	line = bytes.TrimRight(line, "\r\n")
+	if i := bytes.LastIndexByte(line, '\r'); i != -1 {
+		line = line[i+1:]
+	}
+	line = bytes.Map(func(r rune) rune {
+		if r < ' ' && r != '\t' {
+			return -1
+		}
+		return r
+	}, line)
+	if eol {
+		line = append(line, '\n')
+	}
+	return line
+}
+
+// Appends to a log file shared with other writers (one per pane of the unit), rotating it as configured.
+type rotatingLog struct {
+	path string
+	op   OutputLogPolicy
+
+	f *os.File
+	// When the current log file was started, i.e. the previous one rotated.
+	since time.Time
+}
+
+// Open the log file, which may have been rotated away by another writer.
+func (rl *rotatingLog) reopen() error {
+	if rl.f != nil {
+		rl.f.Close()
+		rl.f = nil
+	}
+	err := os.MkdirAll(filepath.Dir(rl.path), 0755)
+	if err != nil {
+		return err
+	}
+	rl.f, err = os.OpenFile(rl.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	rl.since = time.Now()
+	archives, _ := listOutputArchives(filepath.Dir(rl.path))
+	if len(archives) > 0 {
+		rl.since = archives[0].Modified
+	}
+	return nil
+}
+
+// Lock the log file against the other writers, reopening it first if one of them rotated it. Returns its size.
+func (rl *rotatingLog) lock() (int64, error) {
+	for {
+		if rl.f == nil {
+			err := rl.reopen()
+			if err != nil {
+				return 0, err
+			}
+		}
+		err := syscall.Flock(int(rl.f.Fd()), syscall.LOCK_EX)
+		if err != nil {
+			return 0, err
+		}
+		cur, err := rl.f.Stat()
+		if err != nil {
+			rl.unlock()
+			return 0, err
+		}
+		onDisk, err := os.Stat(rl.path)
+		if err == nil && os.SameFile(cur, onDisk) {
+			return cur.Size(), nil
+		}
+		// Somebody else rotated it. Closing the old file releases the lock.
+		err = rl.reopen()
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (rl *rotatingLog) unlock() {
+	syscall.Flock(int(rl.f.Fd()), syscall.LOCK_UN)
+}
+
+func (rl *rotatingLog) write(p []byte) error {
+	size, err := rl.lock()
+	if err != nil {
+		return err
+	}
+
+	tooOld := rl.op.RotateAfter > 0 && time.Since(rl.since) > rl.op.RotateAfter
+	if size > 0 && (size+int64(len(p)) > rl.op.MaxSize || tooOld) {
+		// Other writers wait on the lock of the old file until it's renamed
+		err := rl.rotate()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to rotate %s: %s\n", rl.path, err)
+		}
+		err = rl.reopen()
+		if err != nil {
+			return err
+		}
+		_, err = rl.lock()
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = rl.f.Write(p)
+	rl.unlock()
+	return err
+}
+
+// Move the log file aside, compress it, and drop the oldest archives beyond [OutputLogPolicy.KeepFiles].
+func (rl *rotatingLog) rotate() error {
+	dir := filepath.Dir(rl.path)
+	// Rotating twice within a second (say, a service spewing a stack trace) would otherwise overwrite an archive. Numbered
+	// past the newest one rather than into a gap, which is where the oldest ones were pruned from.
+	now := time.Now()
+	seq := 1
+	archives, _ := listOutputArchives(dir)
+	for _, a := range archives {
+		if a.Modified.Format(outputArchiveTimeFormat) == now.Format(outputArchiveTimeFormat) {
+			seq = max(seq, a.seq+1)
+		}
+	}
+	var archive string
+	for ; ; seq++ {
+		archive = filepath.Join(dir, outputArchiveName(now, seq))
+		if _, err := os.Lstat(archive); errors.Is(err, os.ErrNotExist) {
+			break
+		}
+	}
+	rotated := strings.TrimSuffix(archive, outputArchiveSuffix) + ".log"
+	err := os.Rename(rl.path, rotated)
+	if err != nil {
+		return err
+	}
+
+	err = gzipFile(rotated, archive)
+	if err != nil {
+		return err
+	}
+	os.Remove(rotated)
+
+	archives, err = listOutputArchives(dir)
+	if err != nil {
+		return err
+	}
+	for i := rl.op.KeepFiles; i < len(archives); i++ {
+		os.Remove(filepath.Join(dir, archives[i].Name))
+	}
+	return nil
+}
+
+// Identifies the log file an archive was made from, for [outputLogFollower] to tell whether it's the one it was reading.
+func archiveComment(fi os.FileInfo) string {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("inode %d:%d", st.Dev, st.Ino)
+}
+
+func gzipFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	data, err := io.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Name = filepath.Base(src)
+	if fi, err := in.Stat(); err == nil {
+		zw.Comment = archiveComment(fi)
+	}
+	zw.Write(data)
+	err = zw.Close()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(dest, buf.Bytes(), 0644)
+}
+
+// Copy stdin to the log file a line at a time, until the pane goes away.
+// Reads what gets appended to the log file of a unit, line by line and across rotations. Unlike pane captures, this
+// can't lose its place however much is printed in between.
+type outputLogFollower struct {
+	path string
+	// Nil while the log file is rotated away and not recreated yet.
+	f *os.File
+	// Read past the last complete line.
+	partial []byte
+	// Names of the archives that were there when f was opened.
+	archived map[string]bool
+}
+
+// Start following the log file at path from its current end.
+func followOutputLog(path string) (*outputLogFollower, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	fl := &outputLogFollower{path: path, f: f}
+	fl.archived = fl.listArchived()
+	return fl, nil
+}
+
+func (fl *outputLogFollower) close() {
+	if fl.f != nil {
+		fl.f.Close()
+	}
+}
+
+func (fl *outputLogFollower) listArchived() map[string]bool {
+	res := make(map[string]bool)
+	archives, _ := listOutputArchives(filepath.Dir(fl.path))
+	for _, a := range archives {
+		res[a.Name] = true
+	}
+	return res
+}
+
+// The complete lines appended since the last call.
+func (fl *outputLogFollower) poll() ([]string, error) {
+	var lines []string
+	for {
+		if fl.f == nil {
+			f, err := os.Open(fl.path)
+			if err != nil {
+				return lines, nil
+			}
+			fl.f = f
+		}
+
+		var err error
+		lines, err = fl.readLines(lines)
+		if err != nil {
+			return lines, err
+		}
+		cur, err := os.Stat(fl.path)
+		if err != nil {
+			// In between being rotated away and recreated
+			return lines, nil
+		}
+		open, err := fl.f.Stat()
+		if err != nil {
+			return lines, err
+		}
+		if os.SameFile(open, cur) {
+			return lines, nil
+		}
+
+		// Rotated away. Whoever did that holds the lock of the old file until it's archived, and nothing is written to
+		// it after the rename, so this gets the rest of it.
+		syscall.Flock(int(fl.f.Fd()), syscall.LOCK_SH)
+		lines, err = fl.readLines(lines)
+		read := archiveComment(open)
+		fl.f.Close()
+		fl.f = nil
+		if err != nil {
+			return lines, err
+		}
+		if len(fl.partial) > 0 {
+			lines = append(lines, string(fl.partial))
+			fl.partial = nil
+		}
+
+		// The oldest new archive should be the file just read, any newer ones were rotated in between polls
+		archives, err := listOutputArchives(filepath.Dir(fl.path))
+		if err != nil {
+			return lines, err
+		}
+		var unread []string
+		for i := len(archives) - 1; i >= 0; i-- {
+			if !fl.archived[archives[i].Name] {
+				unread = append(unread, archives[i].Name)
+				fl.archived[archives[i].Name] = true
+			}
+		}
+		for i, name := range unread {
+			archivedLines, comment, err := readOutputArchive(filepath.Join(filepath.Dir(fl.path), name))
+			if err != nil {
+				return lines, err
+			}
+			if i == 0 {
+				if comment == read {
+					continue
+				}
+				lines = append(lines, "[some output was rotated away before it could be read]")
+			}
+			lines = append(lines, archivedLines...)
+		}
+	}
+}
+
+func (fl *outputLogFollower) readLines(lines []string) ([]string, error) {
+	data, err := io.ReadAll(fl.f)
+	if err != nil {
+		return lines, err
+	}
+	data = append(fl.partial, data...)
+	for {
+		line, rest, found := bytes.Cut(data, []byte("\n"))
+		if !found {
+			break
+		}
+		lines = append(lines, strings.TrimSuffix(string(line), "\r"))
+		data = rest
+	}
+	fl.partial = append([]byte(nil), data...)
+	return lines, nil
+}
+
+// The lines of a rotated log file, and its [archiveComment].
+func readOutputArchive(path string) ([]string, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, "", err
+	}
+	var lines []string
+	sc := bufio.NewScanner(zr)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		lines = append(lines, strings.TrimSuffix(sc.Text(), "\r"))
+	}
+	return lines, zr.Comment, sc.Err()
+}
+
+func pipeOutputMain(args []string) int {
+	fs := flag.NewFlagSet("pipe-output", flag.ExitOnError)
+	file := fs.String("file", outputLogName, "Log file to append to")
+	maxSize := fs.Int64("max-size", 10<<20, "Rotate the log file once it gets bigger than this many bytes")
+	rotateAfter := fs.Duration("rotate-after", 0, "Rotate the log file once it is older than this, 0 to only rotate by size")
+	keep := fs.Int("keep", 5, "How many rotated log files to keep")
+	strip := fs.Bool("strip-ansi", false, "Drop terminal control sequences")
+	fs.Parse(args)
+
+	rl := &rotatingLog{
+		path: *file,
+		op: OutputLogPolicy{
+			MaxSize:     *maxSize,
+			RotateAfter: *rotateAfter,
+			KeepFiles:   *keep,
+			StripANSI:   *strip,
+		},
+	}
+	err := rl.reopen()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	r := bufio.NewReader(os.Stdin)
+	for {
+		line, readErr := r.ReadBytes('\n')
+		if len(line) > 0 {
+			if *strip {
+				line = stripANSI(line)
+			}
+			err := rl.write(line)
+			if err != nil {
+				// Keep draining the pipe regardless, tmux doesn't take kindly to it filling up
+				fmt.Fprintf(os.Stderr, "failed to write %s: %s\n", rl.path, err)
+			}
+		}
+		if readErr != nil {
+			break
+		}
+	}
+	return 0
+}
+
+type outputLogInfo struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+
+	// Of archives rotated within the same second, see [outputArchiveName].
+	seq int
+}
+
+// e.g. output-20240501-120000.log.gz, or output-20240501-120000-2.log.gz for the second archive of that second.
+func outputArchiveName(t time.Time, seq int) string {
+	name := outputArchivePrefix + t.Format(outputArchiveTimeFormat)
+	if seq > 1 {
+		name += "-" + strconv.Itoa(seq)
+	}
+	return name + outputArchiveSuffix
+}
+
+// Inverse of [outputArchiveName].
+func parseOutputArchiveName(name string) (time.Time, int, bool) {
+	stamp, ok := strings.CutPrefix(name, outputArchivePrefix)
+	if !ok {
+		return time.Time{}, 0, false
+	}
+	stamp, ok = strings.CutSuffix(stamp, outputArchiveSuffix)
+	if !ok || len(stamp) < len(outputArchiveTimeFormat) {
+		return time.Time{}, 0, false
+	}
+	t, err := time.ParseInLocation(outputArchiveTimeFormat, stamp[:len(outputArchiveTimeFormat)], time.Local)
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+	seq := 1
+	if rest := stamp[len(outputArchiveTimeFormat):]; len(rest) > 0 {
+		digits, ok := strings.CutPrefix(rest, "-")
+		seq, err = strconv.Atoi(digits)
+		if !ok || err != nil || seq < 2 || digits != strconv.Itoa(seq) {
+			return time.Time{}, 0, false
+		}
+	}
+	return t, seq, true
+}
+
+// Rotated log files in dir, newest first.
+func listOutputArchives(dir string) ([]outputLogInfo, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []outputLogInfo
+	for _, e := range entries {
+		name := e.Name()
+		t, seq, ok := parseOutputArchiveName(name)
+		if !ok {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		res = append(res, outputLogInfo{Name: name, Size: fi.Size(), Modified: t, seq: seq})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Modified.Equal(res[j].Modified) {
+			return res[i].seq > res[j].seq
+		}
+		return res[i].Modified.After(res[j].Modified)
+	})
+	return res, nil
+}
+
+// The current log file of a unit followed by the rotated ones, newest first.
+func (cfg *UnitSystem) listOutputLogs(unit *Unit) []outputLogInfo {
+	if cfg.OutputLog == nil {
+		return nil
+	}
+	dir := cfg.outputLogDirOf(unit)
+
+	var res []outputLogInfo
+	if fi, err := os.Stat(filepath.Join(dir, outputLogName)); err == nil {
+		res = append(res, outputLogInfo{Name: outputLogName, Size: fi.Size(), Modified: fi.ModTime()})
+	}
+	archives, _ := listOutputArchives(dir)
+	return append(res, archives...)
+}
+
+func outputLogURL(unit *Unit, name string) string {
+	return "/api/output-log?unit=" + url.QueryEscape(unit.Name) + "&file=" + url.QueryEscape(name)
+}
+
+// GET /api/output-log?unit=<name>&file=<name>
+//
+// Download the archived console output of a unit.
+func apiDownloadOutputLog(w http.ResponseWriter, req *http.Request) {
+	unit := resolveUnitParam(w, req)
+	if unit == nil {
+		return
+	}
+	if unitsys.OutputLog == nil {
+		http.Error(w, "output archiving is disabled", http.StatusNotFound)
+		return
+	}
+
+	name := req.FormValue("file")
+	isArchive := strings.HasPrefix(name, outputArchivePrefix) && strings.HasSuffix(name, outputArchiveSuffix)
+	if name != filepath.Base(name) || (name != outputLogName && !isArchive) {
+		http.Error(w, "invalid log file name '"+name+"'", http.StatusBadRequest)
+		return
+	}
+	p := filepath.Join(unitsys.outputLogDirOf(unit), name)
+	if _, err := os.Stat(p); err != nil {
+		http.Error(w, "no such log file: "+name, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", `attachment; filename="`+sanitizeTmuxName(unit.Name)+"-"+name+`"`)
+	if !isArchive {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	http.ServeFile(w, req, p)
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStripANSI(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"plain\n", "plain\n"},
+		{"no newline", "no newline"},
+		{"\x1b[31mred\x1b[0m\n", "red\n"},
+		{"\x1b[1;32;40mbold\x1b[m text\n", "bold text\n"},
+		{"\x1b]0;window title\x07text\n", "text\n"},
+		{"\x1b]8;;http://example.com\x1b\\link\x1b]8;;\x1b\\\n", "link\n"},
+		{"\x1b(Bcharset\n", "charset\n"},
+		{"\x1b=keypad\x1b>\n", "keypad\n"},
+		{"10%\r50%\r100%\n", "100%\n"},
+		{"windows line\r\n", "windows line\n"},
+		{"tab\tand bell\x07\n", "tab\tand bell\n"},
+	}
+	for _, tt := range tests {
+		if got := string(stripANSI([]byte(tt.in))); got != tt.want {
+			t.Errorf("stripANSI(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func readGzipFile(t *testing.T, path string) string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestRotatingLog(t *testing.T) {
+	dir := t.TempDir()
+	// Left by earlier rotations, the oldest of which is beyond KeepFiles
+	for _, name := range []string{"output-20200101-000000.log.gz", "output-20200102-000000.log.gz"} {
+		err := os.WriteFile(filepath.Join(dir, name), nil, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rl := &rotatingLog{
+		path: filepath.Join(dir, outputLogName),
+		op:   OutputLogPolicy{MaxSize: 16, KeepFiles: 2},
+	}
+	err := rl.reopen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { rl.f.Close() })
+
+	// An empty log is never rotated, even if the line alone is too big
+	for _, line := range []string{"first line, too long\n", "second\n"} {
+		err = rl.write([]byte(line))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := os.ReadFile(rl.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "second\n" {
+		t.Errorf("log file = %q, want %q", data, "second\n")
+	}
+
+	archives, err := listOutputArchives(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(archives) != 2 || archives[1].Name != "output-20200102-000000.log.gz" {
+		t.Fatalf("archives = %+v, want the new one and output-20200102-000000.log.gz", archives)
+	}
+	if got := readGzipFile(t, filepath.Join(dir, archives[0].Name)); got != "first line, too long\n" {
+		t.Errorf("rotated log = %q, want %q", got, "first line, too long\n")
+	}
+}
+
+func TestParseOutputArchiveName(t *testing.T) {
+	stamp := time.Date(2024, 5, 1, 12, 30, 0, 0, time.Local)
+	tests := []struct {
+		name string
+		seq  int
+		ok   bool
+	}{
+		{name: "output-20240501-123000.log.gz", seq: 1, ok: true},
+		{name: "output-20240501-123000-2.log.gz", seq: 2, ok: true},
+		{name: "output-20240501-123000-15.log.gz", seq: 15, ok: true},
+		{name: "output-20240501-123000-1.log.gz"},
+		{name: "output-20240501-123000-02.log.gz"},
+		{name: "output-20240501-123000-.log.gz"},
+		{name: "output-20240501-123000-x.log.gz"},
+		{name: "output-20240501-123000.log"},
+		{name: "output-20240501.log.gz"},
+		{name: "output.log"},
+	}
+	for _, tt := range tests {
+		got, seq, ok := parseOutputArchiveName(tt.name)
+		if ok != tt.ok || (ok && (!got.Equal(stamp) || seq != tt.seq)) {
+			t.Errorf("parseOutputArchiveName(%q) = %s, %d, %v", tt.name, got, seq, ok)
+		}
+		if ok && outputArchiveName(got, seq) != tt.name {
+			t.Errorf("outputArchiveName(%s, %d) = %q, want %q", got, seq, outputArchiveName(got, seq), tt.name)
+		}
+	}
+}
+
+func TestRotatingLogSameSecond(t *testing.T) {
+	dir := t.TempDir()
+	rl := &rotatingLog{
+		path: filepath.Join(dir, outputLogName),
+		op:   OutputLogPolicy{MaxSize: 1, KeepFiles: 10},
+	}
+	err := rl.reopen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { rl.f.Close() })
+
+	// Every line rotates out the one before it, quick enough for most of them to land in the same second
+	lines := []string{"first\n", "second\n", "third\n"}
+	for _, line := range append(lines, "current\n") {
+		err = rl.write([]byte(line))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	archives, err := listOutputArchives(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(archives) != len(lines) {
+		t.Fatalf("archives = %+v, want %d", archives, len(lines))
+	}
+	for i, a := range archives {
+		// Newest first
+		want := lines[len(lines)-1-i]
+		if got := readGzipFile(t, filepath.Join(dir, a.Name)); got != want {
+			t.Errorf("archive %s = %q, want %q", a.Name, got, want)
+		}
+	}
+}
+
+func TestRotatingLogSameSecondPruned(t *testing.T) {
+	dir := t.TempDir()
+	rl := &rotatingLog{
+		path: filepath.Join(dir, outputLogName),
+		op:   OutputLogPolicy{MaxSize: 1, KeepFiles: 2},
+	}
+	err := rl.reopen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { rl.f.Close() })
+
+	// More rotations than KeepFiles, so that the first archives of the second are pruned while it lasts
+	lines := []string{"1\n", "2\n", "3\n", "4\n", "5\n"}
+	for _, line := range append(lines, "current\n") {
+		err = rl.write([]byte(line))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	archives, err := listOutputArchives(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(archives) != 2 {
+		t.Fatalf("archives = %+v, want 2", archives)
+	}
+	for i, want := range []string{"5\n", "4\n"} {
+		if got := readGzipFile(t, filepath.Join(dir, archives[i].Name)); got != want {
+			t.Errorf("archive %s = %q, want %q", archives[i].Name, got, want)
+		}
+	}
+}
+
+func TestOutputLogFollower(t *testing.T) {
+	dir := t.TempDir()
+	rl := &rotatingLog{
+		path: filepath.Join(dir, outputLogName),
+		op:   OutputLogPolicy{MaxSize: 64, KeepFiles: 100},
+	}
+	err := rl.reopen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { rl.f.Close() })
+	write := func(lines ...string) {
+		for _, line := range lines {
+			err := rl.write([]byte(line))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	write("from before\n")
+	fl, err := followOutputLog(rl.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fl.close()
+
+	poll := func(want ...string) {
+		t.Helper()
+		got, err := fl.poll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(got, "|") != strings.Join(want, "|") {
+			t.Errorf("poll() = %q, want %q", got, want)
+		}
+	}
+	poll()
+	write("one\n", "two\r\n")
+	poll("one", "two")
+
+	// Far more than any pane capture would hold, across several rotations
+	var many []string
+	for i := 0; i < 100; i++ {
+		many = append(many, fmt.Sprintf("line %d", i))
+		write(fmt.Sprintf("line %d\n", i))
+	}
+	poll(many...)
+
+	// Half a line is held back until the rest arrives
+	f, err := os.OpenFile(rl.path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("half")
+	poll()
+	f.WriteString(" and the rest\n")
+	f.Close()
+	poll("half and the rest")
+
+	// Archives pruned before they could be read are pointed out
+	rl.op.KeepFiles = 1
+	for i := 0; i < 30; i++ {
+		write(fmt.Sprintf("line %d\n", i))
+	}
+	got, err := fl.poll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) < 2 || got[0] != "[some output was rotated away before it could be read]" || got[len(got)-1] != "line 29" {
+		t.Errorf("poll() = %q, want a note about missing output, then up to line 29", got)
+	}
+}
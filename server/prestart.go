@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Checks run before a service is started, so that e.g. a port still taken by the previous run shows up as a clear error
+// on the panel, instead of a server failing to bind somewhere inside its pane.
+
+// A port or range of ports a service listens on.
+type portSpec struct {
+	// "tcp" or "udp"
+	Proto string
+	First int
+	Last  int
+}
+
+// Accepts e.g. "25565", "25565/tcp" and "2456-2457/udp". The protocol defaults to tcp.
+func parsePortSpec(s string) (portSpec, error) {
+	ps := portSpec{Proto: "tcp"}
+	ports, proto, hasProto := strings.Cut(s, "/")
+	if hasProto {
+		if proto != "tcp" && proto != "udp" {
+			return ps, fmt.Errorf("invalid port '%s': unknown protocol '%s', expected 'tcp' or 'udp'", s, proto)
+		}
+		ps.Proto = proto
+	}
+	first, last, isRange := strings.Cut(ports, "-")
+	var err1, err2 error
+	ps.First, err1 = strconv.Atoi(first)
+	ps.Last = ps.First
+	if isRange {
+		ps.Last, err2 = strconv.Atoi(last)
+	}
+	if err1 != nil || err2 != nil || ps.First < 1 || ps.Last > 65535 || ps.First > ps.Last {
+		return ps, fmt.Errorf("invalid port '%s'", s)
+	}
+	return ps, nil
+}
+
+func (ps portSpec) String() string {
+	if ps.First == ps.Last {
+		return fmt.Sprintf("%d/%s", ps.First, ps.Proto)
+	}
+	return fmt.Sprintf("%d-%d/%s", ps.First, ps.Last, ps.Proto)
+}
+
+// Implemented by lifecycle drivers that know which ports their server uses.
+type PortDeclarer interface {
+	declaredPorts() []portSpec
+}
+
+type PreStartChecks struct {
+	// Must not be listened on (tcp) or bound (udp) by anything.
+	Ports []portSpec
+	// Must not be locked, with flock or fcntl, by anything. Fine if they don't exist.
+	LockFiles []string
+	// Must exist.
+	RequiredPaths []string
+}
+
+// A service can't be started, for the reasons listed.
+type preStartError struct {
+	problems []string
+}
+
+func (e *preStartError) Error() string {
+	return strings.Join(e.problems, "; ")
+}
+
+// Whether err is (or wraps) a [preStartError].
+func isPreStartError(err error) bool {
+	var pse *preStartError
+	return errors.As(err, &pse)
+}
+
+// Must be called with modelLock held.
+func (serv *Unitv4Service) checkPreStart() error {
+	var problems []string
+
+	if len(serv.orphans) > 0 {
+		problems = append(problems, "processes of the previous run are still around: "+joinProcesses(serv.orphans))
+	}
+
+	ports := serv.preStart.Ports
+	if pd, ok := serv.lifecycleDriver.(PortDeclarer); ok {
+		ports = append(ports[:len(ports):len(ports)], pd.declaredPorts()...)
+	}
+	if len(ports) > 0 {
+		inUse, err := portsInUse()
+		if err != nil {
+			fmt.Printf("[WARN] cannot check ports of %s: %s\n", serv.unit.Name, err)
+		}
+		for _, ps := range ports {
+			for port := ps.First; port <= ps.Last; port++ {
+				inode, taken := inUse[ps.Proto][port]
+				if !taken {
+					continue
+				}
+				problem := fmt.Sprintf("port %d/%s is already in use", port, ps.Proto)
+				if owner, ok := socketOwner(inode); ok {
+					problem += " by " + owner.String()
+				}
+				problems = append(problems, problem)
+			}
+		}
+	}
+
+	if len(serv.preStart.LockFiles) > 0 {
+		locks, err := fileLocks()
+		if err != nil {
+			fmt.Printf("[WARN] cannot check lock files of %s: %s\n", serv.unit.Name, err)
+		}
+		for _, path := range serv.preStart.LockFiles {
+			var st syscall.Stat_t
+			if syscall.Stat(path, &st) != nil {
+				continue
+			}
+			holder, held := locks[fileLockKey{devMajor(st.Dev), devMinor(st.Dev), st.Ino}]
+			if !held {
+				continue
+			}
+			problem := fmt.Sprintf("lock file %s is held", path)
+			if holder > 0 {
+				if tp, err := trackProcess(holder); err == nil {
+					problem += " by " + tp.String()
+				}
+			}
+			problems = append(problems, problem)
+		}
+	}
+
+	for _, path := range serv.preStart.RequiredPaths {
+		if _, err := os.Stat(path); err != nil {
+			problems = append(problems, fmt.Sprintf("required path %s does not exist", path))
+		}
+	}
+
+	if len(problems) > 0 {
+		return &preStartError{problems}
+	}
+	return nil
+}
+
+// Socket inodes by protocol and local port, of listening tcp sockets and bound udp sockets.
+func portsInUse() (map[string]map[int]uint64, error) {
+	res := map[string]map[int]uint64{"tcp": {}, "udp": {}}
+	var errs []error
+	for _, table := range []string{"tcp", "tcp6", "udp", "udp6"} {
+		proto := strings.TrimSuffix(table, "6")
+		f, err := os.Open(filepath.Join("/proc/net", table))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		// Header
+		scanner.Scan()
+		for scanner.Scan() {
+			// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 10 {
+				continue
+			}
+			// 0A is TCP_LISTEN. Unconnected udp sockets show up as 07 (TCP_CLOSE), connected ones as 01, both bind the port.
+			if proto == "tcp" && fields[3] != "0A" {
+				continue
+			}
+			_, portHex, ok := strings.Cut(fields[1], ":")
+			if !ok {
+				continue
+			}
+			port, err1 := strconv.ParseUint(portHex, 16, 16)
+			inode, err2 := strconv.ParseUint(fields[9], 10, 64)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			res[proto][int(port)] = inode
+		}
+		f.Close()
+	}
+	return res, errors.Join(errs...)
+}
+
+// The process with a descriptor of the socket, if it can be seen.
+func socketOwner(inode uint64) (trackedProcess, bool) {
+	target := fmt.Sprintf("socket:[%d]", inode)
+	procs, err := os.ReadDir("/proc")
+	if err != nil {
+		return trackedProcess{}, false
+	}
+	for _, p := range procs {
+		pid, err := strconv.Atoi(p.Name())
+		if err != nil {
+			continue
+		}
+		fdDir := filepath.Join("/proc", p.Name(), "fd")
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+			if err == nil && link == target {
+				tp, err := trackProcess(pid)
+				return tp, err == nil
+			}
+		}
+	}
+	return trackedProcess{}, false
+}
+
+type fileLockKey struct {
+	major, minor uint64
+	inode        uint64
+}
+
+// Pids holding a lock on each file, from /proc/locks. -1 for open file description locks, which have no owner pid.
+func fileLocks() (map[fileLockKey]int, error) {
+	f, err := os.Open("/proc/locks")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseFileLocks(f)
+}
+
+// Parse the format of /proc/locks, see [fileLocks].
+func parseFileLocks(r io.Reader) (map[fileLockKey]int, error) {
+	res := make(map[fileLockKey]int)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// e.g. "1: POSIX  ADVISORY  WRITE 1234 fd:01:5678 0 EOF"
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 || fields[1] == "->" {
+			// Waiting for a lock rather than holding it
+			continue
+		}
+		pid, _ := strconv.Atoi(fields[4])
+		dev := strings.Split(fields[5], ":")
+		if len(dev) != 3 {
+			continue
+		}
+		major, err1 := strconv.ParseUint(dev[0], 16, 32)
+		minor, err2 := strconv.ParseUint(dev[1], 16, 32)
+		inode, err3 := strconv.ParseUint(dev[2], 10, 64)
+		if err1 != nil || err2 != nil || err3 != nil {
+			continue
+		}
+		res[fileLockKey{major, minor, inode}] = pid
+	}
+	return res, scanner.Err()
+}
+
+// The encoding of dev_t used by glibc and the kernel, see makedev(3).
+func devMajor(dev uint64) uint64 {
+	return (dev>>8)&0xfff | (dev>>32)&^0xfff
+}
+
+func devMinor(dev uint64) uint64 {
+	return dev&0xff | (dev>>12)&0xffffff00
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestParsePortSpec(t *testing.T) {
+	tests := []struct {
+		in   string
+		want portSpec
+		err  bool
+	}{
+		{in: "25565", want: portSpec{"tcp", 25565, 25565}},
+		{in: "25565/tcp", want: portSpec{"tcp", 25565, 25565}},
+		{in: "34197/udp", want: portSpec{"udp", 34197, 34197}},
+		{in: "2456-2457/udp", want: portSpec{"udp", 2456, 2457}},
+		{in: "1-65535", want: portSpec{"tcp", 1, 65535}},
+		{in: "0", err: true},
+		{in: "65536", err: true},
+		{in: "2457-2456", err: true},
+		{in: "25565/sctp", err: true},
+		{in: "minecraft", err: true},
+		{in: "1-", err: true},
+		{in: "", err: true},
+	}
+	for _, tt := range tests {
+		got, err := parsePortSpec(tt.in)
+		switch {
+		case tt.err && err == nil:
+			t.Errorf("parsePortSpec(%q) = %+v, want an error", tt.in, got)
+		case !tt.err && (err != nil || got != tt.want):
+			t.Errorf("parsePortSpec(%q) = %+v, %v, want %+v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestPortSpecString(t *testing.T) {
+	for _, s := range []string{"25565/tcp", "2456-2457/udp"} {
+		ps, err := parsePortSpec(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ps.String() != s {
+			t.Errorf("parsePortSpec(%q).String() = %q", s, ps.String())
+		}
+	}
+}
+
+func TestDevMajorMinor(t *testing.T) {
+	tests := []struct {
+		dev          uint64
+		major, minor uint64
+	}{
+		{0x801, 8, 1},
+		{0xfd01, 0xfd, 1},
+		{0x2e, 0, 0x2e},
+		// Major 259, minor 300: the minor doesn't fit in the low byte
+		{0x11032c, 259, 300},
+		// Major 4096: the major doesn't fit in 12 bits
+		{0x1000_0000_0000, 4096, 0},
+	}
+	for _, tt := range tests {
+		if got := devMajor(tt.dev); got != tt.major {
+			t.Errorf("devMajor(%#x) = %d, want %d", tt.dev, got, tt.major)
+		}
+		if got := devMinor(tt.dev); got != tt.minor {
+			t.Errorf("devMinor(%#x) = %d, want %d", tt.dev, got, tt.minor)
+		}
+	}
+}
+
+func TestParseFileLocks(t *testing.T) {
+	locks := strings.Join([]string{
+		"1: POSIX  ADVISORY  WRITE 1234 08:01:5678 0 EOF",
+		"2: FLOCK  ADVISORY  WRITE 99 fd:01:42 0 EOF",
+		"2: -> FLOCK  ADVISORY  WRITE 100 fd:01:42 0 EOF",
+		"3: OFDLCK ADVISORY  READ  -1 00:2e:7 0 EOF",
+		"4: POSIX  ADVISORY  WRITE 1 garbage 0 EOF",
+		"5: truncated",
+	}, "\n")
+	got, err := parseFileLocks(strings.NewReader(locks))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[fileLockKey]int{
+		{8, 1, 5678}:  1234,
+		{0xfd, 1, 42}: 99,
+		{0, 0x2e, 7}:  -1,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseFileLocks() = %v, want %v", got, want)
+	}
+}
+
+func TestFileLocks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "world.lock")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		t.Skip("flock not supported:", err)
+	}
+
+	locks, err := fileLocks()
+	if err != nil {
+		t.Skip("cannot read /proc/locks:", err)
+	}
+	var st syscall.Stat_t
+	err = syscall.Stat(path, &st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	holder, held := locks[fileLockKey{devMajor(st.Dev), devMinor(st.Dev), st.Ino}]
+	if !held || holder != os.Getpid() {
+		t.Errorf("lock on %s held = %v by %d, want held by %d", path, held, holder, os.Getpid())
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Process trees, as seen in /proc. Game servers are often started by a wrapper script, which makes the pane's process
+// the wrong one to talk to.
+
+// How long killed processes get to disappear before they're reported, see [Unitv4Service.pruneOrphans].
+const processKillWait = 2 * time.Second
+
+// The interesting fields of /proc/<pid>/stat.
+type procStat struct {
+	State byte
+	Ppid  int
+	// In clock ticks since boot. Tells apart processes that happen to get the same pid.
+	StartTime uint64
+}
+
+func readProcStat(pid int) (procStat, error) {
+	stat, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return procStat{}, err
+	}
+	return parseProcStat(pid, stat)
+}
+
+// Parse the contents of /proc/<pid>/stat.
+func parseProcStat(pid int, stat []byte) (procStat, error) {
+	// The command name in parentheses may contain anything, including spaces and parentheses
+	end := strings.LastIndexByte(string(stat), ')')
+	if end == -1 {
+		return procStat{}, fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+	// Fields from the 3rd on, see proc(5)
+	fields := strings.Fields(string(stat[end+1:]))
+	if len(fields) < 20 {
+		return procStat{}, fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+	res := procStat{State: fields[0][0]}
+	res.Ppid, _ = strconv.Atoi(fields[1])
+	res.StartTime, _ = strconv.ParseUint(fields[19], 10, 64)
+	return res, nil
+}
+
+// A process, as opposed to whatever gets its pid next.
+type trackedProcess struct {
+	Pid       int    `json:"pid"`
+	StartTime uint64 `json:"-"`
+	// See [processExeName].
+	Name string `json:"name"`
+}
+
+func trackProcess(pid int) (trackedProcess, error) {
+	stat, err := readProcStat(pid)
+	if err != nil {
+		return trackedProcess{}, err
+	}
+	return trackedProcess{Pid: pid, StartTime: stat.StartTime, Name: processExeName(pid)}, nil
+}
+
+// Whether the process is still running, zombies don't count.
+func (tp trackedProcess) alive() bool {
+	stat, err := readProcStat(tp.Pid)
+	return err == nil && stat.StartTime == tp.StartTime && stat.State != 'Z'
+}
+
+func (tp trackedProcess) String() string {
+	if len(tp.Name) == 0 {
+		return strconv.Itoa(tp.Pid)
+	}
+	return fmt.Sprintf("%d (%s)", tp.Pid, tp.Name)
+}
+
+// Child pids of every process, by parent pid.
+func processChildren() (map[int][]int, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[int][]int)
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		stat, err := readProcStat(pid)
+		if err != nil {
+			// Exited in the meantime
+			continue
+		}
+		res[stat.Ppid] = append(res[stat.Ppid], pid)
+	}
+	return res, nil
+}
+
+// root and all its descendants, parents before children.
+func processTree(root int) ([]int, error) {
+	children, err := processChildren()
+	if err != nil {
+		return nil, err
+	}
+	return descendantsOf(children, root), nil
+}
+
+// root and all its descendants in children (see [processChildren]), parents before children.
+func descendantsOf(children map[int][]int, root int) []int {
+	res := []int{root}
+	for i := 0; i < len(res); i++ {
+		res = append(res, children[res[i]]...)
+	}
+	return res
+}
+
+// SIGKILL root and everything below it. Returns the processes that were killed, which may take a moment to be gone.
+func killProcessTree(root trackedProcess) ([]trackedProcess, error) {
+	if !root.alive() {
+		return nil, nil
+	}
+	pids, err := processTree(root.Pid)
+	if err != nil {
+		return nil, err
+	}
+	var tree []trackedProcess
+	for _, pid := range pids {
+		tp, err := trackProcess(pid)
+		if err == nil {
+			tree = append(tree, tp)
+		}
+	}
+
+	// Freeze everything first, so that nothing forks or restarts its children while the tree is being taken apart
+	for _, tp := range tree {
+		syscall.Kill(tp.Pid, syscall.SIGSTOP)
+	}
+	for i := len(tree) - 1; i >= 0; i-- {
+		syscall.Kill(tree[i].Pid, syscall.SIGKILL)
+	}
+	return tree, nil
+}
+
+// e.g. "123 (java), 456 (sh)"
+func joinProcesses(tps []trackedProcess) string {
+	strs := make([]string, len(tps))
+	for i, tp := range tps {
+		strs[i] = tp.String()
+	}
+	return strings.Join(strs, ", ")
+}
+
+// Name of the executable pid is running, empty if it's gone.
+func processExeName(pid int) string {
+	exe, err := os.Readlink(filepath.Join("/proc", strconv.Itoa(pid), "exe"))
+	if err == nil {
+		return filepath.Base(exe)
+	}
+	// Not ours to look at, the command name (truncated to 15 characters) is all there is
+	comm, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "comm"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(comm))
+}
+
+// The process running exeName in the tree of proc, closest to the pane first. The pane's own process if there is none.
+func findServerPid(proc *TmuxProcess, exeName string) int {
+	tree, err := processTree(proc.Pid)
+	if err != nil {
+		return proc.Pid
+	}
+	comm := exeName
+	if len(comm) > 15 {
+		comm = comm[:15]
+	}
+	for _, pid := range tree {
+		if name := processExeName(pid); name == exeName || name == comm {
+			return pid
+		}
+	}
+	return proc.Pid
+}
+
+// Send sig to the server process in proc, see [findServerPid].
+func signalServer(proc *TmuxProcess, exeName string, sig syscall.Signal) error {
+	pid := findServerPid(proc, exeName)
+	err := syscall.Kill(pid, sig)
+	if err != nil {
+		return fmt.Errorf("failed to send %s to pid=%d: %w", sig, pid, err)
+	}
+	return nil
+}
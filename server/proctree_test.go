@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A /proc/<pid>/stat line with the given fields, and zeros for the ones in between.
+func procStatLine(pid int, comm string, state byte, ppid int, startTime uint64) string {
+	// State and ppid are fields 3 and 4, the start time is field 22
+	return fmt.Sprintf("%d (%s) %c %d%s %d 0 0 0", pid, comm, state, ppid, strings.Repeat(" 0", 17), startTime)
+}
+
+func TestParseProcStat(t *testing.T) {
+	tests := []struct {
+		stat string
+		want procStat
+		err  bool
+	}{
+		{stat: procStatLine(1234, "bash", 'S', 1, 5678), want: procStat{State: 'S', Ppid: 1, StartTime: 5678}},
+		{stat: procStatLine(1234, "java", 'Z', 99, 1), want: procStat{State: 'Z', Ppid: 99, StartTime: 1}},
+		// The command name is whatever the process set, up to 15 characters
+		{stat: procStatLine(1234, "a) R 7 (b", 'R', 42, 9), want: procStat{State: 'R', Ppid: 42, StartTime: 9}},
+		{stat: procStatLine(1234, "with space", 'D', 3, 12345678901), want: procStat{State: 'D', Ppid: 3, StartTime: 12345678901}},
+		{stat: "1234 bash S 1", err: true},
+		{stat: "1234 (bash) S 1 0 0", err: true},
+		{stat: "", err: true},
+	}
+	for _, tt := range tests {
+		got, err := parseProcStat(1234, []byte(tt.stat))
+		switch {
+		case tt.err && err == nil:
+			t.Errorf("parseProcStat(%q) = %+v, want an error", tt.stat, got)
+		case !tt.err && (err != nil || got != tt.want):
+			t.Errorf("parseProcStat(%q) = %+v, %v, want %+v", tt.stat, got, err, tt.want)
+		}
+	}
+}
+
+func TestReadProcStat(t *testing.T) {
+	stat, err := readProcStat(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Ppid != os.Getppid() {
+		t.Errorf("readProcStat(self).Ppid = %d, want %d", stat.Ppid, os.Getppid())
+	}
+	if stat.State != 'R' && stat.State != 'S' {
+		t.Errorf("readProcStat(self).State = %c, want R or S", stat.State)
+	}
+
+	tp, err := trackProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tp.alive() {
+		t.Errorf("trackProcess(self).alive() = false")
+	}
+	tp.StartTime++
+	if tp.alive() {
+		t.Errorf("alive() = true for a different start time")
+	}
+}
+
+func TestKillProcessTree(t *testing.T) {
+	// A wrapper with a child of its own, like a server started through sh -c
+	cmd := exec.Command("sh", "-c", "sleep 60 & wait")
+	err := cmd.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	waited := make(chan error, 1)
+	go func() { waited <- cmd.Wait() }()
+
+	root, err := trackProcess(cmd.Process.Pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Give sh a moment to start sleep
+	var pids []int
+	for deadline := time.Now().Add(2 * time.Second); len(pids) < 2 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		pids, _ = processTree(root.Pid)
+	}
+	if len(pids) < 2 {
+		t.Fatalf("processTree(sh) = %v, want sh and sleep", pids)
+	}
+
+	killed, err := killProcessTree(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(killed) != len(pids) || killed[0] != root {
+		t.Errorf("killProcessTree() = %v, want the %d processes of %v", killed, len(pids), pids)
+	}
+
+	select {
+	case <-waited:
+	case <-time.After(processKillWait):
+		t.Fatal("sh still running after SIGKILL")
+	}
+	// sleep was reparented to whatever reaps orphans here, give it a moment too
+	deadline := time.Now().Add(processKillWait)
+	for _, tp := range killed {
+		for tp.alive() && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if tp.alive() {
+			t.Errorf("%s still running after SIGKILL", tp)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// Minimal client of the Source RCON protocol, as spoken by e.g. Factorio.
+// See https://developer.valvesoftware.com/wiki/Source_RCON_Protocol
+
+const rconTimeout = 5 * time.Second
+
+// Returned by [rconCommand] when the command was sent, but no reply came back. Commands like Factorio's /quit take the
+// server down before it gets to reply.
+var errRconNoReply = errors.New("RCON command sent, but got no reply")
+
+const (
+	rconTypeResponse    int32 = 0
+	rconTypeExecCommand int32 = 2
+	rconTypeAuthReply   int32 = 2
+	rconTypeAuth        int32 = 3
+)
+
+// Bodies bigger than this are sent in several packets, and such packets are rejected by servers.
+const rconMaxPacket = 4096
+
+type rconPacket struct {
+	Id   int32
+	Type int32
+	Body string
+}
+
+func writeRconPacket(w io.Writer, p rconPacket) error {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, int32(4+4+len(p.Body)+2))
+	binary.Write(&buf, binary.LittleEndian, p.Id)
+	binary.Write(&buf, binary.LittleEndian, p.Type)
+	buf.WriteString(p.Body)
+	buf.Write([]byte{0, 0})
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func readRconPacket(r io.Reader) (rconPacket, error) {
+	var size int32
+	err := binary.Read(r, binary.LittleEndian, &size)
+	if err != nil {
+		return rconPacket{}, err
+	}
+	if size < 10 || size > rconMaxPacket+10 {
+		return rconPacket{}, fmt.Errorf("invalid RCON packet size %d", size)
+	}
+	data := make([]byte, size)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return rconPacket{}, err
+	}
+	return rconPacket{
+		Id:   int32(binary.LittleEndian.Uint32(data[0:4])),
+		Type: int32(binary.LittleEndian.Uint32(data[4:8])),
+		Body: string(bytes.TrimRight(data[8:], "\x00")),
+	}, nil
+}
+
+// Log in to the RCON server at addr, run command and return its output.
+func rconCommand(addr, password, command string) (string, error) {
+	if len(command) > rconMaxPacket {
+		return "", errors.New("RCON command too long")
+	}
+	conn, err := net.DialTimeout("tcp", addr, rconTimeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(rconTimeout))
+
+	err = writeRconPacket(conn, rconPacket{Id: 1, Type: rconTypeAuth, Body: password})
+	if err != nil {
+		return "", err
+	}
+	for {
+		p, err := readRconPacket(conn)
+		if err != nil {
+			return "", err
+		}
+		// Some servers send an empty response before the actual reply
+		if p.Type != rconTypeAuthReply {
+			continue
+		}
+		if p.Id == -1 {
+			return "", errors.New("RCON authentication failed")
+		}
+		break
+	}
+
+	err = writeRconPacket(conn, rconPacket{Id: 2, Type: rconTypeExecCommand, Body: command})
+	if err != nil {
+		return "", err
+	}
+	for {
+		p, err := readRconPacket(conn)
+		if err != nil {
+			return "", fmt.Errorf("%w: %w", errRconNoReply, err)
+		}
+		if p.Id == 2 && p.Type == rconTypeResponse {
+			return p.Body, nil
+		}
+	}
+}
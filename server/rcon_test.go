@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+// Accepts a single RCON connection with password "hunter2", and hands every command to handle. The connection is
+// closed without a reply if handle returns false.
+func newFakeRconServer(t *testing.T, handle func(command string) (string, bool)) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			p, err := readRconPacket(conn)
+			if err != nil {
+				return
+			}
+			switch p.Type {
+			case rconTypeAuth:
+				id := p.Id
+				if p.Body != "hunter2" {
+					id = -1
+				}
+				writeRconPacket(conn, rconPacket{Id: id, Type: rconTypeAuthReply})
+			case rconTypeExecCommand:
+				out, ok := handle(p.Body)
+				if !ok {
+					return
+				}
+				writeRconPacket(conn, rconPacket{Id: p.Id, Type: rconTypeResponse, Body: out})
+			}
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestRconCommand(t *testing.T) {
+	players := func(command string) (string, bool) {
+		return "Online players (1):\n  alice (online)", command == "/players online"
+	}
+	out, err := rconCommand(newFakeRconServer(t, players), "hunter2", "/players online")
+	if err != nil || out != "Online players (1):\n  alice (online)" {
+		t.Errorf("rconCommand() = %q, %v", out, err)
+	}
+
+	_, err = rconCommand(newFakeRconServer(t, players), "wrong", "/players online")
+	if err == nil || errors.Is(err, errRconNoReply) {
+		t.Errorf("rconCommand() with the wrong password = %v, want an authentication error", err)
+	}
+
+	// Like /quit, which takes the server down before it replies
+	quit := func(command string) (string, bool) { return "", false }
+	_, err = rconCommand(newFakeRconServer(t, quit), "hunter2", "/quit")
+	if !errors.Is(err, errRconNoReply) {
+		t.Errorf("rconCommand() without a reply = %v, want %v", err, errRconNoReply)
+	}
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// On-demand snapshots of a unit's [Unitv4Service.dataPaths], taken and restored from the panel.
+// Archives have the same format as scheduled backups (see [writeBackupArchive]), but live in their own directory
+// so that they aren't subject to backup retention.
+
+var snapshotsPage *template.Template
+
+type snapshotInfo struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	Created time.Time `json:"created"`
+}
+
+type snapshotsPageData struct {
+	Unit      string
+	IsStopped bool
+	// Taking and restoring snapshots are only served on admin listeners.
+	IsAdmin   bool
+	Snapshots []snapshotInfo
+}
+
+func (cfg *UnitSystem) snapshotDirOf(unit *Unit) string {
+	return filepath.Join(cfg.backupDirOf(unit), "snapshots")
+}
+
+func parseSnapshotsTemplate(unitsys *UnitSystem) (*template.Template, error) {
+	funcs := template.FuncMap{
+		"mebibytes": func(n int64) float64 { return float64(n) / (1 << 20) },
+	}
+	return template.New("snapshots.html").Funcs(funcs).ParseFiles(filepath.Join(unitsys.StaticFilesDir, "snapshots.html"))
+}
+
+func listSnapshots(dir string) ([]snapshotInfo, error) {
+	archives, err := listBackupArchives(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]snapshotInfo, 0, len(archives))
+	for _, a := range archives {
+		fi, err := os.Stat(a.Path)
+		if err != nil {
+			continue
+		}
+		res = append(res, snapshotInfo{
+			Name:    filepath.Base(a.Path),
+			Size:    fi.Size(),
+			Created: a.Created,
+		})
+	}
+	return res, nil
+}
+
+// Append a line to the snapshot action log of the unit, so there is a trail of who restored what.
+// detail, e.g. why the action failed, is put at the end of the line if not empty.
+func recordSnapshotAction(dir string, action string, snapshot string, detail string, req *http.Request) {
+	line := fmt.Sprintf("%s\t%s\t%s\t%s", time.Now().Format(time.RFC3339), action, snapshot, req.RemoteAddr)
+	if detail != "" {
+		line += "\t" + strings.ReplaceAll(detail, "\n", " ")
+	}
+	line += "\n"
+	fmt.Print("snapshot action: " + line)
+
+	err := os.MkdirAll(dir, 0755)
+	if err == nil {
+		var f *os.File
+		f, err = os.OpenFile(filepath.Join(dir, "actions.log"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err == nil {
+			_, err = f.WriteString(line)
+			f.Close()
+		}
+	}
+	if err != nil {
+		fmt.Printf("[WARN] failed to record snapshot action: %s\n", err)
+	}
+}
+
+// Set [Unitv4Service.busy] to what, unless some other operation is already going on. On failure, an error response is
+// written and false is returned. Undo with [markNotBusy].
+func markBusy(w http.ResponseWriter, unit *Unit, serv *Unitv4Service, what string) bool {
+	modelLock.Lock()
+	defer modelLock.Unlock()
+	if serv.busy != "" {
+		http.Error(w, "unit "+unit.Name+" is busy "+serv.busy, http.StatusConflict)
+		return false
+	}
+	serv.busy = what
+	return true
+}
+
+func markNotBusy(serv *Unitv4Service) {
+	modelLock.Lock()
+	serv.busy = ""
+	modelLock.Unlock()
+}
+
+// Resolve the unit of a snapshot request, which must be a service with DataPaths.
+// On failure, an error response is written and nil is returned.
+func resolveSnapshotUnit(w http.ResponseWriter, req *http.Request) (*Unit, *Unitv4Service) {
+	unit := resolveUnitParam(w, req)
+	if unit == nil {
+		return nil, nil
+	}
+	serv, ok := unit.v.(*Unitv4Service)
+	if !ok || len(serv.dataPaths) == 0 {
+		http.Error(w, "unit "+unit.Name+" has no DataPaths configured", http.StatusBadRequest)
+		return nil, nil
+	}
+	return unit, serv
+}
+
+// Resolve the "snapshot" form value to the path of an existing snapshot archive of the unit.
+// On failure, an error response is written and "" is returned.
+func resolveSnapshotParam(w http.ResponseWriter, req *http.Request, unit *Unit) string {
+	name := req.FormValue("snapshot")
+	if name == "" || name != filepath.Base(name) || !strings.HasSuffix(name, backupSuffix) {
+		http.Error(w, "invalid snapshot name '"+name+"'", http.StatusBadRequest)
+		return ""
+	}
+	p := filepath.Join(unitsys.snapshotDirOf(unit), name)
+	if _, err := os.Stat(p); err != nil {
+		http.Error(w, "no such snapshot: "+name, http.StatusNotFound)
+		return ""
+	}
+	return p
+}
+
+// GET /snapshots?unit=<name>
+func httpSnapshotsPage(w http.ResponseWriter, req *http.Request) {
+	unit, serv := resolveSnapshotUnit(w, req)
+	if unit == nil {
+		return
+	}
+
+	snapshots, err := listSnapshots(unitsys.snapshotDirOf(unit))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if wantsJSON(req) {
+		writeJSON(w, http.StatusOK, snapshots)
+		return
+	}
+
+	modelLock.RLock()
+	data := snapshotsPageData{
+		Unit:      unit.Name,
+		IsStopped: serv.status() == Stopped,
+		IsAdmin:   isAdminRequest(req),
+		Snapshots: snapshots,
+	}
+	modelLock.RUnlock()
+
+	err = snapshotsPage.Execute(w, data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func snapshotsPageURL(unit *Unit) string {
+	return "/snapshots?unit=" + url.QueryEscape(unit.Name)
+}
+
+// POST /api/snapshot-unit unit=<name>
+func apiSnapshotUnit(w http.ResponseWriter, req *http.Request) {
+	unit, serv := resolveSnapshotUnit(w, req)
+	if unit == nil {
+		return
+	}
+
+	if !markBusy(w, unit, serv, "taking a snapshot") {
+		return
+	}
+	dir := unitsys.snapshotDirOf(unit)
+	p, err := writeBackupArchive(dir, unit.Name, serv.dataPaths)
+	markNotBusy(serv)
+
+	if err != nil {
+		http.Error(w, "failed to take snapshot: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	name := filepath.Base(p)
+	recordSnapshotAction(dir, "snapshot", name, "", req)
+
+	if wantsJSON(req) {
+		writeJSON(w, http.StatusOK, map[string]string{"unit": unit.Name, "snapshot": name})
+		return
+	}
+	http.Redirect(w, req, snapshotsPageURL(unit), http.StatusFound)
+}
+
+// GET /api/snapshot-download?unit=<name>&snapshot=<file>
+func apiDownloadSnapshot(w http.ResponseWriter, req *http.Request) {
+	unit, _ := resolveSnapshotUnit(w, req)
+	if unit == nil {
+		return
+	}
+	p := resolveSnapshotParam(w, req, unit)
+	if p == "" {
+		return
+	}
+
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filepath.Base(p)+`"`)
+	http.ServeFile(w, req, p)
+}
+
+// POST /api/restore-snapshot unit=<name> snapshot=<file>
+func apiRestoreSnapshot(w http.ResponseWriter, req *http.Request) {
+	unit, serv := resolveSnapshotUnit(w, req)
+	if unit == nil {
+		return
+	}
+	p := resolveSnapshotParam(w, req, unit)
+	if p == "" {
+		return
+	}
+
+	// Keep the unit from being started while we're swapping out its data
+	if !markBusy(w, unit, serv, "restoring a snapshot") {
+		return
+	}
+	modelLock.RLock()
+	stopped := serv.status() == Stopped
+	modelLock.RUnlock()
+	if !stopped {
+		markNotBusy(serv)
+		http.Error(w, "unit "+unit.Name+" must be stopped before restoring a snapshot", http.StatusConflict)
+		return
+	}
+	err := restoreSnapshot(p, serv.dataPaths)
+	markNotBusy(serv)
+
+	dir := unitsys.snapshotDirOf(unit)
+	if err != nil {
+		recordSnapshotAction(dir, "restore-failed", filepath.Base(p), err.Error(), req)
+		http.Error(w, "failed to restore snapshot: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	recordSnapshotAction(dir, "restore", filepath.Base(p), "", req)
+
+	if wantsJSON(req) {
+		writeJSON(w, http.StatusOK, map[string]string{"unit": unit.Name, "snapshot": filepath.Base(p)})
+		return
+	}
+	http.Redirect(w, req, snapshotsPageURL(unit), http.StatusFound)
+}
+
+// Replace dataPaths with the contents of the archive. The current data is renamed to <path>.pre-restore-<time>
+// rather than deleted. If anything goes wrong, the current data is put back in place.
+func restoreSnapshot(archive string, dataPaths []string) error {
+	// Archive entries are stored under the base name of the path they came from
+	roots := make(map[string]string)
+	for _, p := range dataPaths {
+		roots[filepath.Base(filepath.Clean(p))] = filepath.Clean(p)
+	}
+
+	// LUT from data path to where it has been moved to
+	movedAside := make(map[string]string)
+	var created []string
+	rollback := func() {
+		for _, p := range created {
+			os.RemoveAll(p)
+		}
+		for p, aside := range movedAside {
+			os.Rename(aside, p)
+		}
+	}
+
+	stamp := time.Now().Format(backupTimeFormat)
+	for _, p := range roots {
+		_, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		aside := p + ".pre-restore-" + stamp
+		for i := 1; ; i++ {
+			if _, err := os.Lstat(aside); os.IsNotExist(err) {
+				break
+			}
+			aside = fmt.Sprintf("%s.pre-restore-%s-%d", p, stamp, i)
+		}
+		err = os.Rename(p, aside)
+		if err != nil {
+			rollback()
+			return err
+		}
+		movedAside[p] = aside
+	}
+	for _, p := range roots {
+		created = append(created, p)
+	}
+
+	err := extractSnapshot(archive, roots)
+	if err != nil {
+		rollback()
+		return err
+	}
+	return nil
+}
+
+func extractSnapshot(archive string, roots map[string]string) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Name == backupManifestName {
+			continue
+		}
+
+		target, err := snapshotEntryTarget(hdr.Name, roots)
+		if err != nil {
+			return err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, hdr.FileInfo().Mode().Perm()|0700)
+		case tar.TypeReg:
+			err = extractRegularFile(tr, target, hdr)
+		case tar.TypeSymlink:
+			// A symlink pointing outside the data directory could be used to write anywhere by a later entry
+			linkTarget := hdr.Linkname
+			if !filepath.IsAbs(linkTarget) {
+				linkTarget = filepath.Join(filepath.Dir(target), linkTarget)
+			}
+			root := roots[strings.SplitN(filepath.ToSlash(filepath.Clean(hdr.Name)), "/", 2)[0]]
+			if !isWithin(root, linkTarget) {
+				return fmt.Errorf("archive entry %s: symlink points outside of %s", hdr.Name, root)
+			}
+			err = os.MkdirAll(filepath.Dir(target), 0755)
+			if err == nil {
+				err = os.Symlink(hdr.Linkname, target)
+			}
+		default:
+			fmt.Printf("[WARN] skipping archive entry %s of unsupported type %c\n", hdr.Name, hdr.Typeflag)
+		}
+		if err != nil {
+			return fmt.Errorf("archive entry %s: %w", hdr.Name, err)
+		}
+	}
+}
+
+func extractRegularFile(tr *tar.Reader, target string, hdr *tar.Header) error {
+	err := os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+	// O_EXCL, so that we never write through a symlink that's already there
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, hdr.FileInfo().Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, tr)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	err = out.Close()
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(target, hdr.ModTime, hdr.ModTime)
+}
+
+// Map an archive entry name to where it should be extracted to, rejecting anything that would end up outside of
+// the data paths.
+func snapshotEntryTarget(name string, roots map[string]string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(name))
+	if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("archive entry %s: path escapes the data directory", name)
+	}
+
+	first, rest, _ := strings.Cut(filepath.ToSlash(clean), "/")
+	root, ok := roots[first]
+	if !ok {
+		return "", fmt.Errorf("archive entry %s: doesn't belong to any of the DataPaths", name)
+	}
+
+	target := filepath.Join(root, filepath.FromSlash(rest))
+	if !isWithin(root, target) {
+		return "", fmt.Errorf("archive entry %s: path escapes the data directory", name)
+	}
+
+	// Refuse to go through symlinks extracted earlier, even if they point somewhere legitimate
+	for dir := filepath.Dir(target); isWithin(root, dir) && dir != root; dir = filepath.Dir(dir) {
+		fi, err := os.Lstat(dir)
+		if err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("archive entry %s: path goes through a symlink", name)
+		}
+	}
+
+	return target, nil
+}
+
+func isWithin(root string, p string) bool {
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		return false
+	}
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSnapshotEntryTarget(t *testing.T) {
+	dir := t.TempDir()
+	world := filepath.Join(dir, "world")
+	config := filepath.Join(dir, "cfg")
+	roots := map[string]string{"world": world, "config": config}
+
+	// A symlink extracted by an earlier entry
+	err := os.MkdirAll(world, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink(dir, filepath.Join(world, "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		// Empty if the entry should be rejected
+		want string
+	}{
+		{"world", world},
+		{"world/region/r.0.0.mca", filepath.Join(world, "region", "r.0.0.mca")},
+		{"world/../config/server.properties", filepath.Join(config, "server.properties")},
+		{"./config/ops.json", filepath.Join(config, "ops.json")},
+		{"../etc/passwd", ""},
+		{"..", ""},
+		{"/etc/passwd", ""},
+		{"world/../../etc/passwd", ""},
+		{"other/file", ""},
+		{"world/link/file", ""},
+	}
+	for _, tt := range tests {
+		got, err := snapshotEntryTarget(tt.name, roots)
+		switch {
+		case tt.want == "" && err == nil:
+			t.Errorf("snapshotEntryTarget(%q) = %q, want an error", tt.name, got)
+		case tt.want != "" && (err != nil || got != tt.want):
+			t.Errorf("snapshotEntryTarget(%q) = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestIsWithin(t *testing.T) {
+	tests := []struct {
+		root, p string
+		want    bool
+	}{
+		{"/srv/world", "/srv/world", true},
+		{"/srv/world", "/srv/world/region", true},
+		{"/srv/world", "/srv/world/../world/x", true},
+		{"/srv/world", "/srv/worlds", false},
+		{"/srv/world", "/srv/world/..", false},
+		{"/srv/world", "/srv", false},
+		{"/srv/world", "/", false},
+		{"/srv/world", "/srv/world/..x", true},
+	}
+	for _, tt := range tests {
+		if got := isWithin(tt.root, tt.p); got != tt.want {
+			t.Errorf("isWithin(%q, %q) = %v, want %v", tt.root, tt.p, got, tt.want)
+		}
+	}
+}
+
+func TestSnapshotsPageEscapes(t *testing.T) {
+	tmpl, err := parseSnapshotsTemplate(&UnitSystem{StaticFilesDir: "../static"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := snapshotsPageData{
+		Unit:      `a&b <script>alert("x")</script>`,
+		IsStopped: true,
+		IsAdmin:   true,
+		Snapshots: []snapshotInfo{{Name: `it's.tar.gz`}},
+	}
+
+	var sb strings.Builder
+	err = tmpl.Execute(&sb, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := sb.String()
+	if strings.Contains(page, "<script>alert") {
+		t.Errorf("snapshots page contains unescaped markup:\n%s", page)
+	}
+	// Query parameters are escaped once, not twice
+	if !strings.Contains(page, "unit=a%26b%20%3cscript%3e") {
+		t.Errorf("snapshots page doesn't link to the unit properly:\n%s", page)
+	}
+}
+
+func TestSnapshotAndRestoreActions(t *testing.T) {
+	data := filepath.Join(t.TempDir(), "world")
+	err := os.MkdirAll(data, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unit := &Unit{Name: "minecraft"}
+	serv := &Unitv4Service{unit: unit, dataPaths: []string{data}}
+	unit.v = serv
+
+	prev := unitsys
+	unitsys = &UnitSystem{units: []*Unit{unit}, BackupDir: t.TempDir()}
+	t.Cleanup(func() { unitsys = prev })
+	dir := unitsys.snapshotDirOf(unit)
+
+	post := func(handler http.HandlerFunc, form string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(form))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Accept", "application/json")
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+
+	// Not while something else is going on
+	serv.busy = "restoring a snapshot"
+	if w := post(apiSnapshotUnit, "unit=minecraft"); w.Code != http.StatusConflict {
+		t.Errorf("snapshot while busy: status %d, want %d", w.Code, http.StatusConflict)
+	}
+	serv.busy = ""
+
+	// Twice within the same second, most likely
+	for i := 0; i < 2; i++ {
+		if w := post(apiSnapshotUnit, "unit=minecraft"); w.Code != http.StatusOK {
+			t.Fatalf("snapshot: status %d: %s", w.Code, w.Body)
+		}
+	}
+	snapshots, err := listSnapshots(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 2 || snapshots[0].Name == snapshots[1].Name {
+		t.Errorf("snapshots = %+v, want 2 distinct ones", snapshots)
+	}
+	if serv.busy != "" {
+		t.Errorf("busy = %q after the snapshot", serv.busy)
+	}
+
+	broken := "minecraft-20240501-120000.tar.gz"
+	err = os.WriteFile(filepath.Join(dir, broken), []byte("not a tarball"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := post(apiRestoreSnapshot, "unit=minecraft&snapshot="+broken); w.Code != http.StatusInternalServerError {
+		t.Errorf("restore of a broken snapshot: status %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+	if _, err := os.Stat(data); err != nil {
+		t.Errorf("data wasn't put back after the failed restore: %s", err)
+	}
+
+	log, err := os.ReadFile(filepath.Join(dir, "actions.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(log), "\n"), "\n")
+	if len(lines) != 3 || !strings.Contains(lines[2], "\trestore-failed\t"+broken+"\t") {
+		t.Errorf("actions.log doesn't end with the failed restore:\n%s", log)
+	}
+}
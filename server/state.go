@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Why a service last stopped, see [Unitv4Service.lastStopReason].
+const (
+	stopReasonRequested = "stop requested"
+	stopReasonForced    = "force stopped"
+	stopReasonExited    = "exited on its own"
+	stopReasonOffline   = "exited while the panel was not running"
+)
+
+// Runtime state of the panel that has to survive a restart, written to [UnitSystem.StateFile].
+type PanelState struct {
+	Units map[string]*UnitState `json:"units"`
+	// Units created with [UnitSystem.InstantiateTemplate], in the order they were created.
+	Instances []InstanceState `json:"instances,omitempty"`
+}
+
+type UnitState struct {
+	StoppingAttempt time.Time `json:"stoppingAttempt"`
+	// See [Unitv4Service.pendingStopReason].
+	PendingStopReason string    `json:"pendingStopReason,omitempty"`
+	LastStarted       time.Time `json:"lastStarted"`
+	LastStopped       time.Time `json:"lastStopped"`
+	LastStopReason    string    `json:"lastStopReason,omitempty"`
+	Crashes           int       `json:"crashes,omitempty"`
+	// Panes the service was running in, to tell whether the panes found on the next start are still the same processes.
+	Panes []PaneState `json:"panes,omitempty"`
+}
+
+type PaneState struct {
+	PaneId int `json:"paneId"`
+	Pid    int `json:"pid"`
+}
+
+type InstanceState struct {
+	Template string `json:"template"`
+	Instance string `json:"instance"`
+}
+
+// Must be called with modelLock held.
+func (cfg *UnitSystem) currentState() *PanelState {
+	state := &PanelState{Units: make(map[string]*UnitState)}
+	for _, unit := range cfg.units {
+		if unit.runtimeInstance {
+			state.Instances = append(state.Instances, InstanceState{Template: unit.Template, Instance: unit.Instance})
+		}
+
+		serv, ok := unit.v.(*Unitv4Service)
+		if !ok {
+			continue
+		}
+		us := &UnitState{
+			StoppingAttempt:   serv.stoppingAttempt,
+			PendingStopReason: serv.pendingStopReason,
+			LastStarted:       serv.lastStarted,
+			LastStopped:       serv.lastStopped,
+			LastStopReason:    serv.lastStopReason,
+			Crashes:           serv.crashes,
+		}
+		for _, proc := range serv.procs {
+			us.Panes = append(us.Panes, PaneState{PaneId: proc.PaneId, Pid: proc.Pid})
+		}
+		state.Units[unit.Name] = us
+	}
+	return state
+}
+
+// Write data to path such that readers see either the old or the new contents, never something in between.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(perm)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Write the state file, if anything changed since the last time.
+// Must be called with modelLock held exclusively.
+func (cfg *UnitSystem) saveState() {
+	if cfg.StateFile == "" {
+		return
+	}
+
+	data, err := json.MarshalIndent(cfg.currentState(), "", "  ")
+	if err != nil {
+		fmt.Printf("[ERROR] failed to serialize state: %s\n", err)
+		return
+	}
+	if bytes.Equal(data, cfg.savedState) {
+		return
+	}
+
+	err = writeFileAtomic(cfg.StateFile, data, 0644)
+	if err != nil {
+		fmt.Printf("[ERROR] failed to write state file %s: %s\n", cfg.StateFile, err)
+		return
+	}
+	cfg.savedState = data
+}
+
+// Read the state file, and recreate the units instantiated at runtime before the last shutdown.
+// Call before the first [TmuxSession.PollAndPrune], so that the panes of those units are adopted, and pass the
+// result to [UnitSystem.reconcileState] afterwards.
+// Nullable, if there is no state to restore.
+func (cfg *UnitSystem) loadState() *PanelState {
+	if cfg.StateFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(cfg.StateFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Printf("[WARN] failed to read state file %s: %s\n", cfg.StateFile, err)
+		}
+		return nil
+	}
+	var state PanelState
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		fmt.Printf("[WARN] ignoring broken state file %s: %s\n", cfg.StateFile, err)
+		return nil
+	}
+
+	for _, inst := range state.Instances {
+		_, err := cfg.InstantiateTemplate(inst.Template, inst.Instance)
+		if err != nil {
+			fmt.Printf("[WARN] failed to recreate instance '%s' of template '%s': %s\n", inst.Instance, inst.Template, err)
+		}
+	}
+	return &state
+}
+
+// Restore the state of every service from the state file, checked against the panes that are actually alive now.
+// Must be called with modelLock held exclusively.
+func (cfg *UnitSystem) reconcileState(state *PanelState) {
+	if state == nil {
+		return
+	}
+
+	for _, unit := range cfg.units {
+		serv, ok := unit.v.(*Unitv4Service)
+		us := state.Units[unit.Name]
+		if !ok || us == nil {
+			continue
+		}
+
+		// Adopting the panes counts as starting the service, but it may well have been running for a long time
+		adoptedStart := serv.lastStarted
+
+		serv.lastStarted = us.LastStarted
+		serv.lastStopped = us.LastStopped
+		serv.lastStopReason = us.LastStopReason
+		serv.crashes = us.Crashes
+
+		same := 0
+		for _, proc := range serv.procs {
+			for _, pane := range us.Panes {
+				if pane.PaneId == proc.PaneId && pane.Pid == proc.Pid {
+					same++
+					break
+				}
+			}
+		}
+
+		switch {
+		case len(serv.procs) == 0 && len(us.Panes) > 0:
+			// We don't know when exactly it went away
+			serv.lastStopped = time.Now()
+			ev := UnitEvent{Time: serv.lastStopped, Unit: unit.Name, Kind: EventStop, Detail: stopReasonOffline}
+			if us.StoppingAttempt.IsZero() {
+				serv.lastStopReason = stopReasonOffline
+				serv.crashes++
+				ev.Kind = EventCrash
+			} else if us.PendingStopReason != "" {
+				serv.lastStopReason = us.PendingStopReason
+			} else {
+				serv.lastStopReason = stopReasonRequested
+			}
+			cfg.emit(ev)
+			fmt.Printf("unit %s stopped while the panel was not running\n", unit.Name)
+		case len(serv.procs) > 0 && same == 0:
+			// Started by somebody else, or restarted
+			serv.lastStarted = adoptedStart
+		case len(serv.procs) > 0:
+			serv.stoppingAttempt = us.StoppingAttempt
+			serv.pendingStopReason = us.PendingStopReason
+		}
+	}
+}
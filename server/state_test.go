@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestStateRoundTripStopping(t *testing.T) {
+	newSystem := func(procs ...*TmuxProcess) (*UnitSystem, *Unitv4Service) {
+		unit := &Unit{Name: "minecraft"}
+		serv := &Unitv4Service{unit: unit, procs: procs}
+		unit.v = serv
+		return &UnitSystem{units: []*Unit{unit}}, serv
+	}
+	proc := &TmuxProcess{Name: "minecraft", PaneId: 3, Pid: 1234}
+	stoppingAttempt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, reason := range []string{stopReasonRequested, stopReasonForced} {
+		before, serv := newSystem(proc)
+		serv.stoppingAttempt = stoppingAttempt
+		serv.pendingStopReason = reason
+
+		data, err := json.Marshal(before.currentState())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var state PanelState
+		err = json.Unmarshal(data, &state)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Still stopping after the restart
+		after, serv := newSystem(&TmuxProcess{Name: "minecraft", PaneId: 3, Pid: 1234})
+		after.reconcileState(&state)
+		if !serv.stoppingAttempt.Equal(stoppingAttempt) || serv.pendingStopReason != reason {
+			t.Errorf("%s: restored stoppingAttempt = %s, pendingStopReason = %q", reason, serv.stoppingAttempt, serv.pendingStopReason)
+		}
+
+		// Or gone by then
+		after, serv = newSystem()
+		after.reconcileState(&state)
+		if serv.lastStopReason != reason || serv.crashes != 0 {
+			t.Errorf("%s: stopped while offline, lastStopReason = %q, crashes = %d", reason, serv.lastStopReason, serv.crashes)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+
+	// If true and CertFile/KeyFile don't exist, generate a self-signed certificate and write it there.
+	SelfSigned bool
+	// DNS names and IP addresses to put into the generated self-signed certificate.
+	// Defaults to the hostname, localhost and the loopback addresses.
+	Hosts []string
+
+	// If non-zero, responses served over TLS carry a Strict-Transport-Security header with this max-age.
+	HSTSMaxAge time.Duration
+}
+
+// How often to look at the certificate files for changes, at most.
+const certReloadInterval = 10 * time.Second
+
+// Serves the certificate from [TLSConfig.CertFile]/[TLSConfig.KeyFile], and picks up changes made to them
+// (e.g. by certbot) without a restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	certMtime time.Time
+	keyMtime  time.Time
+	lastCheck time.Time
+}
+
+func newCertReloader(cfg *TLSConfig) (*certReloader, error) {
+	if cfg.SelfSigned {
+		err := ensureSelfSignedCert(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate self-signed certificate: %w", err)
+		}
+	}
+
+	cr := &certReloader{
+		certFile: cfg.CertFile,
+		keyFile:  cfg.KeyFile,
+	}
+	err := cr.reload()
+	if err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+func (cr *certReloader) reload() error {
+	certInfo, err := os.Stat(cr.certFile)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(cr.keyFile)
+	if err != nil {
+		return err
+	}
+	if certInfo.ModTime().Equal(cr.certMtime) && keyInfo.ModTime().Equal(cr.keyMtime) {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	if cr.cert != nil {
+		fmt.Printf("reloaded TLS certificate from %s\n", cr.certFile)
+	}
+	cr.cert = &cert
+	cr.certMtime = certInfo.ModTime()
+	cr.keyMtime = keyInfo.ModTime()
+	return nil
+}
+
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	if time.Since(cr.lastCheck) > certReloadInterval {
+		cr.lastCheck = time.Now()
+		err := cr.reload()
+		if err != nil {
+			// Keep serving the old certificate, the files may be in the middle of being replaced
+			fmt.Printf("[WARN] failed to reload TLS certificate: %s\n", err)
+		}
+	}
+	return cr.cert, nil
+}
+
+func (cr *certReloader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: cr.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+}
+
+// Generate a certificate and key into CertFile and KeyFile, unless both exist already.
+func ensureSelfSignedCert(cfg *TLSConfig) error {
+	_, certErr := os.Stat(cfg.CertFile)
+	_, keyErr := os.Stat(cfg.KeyFile)
+	if certErr == nil && keyErr == nil {
+		return nil
+	}
+	if !errors.Is(certErr, os.ErrNotExist) && certErr != nil {
+		return certErr
+	}
+	if !errors.Is(keyErr, os.ErrNotExist) && keyErr != nil {
+		return keyErr
+	}
+	// A new key wouldn't match the certificate that's there, or the other way around
+	if certErr == nil {
+		return fmt.Errorf("TLS certificate %s exists, but its key %s doesn't; remove the certificate to generate a new one", cfg.CertFile, cfg.KeyFile)
+	}
+	if keyErr == nil {
+		return fmt.Errorf("TLS key %s exists, but its certificate %s doesn't; remove the key to generate a new one", cfg.KeyFile, cfg.CertFile)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	hosts := cfg.Hosts
+	if len(hosts) == 0 {
+		hosts = []string{"localhost", "127.0.0.1", "::1"}
+		if hostname, err := os.Hostname(); err == nil {
+			hosts = append(hosts, hostname)
+		}
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"tmaxhoc self-signed"}},
+		NotBefore:             time.Now().Add(-1 * time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	// Key first, so we never end up with a cert lying around without its key
+	err = writePemFile(cfg.KeyFile, "PRIVATE KEY", keyDer, 0600)
+	if err != nil {
+		return err
+	}
+	err = writePemFile(cfg.CertFile, "CERTIFICATE", der, 0644)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("generated self-signed TLS certificate %s for %v\n", cfg.CertFile, hosts)
+	return nil
+}
+
+func writePemFile(path string, blockType string, der []byte, perm os.FileMode) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	err = pem.Encode(f, &pem.Block{Type: blockType, Bytes: der})
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Add a Strict-Transport-Security header to every response.
+func withHSTS(h http.Handler, maxAge time.Duration) http.Handler {
+	value := "max-age=" + strconv.Itoa(int(maxAge.Seconds()))
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Strict-Transport-Security", value)
+		h.ServeHTTP(w, req)
+	})
+}
+
+// Redirect every request to the same host and path over https, on the given port.
+func redirectToHTTPS(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		host, _, err := net.SplitHostPort(req.Host)
+		if err != nil {
+			// No port in the Host header
+			host = req.Host
+		}
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+		target := "https://" + host + req.URL.RequestURI()
+		// Make sure POSTs from the panel keep being POSTs
+		http.Redirect(w, req, target, http.StatusPermanentRedirect)
+	})
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEnsureSelfSignedCert(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &TLSConfig{
+		CertFile:   filepath.Join(dir, "tls", "cert.pem"),
+		KeyFile:    filepath.Join(dir, "tls", "key.pem"),
+		SelfSigned: true,
+		Hosts:      []string{"example.org", "127.0.0.1"},
+	}
+
+	err := ensureSelfSignedCert(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		t.Fatalf("generated certificate doesn't load: %s", err)
+	}
+
+	// Left alone once both exist
+	err = ensureSelfSignedCert(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil || string(again.Certificate[0]) != string(pair.Certificate[0]) {
+		t.Errorf("certificate was replaced or broken: %v", err)
+	}
+
+	// Half a pair is refused rather than completed with something that doesn't match
+	for _, missing := range []string{cfg.KeyFile, cfg.CertFile} {
+		cert, _ := os.ReadFile(cfg.CertFile)
+		key, _ := os.ReadFile(cfg.KeyFile)
+		os.Remove(missing)
+		err = ensureSelfSignedCert(cfg)
+		if err == nil {
+			t.Errorf("ensureSelfSignedCert() without %s succeeded", missing)
+		}
+		if _, statErr := os.Stat(missing); statErr == nil {
+			t.Errorf("ensureSelfSignedCert() created %s", missing)
+		}
+		os.WriteFile(cfg.CertFile, cert, 0644)
+		os.WriteFile(cfg.KeyFile, key, 0600)
+	}
+}
@@ -1,22 +1,42 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"os"
 	"os/exec"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 )
 
 type TmuxSession struct {
+	// What units call the session, see [TmuxSessionConfig.Name].
+	Name        string
 	SessionName string
+	// Of the tmux server the session is on, as reported by the server itself.
+	SocketPath string
+	// Selects the tmux server, see [TmuxSessionConfig.serverArgs].
+	serverArgs []string
 
 	// LUT from [TmuxProcess.PaneId] to proc groups.
 	// Every proc group managed by this session must be inside this map.
 	byPaneId map[int]*TmuxProcess
 
+	// LUT from [TmuxProcess.PaneId] to panes whose process has exited, but which are kept around by remain-on-exit.
+	// Every dead pane in the session is inside this map, whether it was a proc group of ours or not.
+	deadByPaneId map[int]*TmuxProcess
+
 	onProcSpawned func(*TmuxProcess)
 	onProcPruned  func(*TmuxProcess)
+	// Called for every pane in deadByPaneId once it's added, and once it's gone.
+	onDeadPaneFound func(*TmuxProcess)
+	onDeadPaneGone  func(*TmuxProcess)
+	// Nullable. Whether windows of that name should be kept around after their process exits.
+	keepDeadPanes func(windowName string) bool
+	// When panes were first seen dead without an exit status, see [TmuxSession.PollAndPrune].
+	dyingSince map[int]time.Time
 
 	// The special reserved window 0 to keep session alive when all procs have stopped
 	reservedWindowPaneId int
@@ -43,35 +63,122 @@ type TmuxProcess struct {
 	// Note that this property is orthogonal to [TmuxProcess.Unit];
 	// an adopted proc group may have an associated unit, and a non-adopted proc group may not have an associated unit.
 	Adopted bool
+
+	// If true, the output of the pane is already being piped somewhere, see [TmuxSession.PipePane].
+	OutputPiped bool
+
+	// Nullable. How the process ended, if its pane was kept around by remain-on-exit.
+	Exit *PaneExit
+
+	// Descendants of the pane's process as of the last poll, see [TmuxSession.PollAndPrune].
+	descendants []trackedProcess
+	// Descendants still running after the pane's process exited, found as it's pruned.
+	Orphans []trackedProcess
+}
+
+// How long to wait for tmux to collect the exit status of a dead pane. It sometimes doesn't until another child of the
+// tmux server exits.
+const paneExitStatusWait = 15 * time.Second
+
+type PaneExit struct {
+	// Exit status of the process, meaningless if it was killed by a signal. -1 if tmux never told us.
+	Status int
+	// Signal that killed the process, 0 if it exited by itself.
+	Signal int
+}
+
+func (e *PaneExit) String() string {
+	if e.Signal != 0 {
+		return "killed by signal " + strconv.Itoa(e.Signal)
+	}
+	if e.Status < 0 {
+		return "exit status unknown"
+	}
+	return "exit status " + strconv.Itoa(e.Status)
 }
 
 func (proc *TmuxProcess) targetPane() string {
 	return "%" + strconv.Itoa(proc.PaneId)
 }
 
-var TmuxExecutable = "/bin/tmux"
+// Looked up in PATH, unless it contains a slash. Set from the config on startup.
+var TmuxExecutable = "tmux"
+
+// Name of the session configured by [Tmux] itself, which units run in unless they say otherwise.
+const defaultTmuxSession = "default"
+
+// Where a tmux session managed by the panel lives.
+type TmuxSessionConfig struct {
+	// What units call the session in their TmuxSession.
+	Name        string
+	SessionName string
+	// The tmux server to use, see `tmux -L` and `tmux -S`. At most one can be set, neither for the default server.
+	SocketName string
+	SocketPath string
+}
+
+// Arguments to pass to tmux before the command, to talk to the right server.
+func (conf TmuxSessionConfig) serverArgs() []string {
+	switch {
+	case len(conf.SocketPath) > 0:
+		return []string{"-S", conf.SocketPath}
+	case len(conf.SocketName) > 0:
+		return []string{"-L", conf.SocketName}
+	}
+	return nil
+}
+
+// e.g. "'games' on -L alice"
+func (conf TmuxSessionConfig) String() string {
+	if args := conf.serverArgs(); len(args) > 0 {
+		return fmt.Sprintf("'%s' on %s", conf.SessionName, strings.Join(args, " "))
+	}
+	return "'" + conf.SessionName + "'"
+}
 
-func NewTmuxSession(sessionName string) (*TmuxSession, error) {
-	cmd := exec.Command(TmuxExecutable, "has-session", "-t", sessionName)
+// A tmux command against the server of the session.
+func (ts *TmuxSession) command(args ...string) *exec.Cmd {
+	return exec.Command(TmuxExecutable, append(ts.serverArgs[:len(ts.serverArgs):len(ts.serverArgs)], args...)...)
+}
+
+// Environment for scripts started on behalf of the session, so that they can find its tmux server with
+// `tmux -S "$TMAXHOC_TMUX_SOCKET"`.
+func (ts *TmuxSession) scriptEnv() []string {
+	return append(os.Environ(), "TMAXHOC_TMUX_SOCKET="+ts.SocketPath)
+}
+
+func NewTmuxSession(conf TmuxSessionConfig) (*TmuxSession, error) {
+	ts := &TmuxSession{
+		Name:        conf.Name,
+		SessionName: conf.SessionName,
+		serverArgs:  conf.serverArgs(),
+
+		byPaneId:     make(map[int]*TmuxProcess),
+		deadByPaneId: make(map[int]*TmuxProcess),
+		dyingSince:   make(map[int]time.Time),
+
+		reservedWindowPaneId: -1,
+	}
+
+	cmd := ts.command("has-session", "-t", ts.SessionName)
 	err := cmd.Run()
 	if err != nil {
 		// Dummy window to keep the session alive
-		cmd := exec.Command(TmuxExecutable, "new-session", "-d", "-s", sessionName, "/bin/sh")
+		cmd := ts.command("new-session", "-d", "-s", ts.SessionName, "/bin/sh")
 		_, err := cmd.Output()
 		if err != nil {
-			return nil, fmt.Errorf("failed to create tmux session: %w", err)
+			return nil, fmt.Errorf("failed to create tmux session %s: %w", conf, newCommandError("tmux new-session", err))
 		}
 	}
 
-	ts := &TmuxSession{
-		SessionName: sessionName,
-
-		byPaneId: make(map[int]*TmuxProcess),
-
-		reservedWindowPaneId: -1,
+	cmd = ts.command("display-message", "-p", "-t", ts.targetSession(), "#{socket_path}")
+	socketPath, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("tmux session %s: %w", conf, newCommandError("tmux display-message", err))
 	}
+	ts.SocketPath = strings.TrimSpace(string(socketPath))
 
-	cmd = exec.Command(TmuxExecutable, "list-panes", "-s", "-t", ts.targetSession(), "-F", "#{window_index}\t#{pane_id}")
+	cmd = ts.command("list-panes", "-s", "-t", ts.targetSession(), "-F", "#{window_index}\t#{pane_id}")
 	panes, err := cmd.Output()
 	if err != nil {
 		return nil, err
@@ -85,7 +192,7 @@ func NewTmuxSession(sessionName string) (*TmuxSession, error) {
 		}
 	}
 	if ts.reservedWindowPaneId == -1 {
-		fmt.Println("[WARN] no reserved window present in the session")
+		fmt.Printf("[WARN] no reserved window present in tmux session %s\n", conf)
 	}
 
 	return ts, nil
@@ -108,12 +215,25 @@ func (ts *TmuxSession) removeProcess(proc *TmuxProcess) {
 // starting the service. For an abbreviated example, `miniserve -p 1234` results in `/bin/sh -c 'miniserv -p 1234'`,
 // whereas `miniserve` `-p` `1234` results in running miniserve directly with the arguments.
 func (ts *TmuxSession) spawnProcess(windowName string, commandParts ...string) (*TmuxProcess, error) {
+	return ts.spawnProcessIn(windowName, "", commandParts...)
+}
+
+// Like [TmuxSession.spawnProcess], but starting in the working directory dir. Empty for tmux's default.
+func (ts *TmuxSession) spawnProcessIn(windowName string, dir string, commandParts ...string) (*TmuxProcess, error) {
 	cmdArglist := []string{"new-window", "-t", ts.targetSession(), "-n", windowName, "-P", "-F", "#{pane_id}\t#{pane_pid}"}
+	if len(dir) > 0 {
+		cmdArglist = append(cmdArglist, "-c", dir)
+	}
 	cmdArglist = append(cmdArglist, commandParts...)
-	cmd := exec.Command(TmuxExecutable, cmdArglist...)
+	if ts.keepDeadPanes != nil && ts.keepDeadPanes(windowName) {
+		// In the same invocation, so that the option is already set if the process exits right away.
+		// new-window makes the new window current, which is what set-option targets without -t.
+		cmdArglist = append(cmdArglist, ";", "set-option", "-w", "remain-on-exit", "on")
+	}
+	cmd := ts.command(cmdArglist...)
 	info, err := cmd.Output()
 	if err != nil {
-		return nil, err
+		return nil, newCommandError("tmux new-window", err)
 	}
 
 	var paneId, pid int
@@ -130,95 +250,266 @@ func (ts *TmuxSession) spawnProcess(windowName string, commandParts ...string) (
 	return proc, nil
 }
 
+// Run script with args and the session name (and [TmuxSession.scriptEnv]), and pick up the panes it prints. What the script prints on stderr ends
+// up in the error if it fails, and in the panel's output otherwise.
 func (ts *TmuxSession) spawnByScript(windowName string, script string, args ...string) error {
 	args = append(args, ts.SessionName)
 	cmd := exec.Command(script, args...)
+	cmd.Env = ts.scriptEnv()
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
 	stdout, err := cmd.Output()
 	if err != nil {
-		return err
+		return &commandError{Command: script, Err: err, Output: strings.TrimSpace(stderr.String())}
+	}
+	if stderr.Len() > 0 {
+		fmt.Printf("start script %s of %s: %s\n", script, windowName, strings.TrimSpace(stderr.String()))
 	}
 
+	spawned := 0
 	for _, line := range strings.Split(string(stdout), "\n") {
 		var paneId, pid int
-		fmt.Sscanf(line, "%%%d\t%d", &paneId, &pid)
+		n, _ := fmt.Sscanf(line, "%%%d\t%d", &paneId, &pid)
+		if n != 2 {
+			continue
+		}
+		spawned++
 
 		proc := &TmuxProcess{
 			Name:   windowName,
 			PaneId: paneId,
 			Pid:    pid,
 		}
+		if ts.keepDeadPanes != nil && ts.keepDeadPanes(windowName) {
+			// Too late if the process already exited, but the script is in charge of the windows here
+			cmd := ts.command("set-option", "-w", "-t", proc.targetPane(), "remain-on-exit", "on")
+			cmd.Run()
+		}
 		ts.addProcess(proc)
 	}
 
+	if spawned == 0 {
+		return &commandError{Command: script, Err: errors.New("printed no panes"), Output: strings.TrimSpace(string(stdout))}
+	}
 	return nil
 }
 
-func (ts *TmuxSession) ForceKillProcess(proc *TmuxProcess) {
-	err := syscall.Kill(proc.Pid, syscall.SIGKILL)
+// SIGKILL the process of the pane and all its descendants, so that nothing survives as an orphan (e.g. a server
+// started through rlwrap or sh -c). Returns the processes that were killed, without waiting for them to be gone.
+func (ts *TmuxSession) ForceKillProcess(proc *TmuxProcess) ([]trackedProcess, error) {
+	root, err := trackProcess(proc.Pid)
 	if err != nil {
-		fmt.Printf("[ERROR] failed to force kill pid=%d: %s\n", proc.Pid, err)
+		// Already gone
+		return nil, nil
 	}
+	killed, err := killProcessTree(root)
+	if err != nil {
+		// Can't see the tree, settle for the pane's process
+		return []trackedProcess{root}, syscall.Kill(proc.Pid, syscall.SIGKILL)
+	}
+	return killed, nil
 }
 
 func (ts *TmuxSession) PollAndPrune() error {
-	//// Detect dead proc groups, and prune them ////
-	for _, proc := range ts.byPaneId {
-		err := syscall.Kill(proc.Pid, syscall.Signal(0))
-		if err != nil {
-			fmt.Printf("removing dead proc group %%%d pid=%d '%s'\n", proc.PaneId, proc.Pid, proc.Name)
-			ts.removeProcess(proc)
-		}
-	}
-
-	//// Poll for newly created windows by somebody else, keep records and try to map them to units ////
-	cmd := exec.Command(TmuxExecutable, "list-panes", "-s", "-t", ts.targetSession(), "-F", "#{pane_id}\t#{pane_pid}\t#{window_name}")
+	cmd := ts.command("list-panes", "-s", "-t", ts.targetSession(), "-F", "#{pane_id}\t#{pane_pid}\t#{pane_pipe}\t#{pane_dead}\t#{pane_dead_status}\t#{pane_dead_signal}\t#{window_name}")
 	panes, err := cmd.Output()
 	if err != nil {
 		return err
 	}
+
+	// LUT from pane id to the listed panes, alive or dead, and the same in the order tmux listed them
+	listed := make(map[int]*TmuxProcess)
+	var listedOrder []*TmuxProcess
+	// Panes that are dead, but whose exit status isn't known yet. Left alone until the next poll.
+	dying := make(map[int]time.Time)
 	for _, line := range strings.Split(string(panes), "\n") {
-		var paneId, pid int
-		var windowName string
-		{
-			parts := strings.Split(line, "\t")
-			if len(parts) != 3 {
-				continue
+		parts := strings.SplitN(line, "\t", 7)
+		if len(parts) != 7 {
+			continue
+		}
+		paneId, _ := strconv.Atoi(parts[0][1:]) // %123
+		pid, _ := strconv.Atoi(parts[1])
+		proc := &TmuxProcess{
+			Name:        parts[6],
+			PaneId:      paneId,
+			Pid:         pid,
+			Adopted:     true,
+			OutputPiped: parts[2] == "1",
+		}
+		if parts[3] == "1" {
+			proc.Exit = &PaneExit{Status: -1}
+			if parts[4] == "" && parts[5] == "" {
+				// tmux notices the pane closing before it gets to collect the exit status, hold off until it has both
+				since, ok := ts.dyingSince[paneId]
+				if !ok {
+					since = time.Now()
+				}
+				if time.Since(since) < paneExitStatusWait {
+					dying[paneId] = since
+					continue
+				}
+			} else {
+				proc.Exit.Status, _ = strconv.Atoi(parts[4])
+				proc.Exit.Signal, _ = strconv.Atoi(parts[5])
 			}
-			paneId, _ = strconv.Atoi(parts[0][1:]) // %123
-			pid, _ = strconv.Atoi(parts[1])
-			windowName = parts[2]
 		}
+		if paneId != ts.reservedWindowPaneId {
+			listed[paneId] = proc
+			listedOrder = append(listedOrder, proc)
+		}
+	}
+
+	ts.dyingSince = dying
+
+	//// Detect dead proc groups, and prune them ////
+	pruned := make(map[int]bool)
+	for _, proc := range ts.byPaneId {
+		pane := listed[proc.PaneId]
+		if _, isDying := dying[proc.PaneId]; isDying || (pane != nil && pane.Exit == nil) {
+			continue
+		}
+		pruned[proc.PaneId] = true
+		fmt.Printf("removing dead proc group %%%d pid=%d '%s'\n", proc.PaneId, proc.Pid, proc.Name)
+		for _, tp := range proc.descendants {
+			if tp.alive() {
+				proc.Orphans = append(proc.Orphans, tp)
+			}
+		}
+		if len(proc.Orphans) > 0 {
+			fmt.Printf("[WARN] proc group %%%d '%s' left orphaned processes behind: %s\n", proc.PaneId, proc.Name, joinProcesses(proc.Orphans))
+		}
+		if pane != nil {
+			// Kept by remain-on-exit
+			proc.Exit = pane.Exit
+			ts.deadByPaneId[proc.PaneId] = proc
+		}
+		ts.removeProcess(proc)
+		if pane != nil && ts.deadByPaneId[proc.PaneId] == proc {
+			ts.onDeadPaneFound(proc)
+		}
+	}
 
-		if paneId == ts.reservedWindowPaneId {
+	//// Keep track of dead panes that got killed, or were already there ////
+	for paneId, proc := range ts.deadByPaneId {
+		if listed[paneId] == nil {
+			delete(ts.deadByPaneId, paneId)
+			ts.onDeadPaneGone(proc)
+		}
+	}
+	for _, pane := range listedOrder {
+		if pane.Exit == nil || ts.deadByPaneId[pane.PaneId] != nil || pruned[pane.PaneId] {
 			continue
 		}
-		_, exists := ts.byPaneId[paneId]
+		pane.Dead = true
+		ts.deadByPaneId[pane.PaneId] = pane
+		ts.onDeadPaneFound(pane)
+
+		fmt.Printf("polled dead pane %%%d '%s' (%s)\n", pane.PaneId, pane.Name, pane.Exit)
+	}
+
+	//// Poll for newly created windows by somebody else, keep records and try to map them to units ////
+	for _, pane := range listedOrder {
+		if pane.Exit != nil {
+			continue
+		}
+		_, exists := ts.byPaneId[pane.PaneId]
 		if exists {
 			continue
 		}
 
-		proc := &TmuxProcess{
-			Name:    windowName,
-			PaneId:  paneId,
-			Pid:     pid,
-			Adopted: true,
+		ts.addProcess(pane)
+
+		fmt.Printf("polled proc group %%%d pid=%d '%s'\n", pane.PaneId, pane.Pid, pane.Name)
+	}
+
+	ts.trackDescendants()
+	return nil
+}
+
+// Remember what runs below every proc group, to find out what it leaves behind when it dies. Processes already known
+// aren't looked at again.
+func (ts *TmuxSession) trackDescendants() {
+	children, err := processChildren()
+	if err != nil {
+		return
+	}
+	for _, proc := range ts.byPaneId {
+		known := make(map[int]trackedProcess, len(proc.descendants))
+		for _, tp := range proc.descendants {
+			known[tp.Pid] = tp
 		}
-		ts.addProcess(proc)
+		var descendants []trackedProcess
+		for _, pid := range descendantsOf(children, proc.Pid)[1:] {
+			tp, ok := known[pid]
+			if !ok {
+				tp, err = trackProcess(pid)
+				if err != nil {
+					continue
+				}
+			}
+			descendants = append(descendants, tp)
+		}
+		proc.descendants = descendants
+	}
+}
 
-		fmt.Printf("polled proc group %%%d pid=%d '%s'\n", paneId, pid, windowName)
+// Kill a pane kept around after its process exited, see [TmuxSession.deadByPaneId].
+func (ts *TmuxSession) KillDeadPane(proc *TmuxProcess) error {
+	if ts.deadByPaneId[proc.PaneId] != proc {
+		return nil
+	}
+	cmd := ts.command("kill-pane", "-t", proc.targetPane())
+	err := cmd.Run()
+	if err != nil {
+		return err
 	}
 
+	delete(ts.deadByPaneId, proc.PaneId)
+	ts.onDeadPaneGone(proc)
 	return nil
 }
 
 func (ts *TmuxSession) SendKeys(proc *TmuxProcess, keys ...string) error {
 	cmdArglist := []string{"send-keys", "-t", proc.targetPane()}
 	cmdArglist = append(cmdArglist, keys...)
-	cmd := exec.Command(TmuxExecutable, cmdArglist...)
+	cmd := ts.command(cmdArglist...)
+	_, err := cmd.Output()
+	if err != nil {
+		return newCommandError("tmux send-keys", err)
+	}
+
+	return nil
+}
+
+// Feed everything the pane prints from now on to the stdin of shellCommand, until the pane dies.
+func (ts *TmuxSession) PipePane(proc *TmuxProcess, shellCommand string) error {
+	cmd := ts.command("pipe-pane", "-t", proc.targetPane(), shellCommand)
 	err := cmd.Run()
 	if err != nil {
 		return err
 	}
 
+	proc.OutputPiped = true
 	return nil
 }
+
+// Get the contents of a pane, one string per line, including up to historyLines lines of scrollback.
+// If historyLines is negative, the entire scrollback is included.
+// Trailing empty lines (the unused part of the screen) are dropped.
+func (ts *TmuxSession) CapturePane(proc *TmuxProcess, historyLines int) ([]string, error) {
+	start := "-"
+	if historyLines >= 0 {
+		start = strconv.Itoa(-historyLines)
+	}
+	cmd := ts.command("capture-pane", "-p", "-J", "-t", proc.targetPane(), "-S", start)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	lines := strings.Split(string(out), "\n")
+	for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines, nil
+}
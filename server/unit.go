@@ -1,8 +1,10 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -14,39 +16,110 @@ const (
 	Running
 )
 
+// How long a service gets to stop before it may be force stopped, unless its stop sequence takes longer.
+const defaultForceStopAfter = 10 * time.Second
+
 // A workload backed directly by some processes.
 type Unitv4Service struct {
+	// The unit this is the [Unit.v] of.
+	unit *Unit
+
 	// Name of the tmux window hosting this unit process.
 	TmuxName string
+	// Name of the [TmuxSessionConfig] the service runs in.
+	tmuxSession string
+	// The session itself, set up by [UnitSystem.BindTmuxSession].
+	session *TmuxSession
 
 	// If non-zero, a stop command has been issued but we're not sure it has died.
 	stoppingAttempt time.Time
+	// How long after stoppingAttempt the service may be force stopped.
+	forceStopAfter time.Duration
+
+	// When the service last started and stopped, zero if it never did.
+	lastStarted time.Time
+	lastStopped time.Time
+	// Why the service last stopped, one of the stopReason* constants.
+	lastStopReason string
+	// Why the service is going to stop, set once it has been asked to and until its processes are gone.
+	pendingStopReason string
+	// Who asked the service to stop, see [UnitSystem.actAs].
+	stopActor string
+	// Number of times the service exited without being asked to.
+	crashes int
+	// Times of the crashes within the last [crashLoopWindow], to detect [EventRestartLoop].
+	recentCrashes []time.Time
 
 	procs []*TmuxProcess
+	// Processes left behind by procs that exited, see [TmuxProcess.Orphans]. Likely still holding ports and save locks.
+	orphans []trackedProcess
+	// Processes SIGKILLed by the last force stop that weren't seen gone yet, see [Unitv4Service.pruneOrphans].
+	killed   []trackedProcess
+	killedAt time.Time
+	// Panes whose process exited, kept around (if keepDeadPanes) to see what happened until the next start.
+	deadPanes     []*TmuxProcess
+	keepDeadPanes bool
 
 	lifecycleDriver ServiceLifecycleDriver
+	preStart        PreStartChecks
+
+	// Nullable, if this service isn't backed up.
+	backup *BackupPolicy
+	// Directories holding the service's data, which can be snapshotted and restored from the panel.
+	dataPaths []string
+
+	// Nullable, if the output isn't matched against anything.
+	logRules []*LogRule
+	// Most recent matches of logRules, oldest first.
+	logMatches []logMatch
+	// If non-empty, the name of the log rule that found the service unhealthy. Cleared when it starts.
+	unhealthy string
+	// If non-empty, the service is being restarted by a log rule, and will be started once it's gone. Who caused it.
+	restartPending string
+
+	// Most recent failures to start or stop, oldest first.
+	recentErrors []unitError
+
+	// If non-empty, some maintenance operation is going on and the service cannot be started. Describes the operation.
+	busy string
 }
 
+// Errors returned by start and stop may be joined from several (e.g. one per process) with [errors.Join]. Processes
+// that did start are picked up all the same.
 type ServiceLifecycleDriver interface {
 	start(serv *Unitv4Service, ts *TmuxSession) error
-	stop(serv *Unitv4Service, ts *TmuxSession)
+	stop(serv *Unitv4Service, ts *TmuxSession) error
 }
 
-func (serv *Unitv4Service) start(ts *TmuxSession) error {
+// Errors are recorded in recentErrors, and returned as a [unitError].
+func (serv *Unitv4Service) start() error {
 	if len(serv.procs) > 0 {
 		return nil
 	}
+	if serv.busy != "" {
+		return serv.noteError("start", errors.New("cannot start while "+serv.busy))
+	}
+	err := serv.checkPreStart()
+	if err != nil {
+		return serv.noteError("start", err)
+	}
 
-	return serv.lifecycleDriver.start(serv, ts)
+	serv.dismissDeadPanes()
+	return serv.noteError("start", serv.lifecycleDriver.start(serv, serv.session))
 }
 
-func (serv *Unitv4Service) stop(ts *TmuxSession) {
+// Errors are recorded in recentErrors, and returned as a [unitError]. The service counts as stopping regardless.
+func (serv *Unitv4Service) stop() error {
 	if len(serv.procs) == 0 {
-		return
+		return nil
 	}
 
-	serv.lifecycleDriver.stop(serv, ts)
+	err := serv.lifecycleDriver.stop(serv, serv.session)
 	serv.stoppingAttempt = time.Now()
+	if serv.pendingStopReason == "" {
+		serv.pendingStopReason = stopReasonRequested
+	}
+	return serv.noteError("stop", err)
 }
 
 func (serv *Unitv4Service) status() UnitStatus {
@@ -61,13 +134,127 @@ func (serv *Unitv4Service) status() UnitStatus {
 	}
 }
 
+// Describe how the service ended, while its dead panes are kept around, e.g. "Exited (1)". Empty otherwise.
+func (serv *Unitv4Service) exitSummary() string {
+	if len(serv.procs) > 0 || len(serv.deadPanes) == 0 {
+		return ""
+	}
+	exit := serv.deadPanes[len(serv.deadPanes)-1].Exit
+	switch {
+	case exit.Signal != 0:
+		return fmt.Sprintf("Crashed (signal %d)", exit.Signal)
+	case exit.Status < 0:
+		return "Exited"
+	}
+	return fmt.Sprintf("Exited (%d)", exit.Status)
+}
+
+// Kill the panes kept around after the service exited.
+func (serv *Unitv4Service) dismissDeadPanes() {
+	for _, proc := range append([]*TmuxProcess(nil), serv.deadPanes...) {
+		err := serv.session.KillDeadPane(proc)
+		if err != nil {
+			fmt.Printf("[WARN] failed to kill dead pane %s of %s: %s\n", proc.targetPane(), serv.unit.Name, err)
+		}
+	}
+}
+
+// Record a crash, and emit [EventRestartLoop] if there were too many recently.
+func (serv *Unitv4Service) noteCrash(cfg *UnitSystem, t time.Time) {
+	recent := serv.recentCrashes[:0]
+	for _, c := range serv.recentCrashes {
+		if t.Sub(c) < crashLoopWindow {
+			recent = append(recent, c)
+		}
+	}
+	serv.recentCrashes = append(recent, t)
+
+	if len(serv.recentCrashes) >= crashLoopCount {
+		cfg.emit(UnitEvent{
+			Time:   t,
+			Unit:   serv.unit.Name,
+			Kind:   EventRestartLoop,
+			Detail: fmt.Sprintf("crashed %d times within %s", len(serv.recentCrashes), crashLoopWindow),
+		})
+		serv.recentCrashes = nil
+	}
+}
+
 func (serv *Unitv4Service) forceStopAllowed() bool {
-	return serv.status() == Stopping && time.Since(serv.stoppingAttempt) > 10*time.Second
+	switch serv.status() {
+	case Stopping:
+		return time.Since(serv.stoppingAttempt) > serv.forceStopAfter
+	case Stopped:
+		// To get rid of them
+		return len(serv.orphans) > 0
+	}
+	return false
 }
 
-func (serv *Unitv4Service) forceStop(ts *TmuxSession) {
+// Errors are recorded in recentErrors, and returned as a [unitError]. Doesn't wait for the killed processes to be gone,
+// those still around after [processKillWait] are reported by [Unitv4Service.pruneOrphans].
+func (serv *Unitv4Service) forceStop() error {
+	if len(serv.procs) > 0 {
+		serv.pendingStopReason = stopReasonForced
+		// Attribute it to whoever is force stopping instead
+		serv.stopActor = ""
+	}
+	var errs []error
+	var killed []trackedProcess
 	for _, proc := range serv.procs {
-		ts.ForceKillProcess(proc)
+		tps, err := serv.session.ForceKillProcess(proc)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("pane %s: %w", proc.targetPane(), err))
+		}
+		killed = append(killed, tps...)
+	}
+
+	// Orphans (and their children) stay orphans until they're seen gone
+	var orphans []trackedProcess
+	for _, orphan := range serv.orphans {
+		tps, err := killProcessTree(orphan)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("orphaned process %s: %w", orphan, err))
+			tps = []trackedProcess{orphan}
+		}
+		orphans = append(orphans, tps...)
+	}
+	serv.orphans = orphans
+	serv.killed = append(killed, orphans...)
+	serv.killedAt = time.Now()
+	return serv.noteError("force stop", errors.Join(errs...))
+}
+
+// See [Unitv4Service.pruneOrphans].
+// Must be called with modelLock held exclusively.
+func (cfg *UnitSystem) pruneOrphans() {
+	for _, unit := range cfg.units {
+		if serv, ok := unit.v.(*Unitv4Service); ok {
+			serv.pruneOrphans()
+		}
+	}
+}
+
+// Forget the orphans that have exited or were killed, and report the processes a force stop didn't get rid of.
+func (serv *Unitv4Service) pruneOrphans() {
+	alive := serv.orphans[:0]
+	for _, orphan := range serv.orphans {
+		if orphan.alive() {
+			alive = append(alive, orphan)
+		}
+	}
+	serv.orphans = alive
+
+	var survivors []trackedProcess
+	for _, tp := range serv.killed {
+		if tp.alive() {
+			survivors = append(survivors, tp)
+		}
+	}
+	serv.killed = survivors
+	if len(survivors) > 0 && time.Since(serv.killedAt) > processKillWait {
+		serv.noteError("force stop", errors.New("still running after SIGKILL: "+joinProcesses(survivors)))
+		serv.killed = nil
 	}
 }
 
@@ -78,9 +265,9 @@ type Unitv4Group struct {
 	requirements []*Unit
 }
 
-func (gp *Unitv4Group) start(ts *TmuxSession) error {
+func (gp *Unitv4Group) start() error {
 	for _, req := range gp.requirements {
-		err := req.v.start(ts)
+		err := req.v.start()
 		if err != nil {
 			return err
 		}
@@ -88,10 +275,13 @@ func (gp *Unitv4Group) start(ts *TmuxSession) error {
 	return nil
 }
 
-func (gp *Unitv4Group) stop(ts *TmuxSession) {
+// Stops every requirement, even if some fail to.
+func (gp *Unitv4Group) stop() error {
+	var errs []error
 	for _, req := range gp.requirements {
-		req.v.stop(ts)
+		errs = append(errs, req.v.stop())
 	}
+	return errors.Join(errs...)
 }
 
 func (gp *Unitv4Group) status() UnitStatus {
@@ -109,8 +299,8 @@ func (gp *Unitv4Group) status() UnitStatus {
 	return Stopped
 }
 
-func (*Unitv4Group) forceStopAllowed() bool   { return false }
-func (*Unitv4Group) forceStop(_ *TmuxSession) {}
+func (*Unitv4Group) forceStopAllowed() bool { return false }
+func (*Unitv4Group) forceStop() error       { return nil }
 
 func (gp *Unitv4Group) numReqsRunning() int {
 	n := 0
@@ -131,17 +321,23 @@ type Unit struct {
 	// If true, this unit is not displayed in the panel.
 	Hidden bool
 
+	// Name of the template and the instance name, if this unit was instantiated from a template.
+	Template string
+	Instance string
+	// If true, this unit was instantiated through the API rather than listed in the config.
+	runtimeInstance bool
+
 	// The "virtual" part of this unit that determines the kind
 	v Unitv
 }
 
 type Unitv interface {
-	start(ts *TmuxSession) error
-	stop(ts *TmuxSession)
+	start() error
+	stop() error
 	status() UnitStatus
 
 	forceStopAllowed() bool
-	forceStop(ts *TmuxSession)
+	forceStop() error
 }
 
 func DecorateTmuxName(name string, extra string) string {
@@ -156,31 +352,122 @@ func UndecorateTmuxName(deco string) (string, string) {
 	return deco[:i], deco[(i + len("$$")):]
 }
 
+// What to do with running units when the panel exits.
+type ExitAction int
+
+const (
+	// Leave the tmux session untouched. The processes are adopted again by [TmuxSession.PollAndPrune] on next start.
+	ExitLeaveRunning ExitAction = iota
+	// Stop every running unit, see [UnitSystem.StopAll].
+	ExitStopAll
+)
+
 type UnitSystem struct {
-	// List of units in the same order as the config file.
+	// List of units in the same order as the config file, followed by units instantiated at runtime.
 	// Will also be displayed on the panel in this order.
-	// Immutable after load.
 	units []*Unit
 	// Lookup table from [Unit.Name] to the [Unit] itself.
-	// Immutable after load. Generated after unmarshal.
+	// Generated after unmarshal.
 	unitsLut map[string]*Unit
 	// Lookup table from [Unit.TmuxName] to the [Unitv4Service] that generates i
-	// Immutable after load. Generated after unmarshal.
+	// Generated after unmarshal.
 	tmuxNameLut map[string]*Unitv4Service
+	// Guards the three fields above, which change when templates are instantiated at runtime.
+	// Writers must also hold modelLock, so holding modelLock is enough to read them.
+	unitsLock sync.RWMutex
+
+	// Lookup table from template name to its (unexpanded) config.
+	// Immutable after load.
+	templates map[string]*configUnit
+	// The config as written, before ${...} references are interpolated. Safe to show to admins.
+	rawConfig *config
+
+	// Where to persist [PanelState], or empty to not persist it.
+	StateFile string
+	// Contents of the state file as last written by [UnitSystem.saveState].
+	savedState []byte
+
+	// Where to keep the [UnitHistory], or empty to only keep it in memory.
+	HistoryFile string
+	history     *UnitHistory
+
+	// Where to send notices about unit events.
+	NotifySinks []*NotifySink
+
+	// See [UnitSystem.subscribe].
+	subscribers []func(UnitEvent)
+	// Set while handling a request, see [UnitSystem.actAs].
+	actor string
 
 	// Max number of units allowed to run at a time
 	MaxUnits int
 
-	SessionName string
+	// Path or name in PATH of the tmux binary, see [TmuxExecutable].
+	TmuxExecutable string
+	// Sessions services can run in, the default one first.
+	TmuxSessions []TmuxSessionConfig
+	// The sessions bound with [UnitSystem.BindTmuxSession], in the same order.
+	sessions []*TmuxSession
 
 	// Path to the directory holding static files
 	StaticFilesDir string
+
+	// Addresses to serve the panel on. Never empty after load.
+	Listeners []ListenerConfig
+	// Nullable, if no listener serves TLS.
+	TLS *TLSConfig
+
+	// Directory holding one subdirectory of backups per unit.
+	BackupDir string
+	// Nullable, if service output is not archived.
+	OutputLog *OutputLogPolicy
+
+	OnExit ExitAction
+	// How long each unit gets to stop gracefully under [ExitStopAll], before it is force killed.
+	OnExitTimeout time.Duration
 }
 
+// Hook up the session to the services that run in it, see [Unitv4Service.tmuxSession]. Windows of other services
+// found in it are left alone.
 func (cfg *UnitSystem) BindTmuxSession(ts *TmuxSession) {
-	ts.onProcSpawned = func(proc *TmuxProcess) {
-		tmuxName, _ := UndecorateTmuxName(proc.Name)
+	cfg.sessions = append(cfg.sessions, ts)
+	for _, serv := range cfg.tmuxNameLut {
+		if serv.tmuxSession == ts.Name {
+			serv.session = ts
+		}
+	}
+
+	serviceOf := func(windowName string) *Unitv4Service {
+		tmuxName, _ := UndecorateTmuxName(windowName)
 		serv := cfg.tmuxNameLut[tmuxName]
+		if serv == nil || serv.session != ts {
+			return nil
+		}
+		return serv
+	}
+	ts.keepDeadPanes = func(windowName string) bool {
+		serv := serviceOf(windowName)
+		return serv != nil && serv.keepDeadPanes
+	}
+	ts.onDeadPaneFound = func(proc *TmuxProcess) {
+		if serv := serviceOf(proc.Name); serv != nil {
+			serv.deadPanes = append(serv.deadPanes, proc)
+		}
+	}
+	ts.onDeadPaneGone = func(proc *TmuxProcess) {
+		serv := serviceOf(proc.Name)
+		if serv == nil {
+			return
+		}
+		for i, dead := range serv.deadPanes {
+			if dead == proc {
+				serv.deadPanes = append(serv.deadPanes[:i:i], serv.deadPanes[i+1:]...)
+				break
+			}
+		}
+	}
+	ts.onProcSpawned = func(proc *TmuxProcess) {
+		serv := serviceOf(proc.Name)
 		if serv == nil {
 			return
 		}
@@ -192,15 +479,34 @@ func (cfg *UnitSystem) BindTmuxSession(ts *TmuxSession) {
 				return
 			}
 		}
+		if len(serv.procs) == 0 {
+			serv.unhealthy = ""
+			serv.restartPending = ""
+			serv.lastStarted = time.Now()
+			ev := UnitEvent{Time: serv.lastStarted, Unit: serv.unit.Name, Kind: EventStart, Actor: cfg.actor}
+			if proc.Adopted {
+				ev.Kind = EventAdopt
+				ev.Actor = ""
+			}
+			cfg.emit(ev)
+		}
 		serv.procs = append(serv.procs, proc)
+
+		if cfg.OutputLog != nil && !proc.OutputPiped {
+			cfg.pipeOutput(ts, serv, proc)
+		}
 	}
 	ts.onProcPruned = func(proc *TmuxProcess) {
-		tmuxName, _ := UndecorateTmuxName(proc.Name)
-		serv := cfg.tmuxNameLut[tmuxName]
+		serv := serviceOf(proc.Name)
 		if serv == nil {
 			return
 		}
 
+		// Nobody wants to look at the remains of a service that was asked to stop
+		if proc.Exit != nil && serv.pendingStopReason != "" {
+			ts.KillDeadPane(proc)
+		}
+
 		idx := -1
 		for i, known := range serv.procs {
 			if proc == known {
@@ -215,20 +521,136 @@ func (cfg *UnitSystem) BindTmuxSession(ts *TmuxSession) {
 		lastIdx := len(serv.procs) - 1
 		serv.procs[idx] = serv.procs[lastIdx]
 		serv.procs = serv.procs[:lastIdx]
+		serv.orphans = append(serv.orphans, proc.Orphans...)
 		if len(serv.procs) == 0 {
 			serv.stoppingAttempt = time.Time{}
+			serv.lastStopped = time.Now()
+			serv.lastStopReason = serv.pendingStopReason
+			ev := UnitEvent{Time: serv.lastStopped, Unit: serv.unit.Name, Actor: serv.stopActor}
+			if proc.Exit != nil {
+				ev.Detail = proc.Exit.String()
+			}
+			if len(serv.orphans) > 0 {
+				if ev.Detail != "" {
+					ev.Detail += ", "
+				}
+				ev.Detail += "orphaned " + joinProcesses(serv.orphans)
+			}
+			if !serv.lastStarted.IsZero() {
+				ev.Duration = serv.lastStopped.Sub(serv.lastStarted)
+			}
+			switch serv.lastStopReason {
+			case stopReasonRequested:
+				ev.Kind = EventStop
+			case stopReasonForced:
+				ev.Kind = EventForceStop
+			default:
+				serv.lastStopReason = stopReasonExited
+				serv.crashes++
+				ev.Kind = EventCrash
+			}
+			serv.pendingStopReason = ""
+			serv.stopActor = ""
+			cfg.emit(ev)
+
+			if ev.Kind == EventCrash {
+				serv.noteCrash(cfg, ev.Time)
+			}
 		}
 	}
 }
 
-// Nullable
-func (cfg *UnitSystem) MatchByName(name string) *Unit {
-	// TODO better fuzzy matching algorithm; ideas:
-	// - case insensitive matching
-	// - whitespace/-/_ insensitive matching
-	// - allow unit names to be supplied as a regex, and return a list of candidates?
-	// - some kind of fuzzy scoring algorithm like fzf/sublime text's command palette
-	return cfg.unitsLut[name]
+// All units, ordered such that every unit comes after its requirements, i.e. the order to start them in.
+// Ties are broken by config order.
+func (cfg *UnitSystem) dependencyOrder() []*Unit {
+	visited := make(map[*Unit]bool)
+	order := make([]*Unit, 0, len(cfg.units))
+
+	var visit func(unit *Unit)
+	visit = func(unit *Unit) {
+		if unit == nil || visited[unit] {
+			return
+		}
+		visited[unit] = true
+		if grp, ok := unit.v.(*Unitv4Group); ok {
+			for _, req := range grp.requirements {
+				visit(req)
+			}
+		}
+		order = append(order, unit)
+	}
+
+	for _, unit := range cfg.units {
+		visit(unit)
+	}
+	return order
+}
+
+// The bound session named name, nil if there is none.
+func (cfg *UnitSystem) sessionNamed(name string) *TmuxSession {
+	for _, ts := range cfg.sessions {
+		if ts.Name == name {
+			return ts
+		}
+	}
+	return nil
+}
+
+// [TmuxSession.PollAndPrune] every session.
+// Must be called with modelLock held exclusively.
+func (cfg *UnitSystem) PollAndPrune() {
+	for _, ts := range cfg.sessions {
+		err := ts.PollAndPrune()
+		if err != nil {
+			fmt.Printf("[WARN] failed to poll tmux session %s: %s\n", ts.Name, err)
+		}
+	}
+}
+
+// Stop every running service one by one, in reverse dependency order, waiting for each to exit.
+// Services that don't exit within timeout are force killed.
+//
+// This drives [TmuxSession.PollAndPrune] itself, so nothing else should be polling the sessions at the same time.
+// Must be called with modelLock held exclusively. It is released while waiting, see [waitServiceStopped].
+func (cfg *UnitSystem) StopAll(timeout time.Duration) {
+	order := cfg.dependencyOrder()
+	for i := len(order) - 1; i >= 0; i-- {
+		unit := order[i]
+		serv, ok := unit.v.(*Unitv4Service)
+		if !ok || serv.status() == Stopped {
+			continue
+		}
+
+		fmt.Printf("stopping %s\n", unit.Name)
+		serv.stop()
+		if waitServiceStopped(serv, timeout) {
+			continue
+		}
+
+		fmt.Printf("[WARN] %s did not stop within %s, force killing\n", unit.Name, timeout)
+		serv.forceStop()
+		if !waitServiceStopped(serv, 5*time.Second) {
+			fmt.Printf("[ERROR] %s is still alive after force kill\n", unit.Name)
+		}
+	}
+}
+
+// Must be called with modelLock held exclusively. It is released between polls, so that whatever the stop is carried
+// out by in the background, like the waits of a stop sequence, gets to run.
+func waitServiceStopped(serv *Unitv4Service, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		serv.session.PollAndPrune()
+		if serv.status() == Stopped {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		modelLock.Unlock()
+		time.Sleep(500 * time.Millisecond)
+		modelLock.Lock()
+	}
 }
 
 func (cfg *UnitSystem) RunningServicesCount() int {
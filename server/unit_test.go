@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPruneOrphansReportsSurvivors(t *testing.T) {
+	self, err := trackProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	gone := self
+	gone.StartTime++
+
+	serv := &Unitv4Service{unit: &Unit{Name: "minecraft"}}
+	serv.orphans = []trackedProcess{self, gone}
+	serv.killed = []trackedProcess{self, gone}
+	serv.killedAt = time.Now()
+
+	// Still within processKillWait
+	serv.pruneOrphans()
+	if len(serv.orphans) != 1 || len(serv.killed) != 1 || len(serv.recentErrors) != 0 {
+		t.Fatalf("after pruneOrphans(): orphans = %v, killed = %v, errors = %v, want only %s left and no errors", serv.orphans, serv.killed, serv.recentErrors, self)
+	}
+
+	serv.killedAt = time.Now().Add(-2 * processKillWait)
+	serv.pruneOrphans()
+	if len(serv.recentErrors) != 1 || !strings.Contains(serv.recentErrors[0].Error(), "still running after SIGKILL: "+self.String()) {
+		t.Errorf("after processKillWait: errors = %v, want one naming %s", serv.recentErrors, self)
+	}
+	if len(serv.killed) != 0 {
+		t.Errorf("after processKillWait: killed = %v, want it reported only once", serv.killed)
+	}
+	if len(serv.orphans) != 1 {
+		t.Errorf("after processKillWait: orphans = %v, want %s still listed", serv.orphans, self)
+	}
+}
@@ -2,14 +2,22 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"net"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"regexp"
-
-	"github.com/pelletier/go-toml/v2"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
 )
 
 type configServiceUnit struct {
 	TmuxWindowName string
+	// Name of a [[Tmux.Sessions]] entry to run in. Empty for the default session.
+	TmuxSession string
 
 	/* case 1 */
 	/* union */
@@ -18,9 +26,77 @@ type configServiceUnit struct {
 	/* union */
 	StopInput  []string
 	StopScript []string
+	StopSignal string
+	// Escalation ladder, replacing all of the above, e.g. [{Input = ["stop", "Enter"]}, {Wait = "30s"}, {Signal = "SIGKILL"}]
+	StopSequence []configStopStep
+	// For StopSignal: "pane" (the default), "group" or "deepest", see [SignalTarget].
+	StopSignalTarget string
 
 	/* case 2 */
 	DontStarveTogether *SlfdrvDontStarveTogether
+	/* case 3 */
+	Factorio *SlfdrvFactorio
+	/* case 4 */
+	Terraria *SlfdrvTerraria
+	/* case 5 */
+	Valheim *SlfdrvValheim
+
+	BackupPaths []string
+	Backup      *configBackup `toml:",omitempty"`
+
+	DataPaths []string
+
+	// Checked before starting, see [PreStartChecks]. Ports are e.g. "25565", "25565/tcp" or "2456-2457/udp".
+	Ports         []string
+	LockFiles     []string
+	RequiredPaths []string
+
+	// Keep the tmux window around after the service exits, to see how it died.
+	KeepDeadPanes bool
+
+	LogRules []configLogRule
+}
+
+type configStopStep struct {
+	Input  []string
+	Signal string
+	Target string
+	Wait   string
+}
+
+type configLogRule struct {
+	// Defaults to the pattern
+	Name     string
+	Pattern  string
+	Actions  []string
+	Cooldown string
+}
+
+type configBackup struct {
+	Interval string
+
+	KeepHourly int
+	KeepDaily  int
+	KeepWeekly int
+
+	PreCommands     []string
+	PreCommandsWait string
+	PostCommands    []string
+
+	SkipWhenStopped bool
+}
+
+type configBackupGlobal struct {
+	Dir string
+}
+
+type configOutputLog struct {
+	// Empty to not archive service output.
+	Dir         string
+	MaxSizeMiB  int
+	RotateAfter string
+	KeepFiles   int
+	StripANSI   bool
 }
 
 type configGroupUnit struct {
@@ -34,6 +110,10 @@ type configUnit struct {
 	Description string
 	Styles      string
 
+	// Instantiate the [[Templates]] entry of this name, instead of defining Service or Target here.
+	Template string
+	Instance string
+
 	Hidden bool
 
 	/* union */
@@ -41,21 +121,112 @@ type configUnit struct {
 	Target  *configGroupUnit   `toml:",omitempty"`
 }
 
+type configListener struct {
+	Address string
+	Role    string
+
+	// Unix socket only
+	Mode  string
+	Owner string
+	Group string
+
+	TLS             bool
+	RedirectToHTTPS bool
+}
+
+type configTLS struct {
+	CertFile   string
+	KeyFile    string
+	SelfSigned bool
+	Hosts      []string
+	HSTSMaxAge string
+}
+
 type configWebServer struct {
 	StaticFilesDir string
+
+	Listeners []configListener
+	TLS       *configTLS `toml:",omitempty"`
 }
 
 type configTmux struct {
+	// Defaults to "tmux", looked up in PATH.
+	Executable string
+
+	// The default session, see [TmuxSessionConfig].
 	SessionName string
+	SocketName  string
+	SocketPath  string
+
+	// More sessions, e.g. on the tmux servers of other users, which units can pick with TmuxSession.
+	// SessionName defaults to the one above.
+	Sessions []TmuxSessionConfig
+}
+
+type configNotify struct {
+	Name string
+	Kind string
+
+	// Webhook URLs of Discord and Slack are tokens themselves, and others often carry one.
+	URL     string            `secret:"true"`
+	Headers map[string]string `secret:"true"`
+	Body    string
+	Command []string
+	Message string
+
+	Events []string
+	Units  []string
+
+	// Nil for the default, as 0 turns retrying off
+	MaxRetries   *int
+	MaxPerMinute int
+	Timeout      string
+
+	SMTP *configSMTP
+}
+
+type configSMTP struct {
+	Address  string
+	TLS      string
+	Username string
+	Password string `secret:"true"`
+	From     string
+	To       []string
+	Subject  string
+	// Defaults to 1m
+	DigestWindow   string
+	MaxDigestDelay string
+}
+
+// Contents of a file pulled in by [config.Include].
+type configInclude struct {
+	Units     []configUnit
+	Templates []configUnit
 }
 
 type config struct {
-	Web  configWebServer
-	Tmux configTmux
+	// Glob patterns of additional files to load units from.
+	Include []string
+
+	Web       configWebServer
+	Tmux      configTmux
+	Backup    configBackupGlobal
+	OutputLog configOutputLog
 
-	Units []configUnit
+	Units     []configUnit
+	Templates []configUnit
 
 	MaxRunningUnits int
+
+	OnExit        string
+	OnExitTimeout string
+
+	// Where to keep runtime state across restarts. Empty to not keep any.
+	StateFile string
+	// Where to keep the history of unit events. Empty to only keep it in memory.
+	HistoryFile string
+
+	Notify []configNotify
 }
 
 // NOTE: $ cannot be here even if tmux works with it, since it's used as the decoration delimiter
@@ -65,119 +236,913 @@ func sanitizeTmuxName(s string) string {
 	return sanitizer.ReplaceAllLiteralString(s, "_")
 }
 
+// Archives store each path under its base name, so those have to be unique.
+func checkArchivePaths(paths []string) error {
+	seen := make(map[string]bool)
+	for _, p := range paths {
+		base := filepath.Base(filepath.Clean(p))
+		if seen[base] {
+			return errors.New("more than one path named '" + base + "'")
+		}
+		seen[base] = true
+	}
+	return nil
+}
+
+// Nullable, if the unit doesn't do backups.
+func newBackupPolicy(cus *configServiceUnit) (*BackupPolicy, error) {
+	cb := cus.Backup
+	if cb == nil {
+		if len(cus.BackupPaths) > 0 {
+			return nil, errors.New("field BackupPaths is set, but there is no Backup section to configure the schedule")
+		}
+		return nil, nil
+	}
+	if len(cus.BackupPaths) == 0 {
+		return nil, errors.New("field BackupPaths cannot be empty if there is a Backup section")
+	}
+	if err := checkArchivePaths(cus.BackupPaths); err != nil {
+		return nil, fmt.Errorf("BackupPaths: %w", err)
+	}
+
+	bp := &BackupPolicy{
+		Paths:           cus.BackupPaths,
+		KeepHourly:      cb.KeepHourly,
+		KeepDaily:       cb.KeepDaily,
+		KeepWeekly:      cb.KeepWeekly,
+		PreCommands:     cb.PreCommands,
+		PostCommands:    cb.PostCommands,
+		PreCommandsWait: 5 * time.Second,
+		SkipWhenStopped: cb.SkipWhenStopped,
+	}
+
+	var err error
+	bp.Interval, err = time.ParseDuration(cb.Interval)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backup Interval: %w", err)
+	}
+	if bp.Interval < time.Minute {
+		return nil, errors.New("backup Interval must be at least 1m")
+	}
+	if len(cb.PreCommandsWait) > 0 {
+		bp.PreCommandsWait, err = time.ParseDuration(cb.PreCommandsWait)
+		if err != nil {
+			return nil, fmt.Errorf("invalid backup PreCommandsWait: %w", err)
+		}
+	}
+
+	return bp, nil
+}
+
+// Load the config file and validate it, see [loadConfig] for details.
+// Warnings are printed, and errors are returned as [*ConfigErrors].
 func NewUnitSystemFromConfig(configFile string) (*UnitSystem, error) {
-	f, err := os.Open(configFile)
+	res, problems := loadConfig(configFile)
+
+	var errs []ConfigProblem
+	for _, p := range problems {
+		if p.Warning {
+			fmt.Println("[WARN] " + p.String())
+		} else {
+			errs = append(errs, p)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, &ConfigErrors{Problems: errs}
+	}
+	return res, nil
+}
+
+// Load the config file, collecting every problem found along the way instead of stopping at the first one.
+// The returned [UnitSystem] is only usable if there are no problems other than warnings; it is nil if the file
+// couldn't be read or parsed at all.
+func loadConfig(configFile string) (*UnitSystem, []ConfigProblem) {
+	ck := &configChecker{file: configFile}
+
+	data, err := os.ReadFile(configFile)
 	if err != nil {
-		return nil, err
+		ck.errorf("%s", err)
+		return nil, ck.problems
 	}
 
 	cfg := config{
 		Tmux: configTmux{
+			Executable:  "tmux",
 			SessionName: "tmaxhoc-managed",
 		},
 		Web: configWebServer{
 			StaticFilesDir: "static",
 		},
+		Backup: configBackupGlobal{
+			Dir: "backups",
+		},
+		OutputLog: configOutputLog{
+			Dir:        "logs",
+			MaxSizeMiB: 10,
+			KeepFiles:  5,
+		},
 		MaxRunningUnits: 0,
+		StateFile:       "state.json",
+		HistoryFile:     "history.jsonl",
+	}
+	if !ck.decodeFile(configFile, data, &cfg) {
+		return nil, ck.problems
 	}
-	err = toml.NewDecoder(f).Decode(&cfg)
+	ck.addUnitOrigins(configFile, data, len(cfg.Units))
+
+	loadConfigIncludes(ck, configFile, &cfg)
+
+	rawConfig, err := cloneConfig(&cfg)
 	if err != nil {
-		return nil, err
+		ck.errorf("%s", err)
+		return nil, ck.problems
 	}
+	interpolateConfig(ck, configFile, &cfg)
 
 	res := &UnitSystem{
+		rawConfig: rawConfig,
+
 		units:       []*Unit{},
 		unitsLut:    make(map[string]*Unit),
 		tmuxNameLut: make(map[string]*Unitv4Service),
+		templates:   make(map[string]*configUnit),
 
 		MaxUnits: cfg.MaxRunningUnits,
 
-		SessionName: cfg.Tmux.SessionName,
+		TmuxExecutable: cfg.Tmux.Executable,
 
 		StaticFilesDir: cfg.Web.StaticFilesDir,
+
+		BackupDir: cfg.Backup.Dir,
+
+		StateFile:   cfg.StateFile,
+		HistoryFile: cfg.HistoryFile,
+	}
+
+	if fi, err := os.Stat(cfg.Web.StaticFilesDir); err != nil || !fi.IsDir() {
+		ck.errorf("StaticFilesDir '%s' is not a directory", cfg.Web.StaticFilesDir)
+	} else if _, err := os.Stat(filepath.Join(cfg.Web.StaticFilesDir, "index.html")); err != nil {
+		ck.errorf("StaticFilesDir '%s' doesn't contain index.html", cfg.Web.StaticFilesDir)
 	}
 
-	for _, cu := range cfg.Units {
+	loadWebConfig(ck, &cfg, res)
+	loadTmuxConfig(ck, &cfg, res)
+
+	// Before templates and units, which check that it is set for LogRules
+	if len(cfg.OutputLog.Dir) > 0 {
+		res.OutputLog = newOutputLogPolicy(ck, &cfg.OutputLog)
+	}
+
+	for i := range cfg.Templates {
+		tmpl := &cfg.Templates[i]
+		switch {
+		case len(tmpl.Name) == 0:
+			ck.errorf("field Name of template cannot be empty")
+		case res.templates[tmpl.Name] != nil:
+			ck.errorf("duplicate template name '%s'", tmpl.Name)
+		case tmpl.Service == nil || tmpl.Target != nil:
+			ck.errorf("template '%s' must have a Service section, and no Target section", tmpl.Name)
+		case len(tmpl.Template) > 0 || len(tmpl.Instance) > 0:
+			ck.errorf("template '%s' cannot itself be an instance of a template", tmpl.Name)
+		case len(tmpl.Service.LogRules) > 0 && res.OutputLog == nil:
+			ck.errorf("template '%s' has LogRules, which need OutputLog.Dir to be set", tmpl.Name)
+		default:
+			res.templates[tmpl.Name] = tmpl
+		}
+	}
+
+	switch cfg.OnExit {
+	case "leave-running", "":
+		res.OnExit = ExitLeaveRunning
+	case "stop-all":
+		res.OnExit = ExitStopAll
+	default:
+		ck.errorf("invalid OnExit '%s', accepted 'leave-running' or 'stop-all'", cfg.OnExit)
+	}
+	res.OnExitTimeout = 60 * time.Second
+	if len(cfg.OnExitTimeout) > 0 {
+		res.OnExitTimeout, err = time.ParseDuration(cfg.OnExitTimeout)
+		if err != nil {
+			ck.errorf("invalid OnExitTimeout: %s", err)
+		}
+	}
+
+	for i := range cfg.Units {
+		cu := &cfg.Units[i]
+		if len(cu.Template) > 0 {
+			tmpl := res.templates[cu.Template]
+			if tmpl == nil {
+				ck.forUnit(i, cu.Name).errorf("no template named '%s'", cu.Template)
+				continue
+			}
+			expanded, err := expandTemplate(tmpl, cu)
+			if err != nil {
+				ck.forUnit(i, cu.Name).errorf("%s", err)
+				continue
+			}
+			*cu = expanded
+		}
+
 		u := &Unit{
 			Name:        cu.Name,
 			Description: cu.Description,
 			Styles:      cu.Styles,
 			Hidden:      cu.Hidden,
+			Template:    cu.Template,
+			Instance:    cu.Instance,
+		}
+		uck := ck.forUnit(i, cu.Name)
+
+		if len(cu.Name) == 0 {
+			uck.errorf("field Name cannot be empty")
+		} else if _, exists := res.unitsLut[cu.Name]; exists {
+			uck.errorf("duplicate unit name")
 		}
 
-		if cu.Target != nil {
+		if cu.Target != nil && cu.Service != nil {
+			uck.errorf("unit cannot have both Service and Target section")
+			continue
+		} else if cu.Target != nil {
 			grp := &Unitv4Group{}
 			// requirements filled afterwards when the name LUT is fully built
 			cu.Target.linkedGroupUnit = grp
 			u.v = grp
 		} else if cu.Service != nil {
-			serv := &Unitv4Service{
-				TmuxName: cu.Service.TmuxWindowName,
+			serv := newServiceUnit(uck, cu)
+			if serv == nil {
+				continue
 			}
-
-			if len(cu.Service.TmuxWindowName) == 0 {
-				serv.TmuxName = sanitizeTmuxName(cu.Name)
+			if res.tmuxNameLut[serv.TmuxName] != nil {
+				uck.errorf("duplicate tmux window name '%s'! Possibly caused by generated from unit names that differ only in special non-alphanumeric characters.", serv.TmuxName)
 			}
-			_, exists := res.tmuxNameLut[serv.TmuxName]
-			if exists {
-				return nil, errors.New("Duplicate tmux window name '" + serv.TmuxName + "'! Possibly caused by generated from unit names that differ only in special non-alphanumeric characters.")
+			if len(serv.logRules) > 0 && res.OutputLog == nil {
+				uck.errorf("LogRules need OutputLog.Dir to be set, they are matched against the archived output")
+			}
+			if res.tmuxSessionConfig(serv.tmuxSession) == nil {
+				uck.errorf("no tmux session named '%s' in [[Tmux.Sessions]]", serv.tmuxSession)
 			}
 			res.tmuxNameLut[serv.TmuxName] = serv
+			serv.unit = u
+			u.v = serv
+		} else {
+			uck.errorf("unit must have either Service or Target section")
+			continue
+		}
 
-			if cusdst := cu.Service.DontStarveTogether; cusdst != nil {
-				if len(cusdst.GameInstall) == 0 {
-					return nil, errors.New("field GameInstall cannot be empty")
-				}
-				if len(cusdst.DataDir) == 0 {
-					return nil, errors.New("field DataDir cannot be empty")
-				}
-				if len(cusdst.Cluster) == 0 {
-					return nil, errors.New("field Cluster cannot be empty")
-				}
-				if len(cusdst.Shards) == 0 {
-					return nil, errors.New("field Shards cannot be empty")
-				}
-				drv := SlfdrvDontStarveTogether(*cusdst)
-				serv.lifecycleDriver = &drv
-			} else {
-				drv := &SlfdrvSimple{}
-				if len(cu.Service.StartScript) > 0 {
-					drv.Start = cu.Service.StartScript
-					drv.StartMode = ServiceScriptedStart
-				} else {
-					drv.Start = cu.Service.StartCommand
-					drv.StartMode = ServiceDirectStart
+		res.units = append(res.units, u)
+		if _, exists := res.unitsLut[u.Name]; !exists {
+			res.unitsLut[u.Name] = u
+		}
+	}
+
+	for i, cu := range cfg.Units {
+		if cu.Target == nil || cu.Target.linkedGroupUnit == nil {
+			continue
+		}
+		uck := ck.forUnit(i, cu.Name)
+
+		d := cu.Target.linkedGroupUnit
+		d.requirements = make([]*Unit, 0, len(cu.Target.Requires))
+		for _, subpartName := range cu.Target.Requires {
+			req := res.unitsLut[subpartName]
+			if req == nil {
+				uck.errorf("Requires names unit '%s', which doesn't exist", subpartName)
+				continue
+			}
+			d.requirements = append(d.requirements, req)
+		}
+	}
+
+	loadNotifyConfig(ck, &cfg, res)
+
+	for _, unit := range res.units {
+		if cycle := findRequirementCycle(unit); cycle != nil {
+			ck.errorf("units require each other in a cycle: %s", strings.Join(cycle, " -> "))
+			// One is enough, every unit on the cycle would report it again otherwise
+			break
+		}
+	}
+
+	return res, ck.problems
+}
+
+// Append the units of every file matched by the Include patterns to cfg.Units.
+// Patterns are relative to the directory of the main config file; files are read in the sorted order of their paths,
+// within each pattern.
+func loadConfigIncludes(ck *configChecker, configFile string, cfg *config) {
+	seen := make(map[string]bool)
+	for _, pattern := range cfg.Include {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(configFile), pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			ck.errorf("invalid Include pattern '%s': %s", pattern, err)
+			continue
+		}
+
+		for _, file := range matches {
+			if seen[file] {
+				continue
+			}
+			seen[file] = true
+
+			data, err := os.ReadFile(file)
+			if err != nil {
+				ck.add(ConfigProblem{File: file, Msg: err.Error()})
+				continue
+			}
+			var inc configInclude
+			if !ck.decodeFile(file, data, &inc) {
+				continue
+			}
+
+			ck.addUnitOrigins(file, data, len(inc.Units))
+			cfg.Units = append(cfg.Units, inc.Units...)
+			cfg.Templates = append(cfg.Templates, inc.Templates...)
+		}
+	}
+}
+
+func loadTmuxConfig(ck *configChecker, cfg *config, res *UnitSystem) {
+	exe, err := exec.LookPath(cfg.Tmux.Executable)
+	if err != nil {
+		ck.errorf("tmux executable: %s", err)
+	} else if abs, err := filepath.Abs(exe); err == nil {
+		// Handed to ctl attach, which neither reads the config nor runs in the same directory
+		res.TmuxExecutable = abs
+	}
+
+	res.TmuxSessions = append(res.TmuxSessions, TmuxSessionConfig{
+		Name:        defaultTmuxSession,
+		SessionName: cfg.Tmux.SessionName,
+		SocketName:  cfg.Tmux.SocketName,
+		SocketPath:  cfg.Tmux.SocketPath,
+	})
+	for _, conf := range cfg.Tmux.Sessions {
+		if len(conf.SessionName) == 0 {
+			conf.SessionName = cfg.Tmux.SessionName
+		}
+		switch {
+		case len(conf.Name) == 0:
+			ck.errorf("field Name of tmux session cannot be empty")
+		case res.tmuxSessionConfig(conf.Name) != nil:
+			ck.errorf("duplicate tmux session name '%s'", conf.Name)
+		default:
+			res.TmuxSessions = append(res.TmuxSessions, conf)
+		}
+	}
+
+	// LUT from the tmux server and session to the name of the config using it
+	seen := make(map[string]string)
+	for _, conf := range res.TmuxSessions {
+		if len(conf.SocketName) > 0 && len(conf.SocketPath) > 0 {
+			ck.errorf("tmux session '%s': only one of SocketName and SocketPath can be set", conf.Name)
+		}
+		if len(conf.SessionName) == 0 {
+			ck.errorf("tmux session '%s': SessionName cannot be empty", conf.Name)
+		}
+		key := conf.String()
+		if other, ok := seen[key]; ok {
+			// Both would adopt each other's windows
+			ck.errorf("tmux sessions '%s' and '%s' are the same session %s", other, conf.Name, key)
+		}
+		seen[key] = conf.Name
+	}
+}
+
+// Nil if there is no session config named name.
+func (cfg *UnitSystem) tmuxSessionConfig(name string) *TmuxSessionConfig {
+	for i := range cfg.TmuxSessions {
+		if cfg.TmuxSessions[i].Name == name {
+			return &cfg.TmuxSessions[i]
+		}
+	}
+	return nil
+}
+
+func loadWebConfig(ck *configChecker, cfg *config, res *UnitSystem) {
+	for _, cl := range cfg.Web.Listeners {
+		l := ListenerConfig{
+			Address:         cl.Address,
+			Owner:           cl.Owner,
+			Group:           cl.Group,
+			TLS:             cl.TLS,
+			RedirectToHTTPS: cl.RedirectToHTTPS,
+		}
+		if len(cl.Address) == 0 {
+			ck.errorf("field Address of listener cannot be empty")
+		}
+		if cl.TLS && cfg.Web.TLS == nil {
+			ck.errorf("listener '%s' has TLS enabled, but there is no [Web.TLS] section", cl.Address)
+		}
+		if cl.TLS && cl.RedirectToHTTPS {
+			ck.errorf("listener '%s' cannot both serve TLS and redirect to HTTPS", cl.Address)
+		}
+		var err error
+		l.Role, err = parseListenerRole(cl.Role)
+		if err != nil {
+			ck.errorf("%s", err)
+		}
+		if len(cl.Mode) > 0 {
+			mode, err := strconv.ParseUint(cl.Mode, 8, 32)
+			if err != nil {
+				ck.errorf("invalid listener socket mode '%s', expected octal like \"0660\"", cl.Mode)
+			}
+			l.Mode = os.FileMode(mode)
+		}
+		res.Listeners = append(res.Listeners, l)
+	}
+	if len(res.Listeners) == 0 {
+		res.Listeners = []ListenerConfig{defaultListener}
+	}
+
+	if ct := cfg.Web.TLS; ct != nil {
+		t := &TLSConfig{
+			CertFile:   ct.CertFile,
+			KeyFile:    ct.KeyFile,
+			SelfSigned: ct.SelfSigned,
+			Hosts:      ct.Hosts,
+		}
+		if ct.SelfSigned {
+			if len(t.CertFile) == 0 {
+				t.CertFile = "tls/cert.pem"
+			}
+			if len(t.KeyFile) == 0 {
+				t.KeyFile = "tls/key.pem"
+			}
+		}
+		if len(t.CertFile) == 0 || len(t.KeyFile) == 0 {
+			ck.errorf("fields CertFile and KeyFile cannot be empty, unless SelfSigned is set")
+		}
+		if len(ct.HSTSMaxAge) > 0 {
+			var err error
+			t.HSTSMaxAge, err = time.ParseDuration(ct.HSTSMaxAge)
+			if err != nil {
+				ck.errorf("invalid HSTSMaxAge: %s", err)
+			}
+		}
+		res.TLS = t
+	}
+}
+
+func loadNotifyConfig(ck *configChecker, cfg *config, res *UnitSystem) {
+	for i, cn := range cfg.Notify {
+		sink := &NotifySink{
+			Name:         cn.Name,
+			URL:          cn.URL,
+			Headers:      cn.Headers,
+			Command:      cn.Command,
+			MaxRetries:   3,
+			RetryBackoff: 1 * time.Second,
+			Timeout:      10 * time.Second,
+		}
+		if len(sink.Name) == 0 {
+			sink.Name = fmt.Sprintf("#%d", i+1)
+		}
+
+		var err error
+		sink.Kind, err = parseNotifyKind(cn.Kind)
+		if err != nil {
+			ck.errorf("notification sink %s: %s", sink.Name, err)
+		}
+		switch sink.Kind {
+		case NotifyExec:
+			if len(cn.Command) == 0 {
+				ck.errorf("notification sink %s: field Command cannot be empty", sink.Name)
+			}
+		case NotifySMTP:
+			sink.SMTP = newSMTPConfig(ck, sink.Name, cn.SMTP)
+		default:
+			if len(cn.URL) == 0 {
+				ck.errorf("notification sink %s: field URL cannot be empty", sink.Name)
+			}
+		}
+		if cn.SMTP != nil && sink.Kind != NotifySMTP {
+			ck.warnf("notification sink %s: section SMTP is only used by smtp sinks", sink.Name)
+		}
+
+		message := cn.Message
+		if len(message) == 0 {
+			message = defaultNotifyMessage
+		}
+		sink.Message, err = template.New("message").Parse(message)
+		if err != nil {
+			ck.errorf("notification sink %s: invalid Message template: %s", sink.Name, err)
+		}
+		body := cn.Body
+		if len(body) == 0 && sink.Kind == NotifySMTP {
+			body = defaultSMTPBody
+		}
+		if len(body) > 0 {
+			if sink.Kind != NotifyWebhook && sink.Kind != NotifySMTP {
+				ck.warnf("notification sink %s: field Body is only used by webhook and smtp sinks", sink.Name)
+			}
+			sink.Body, err = template.New("body").Parse(body)
+			if err != nil {
+				ck.errorf("notification sink %s: invalid Body template: %s", sink.Name, err)
+			}
+		}
+
+		events := cn.Events
+		if len(events) == 0 && sink.Kind == NotifySMTP {
+			// Nobody wants a mail every time a server is started
+			events = []string{string(EventCrash), string(EventRestartLoop), string(EventBackupFailed)}
+		}
+		if len(events) > 0 {
+			sink.Events = make(map[UnitEventKind]bool)
+			for _, e := range events {
+				switch kind := UnitEventKind(e); kind {
+				case EventStart, EventAdopt, EventStop, EventForceStop, EventCrash, EventRestartLoop, EventBackupFailed, EventLogMatch:
+					sink.Events[kind] = true
+				default:
+					ck.errorf("notification sink %s: unknown event '%s'", sink.Name, e)
 				}
-				if len(cu.Service.StopScript) > 0 {
-					drv.Stop = cu.Service.StopScript
-					drv.StopMode = ServiceScriptStop
-				} else {
-					drv.Stop = cu.Service.StopInput
-					drv.StopMode = ServiceInputStop
+			}
+		}
+		if len(cn.Units) > 0 {
+			sink.Units = make(map[string]bool)
+			for _, name := range cn.Units {
+				if res.unitsLut[name] == nil {
+					ck.warnf("notification sink %s: no unit named '%s' (yet)", sink.Name, name)
 				}
-				serv.lifecycleDriver = drv
+				sink.Units[name] = true
 			}
+		}
 
-			u.v = serv
+		if cn.MaxRetries != nil {
+			sink.MaxRetries = *cn.MaxRetries
+			if sink.MaxRetries < 0 {
+				ck.errorf("notification sink %s: MaxRetries cannot be negative", sink.Name)
+			}
+		}
+		perMinute := cn.MaxPerMinute
+		if perMinute <= 0 {
+			perMinute = 30
+		}
+		sink.MinInterval = time.Minute / time.Duration(perMinute)
+		if len(cn.Timeout) > 0 {
+			sink.Timeout, err = time.ParseDuration(cn.Timeout)
+			if err != nil {
+				ck.errorf("notification sink %s: invalid Timeout: %s", sink.Name, err)
+			}
+		}
+
+		res.NotifySinks = append(res.NotifySinks, sink)
+	}
+}
+
+func newOutputLogPolicy(ck *configChecker, col *configOutputLog) *OutputLogPolicy {
+	op := &OutputLogPolicy{
+		Dir:       col.Dir,
+		MaxSize:   int64(col.MaxSizeMiB) << 20,
+		KeepFiles: col.KeepFiles,
+		StripANSI: col.StripANSI,
+	}
+	if col.MaxSizeMiB <= 0 {
+		ck.errorf("OutputLog.MaxSizeMiB must be positive")
+	}
+	if col.KeepFiles < 0 {
+		ck.errorf("OutputLog.KeepFiles cannot be negative")
+	}
+	if len(col.RotateAfter) > 0 {
+		var err error
+		op.RotateAfter, err = time.ParseDuration(col.RotateAfter)
+		if err != nil {
+			ck.errorf("invalid OutputLog.RotateAfter: %s", err)
+		}
+	}
+	return op
+}
+
+// Nullable, if the section is missing.
+func newSMTPConfig(ck *configChecker, sinkName string, cs *configSMTP) *SMTPConfig {
+	if cs == nil {
+		ck.errorf("notification sink %s: section SMTP is required for smtp sinks", sinkName)
+		return nil
+	}
+	sc := &SMTPConfig{
+		Address:        cs.Address,
+		Username:       cs.Username,
+		Password:       cs.Password,
+		From:           cs.From,
+		To:             cs.To,
+		DigestWindow:   time.Minute,
+		MaxDigestDelay: time.Hour,
+	}
+
+	var err error
+	sc.TLS, err = parseSMTPTLSMode(cs.TLS)
+	if err != nil {
+		ck.errorf("notification sink %s: %s", sinkName, err)
+	}
+	if _, _, err := net.SplitHostPort(cs.Address); err != nil {
+		ck.errorf("notification sink %s: field SMTP.Address must be host:port: %s", sinkName, err)
+	}
+	if len(cs.From) == 0 {
+		ck.errorf("notification sink %s: field SMTP.From cannot be empty", sinkName)
+	}
+	if len(cs.To) == 0 {
+		ck.errorf("notification sink %s: field SMTP.To cannot be empty", sinkName)
+	}
+	if len(cs.Password) > 0 && len(cs.Username) == 0 {
+		ck.warnf("notification sink %s: field SMTP.Password is ignored without a Username", sinkName)
+	}
+
+	subject := cs.Subject
+	if len(subject) == 0 {
+		subject = defaultSMTPSubject
+	}
+	sc.Subject, err = template.New("subject").Parse(subject)
+	if err != nil {
+		ck.errorf("notification sink %s: invalid SMTP.Subject template: %s", sinkName, err)
+	}
+	if len(cs.DigestWindow) > 0 {
+		sc.DigestWindow, err = time.ParseDuration(cs.DigestWindow)
+		if err != nil {
+			ck.errorf("notification sink %s: invalid SMTP.DigestWindow: %s", sinkName, err)
+		}
+	}
+	if len(cs.MaxDigestDelay) > 0 {
+		sc.MaxDigestDelay, err = time.ParseDuration(cs.MaxDigestDelay)
+		if err != nil {
+			ck.errorf("notification sink %s: invalid SMTP.MaxDigestDelay: %s", sinkName, err)
+		}
+	}
+	if sc.MaxDigestDelay < sc.DigestWindow {
+		ck.warnf("notification sink %s: SMTP.MaxDigestDelay is shorter than DigestWindow, mail will be sent every %s while events keep coming", sinkName, sc.MaxDigestDelay)
+	}
+	return sc
+}
+
+// Nullable, if the unit is too broken to be constructed.
+func newServiceUnit(uck *configChecker, cu *configUnit) *Unitv4Service {
+	cus := cu.Service
+	serv := &Unitv4Service{
+		TmuxName:       cus.TmuxWindowName,
+		forceStopAfter: defaultForceStopAfter,
+	}
+
+	if len(cus.TmuxWindowName) == 0 {
+		serv.TmuxName = sanitizeTmuxName(cu.Name)
+	}
+
+	var games []string
+	if cus.DontStarveTogether != nil {
+		games = append(games, "DontStarveTogether")
+	}
+	if cus.Factorio != nil {
+		games = append(games, "Factorio")
+	}
+	if cus.Terraria != nil {
+		games = append(games, "Terraria")
+	}
+	if cus.Valheim != nil {
+		games = append(games, "Valheim")
+	}
+	if len(games) > 1 {
+		uck.errorf("only one of %s can be set", strings.Join(games, ", "))
+	}
+	hasStop := len(cus.StopInput) > 0 || len(cus.StopScript) > 0 || len(cus.StopSignal) > 0 || len(cus.StopSequence) > 0
+	if len(games) > 0 && (len(cus.StartCommand) > 0 || len(cus.StartScript) > 0 || hasStop) {
+		uck.warnf("Start*/Stop* fields are ignored for units with a %s section", games[0])
+	}
+
+	if cusdst := cus.DontStarveTogether; cusdst != nil {
+		if len(cusdst.GameInstall) == 0 {
+			uck.errorf("field GameInstall cannot be empty")
+		}
+		if len(cusdst.DataDir) == 0 {
+			uck.errorf("field DataDir cannot be empty")
+		}
+		if len(cusdst.Cluster) == 0 {
+			uck.errorf("field Cluster cannot be empty")
+		}
+		if len(cusdst.Shards) == 0 {
+			uck.errorf("field Shards cannot be empty")
+		}
+		drv := SlfdrvDontStarveTogether(*cusdst)
+		serv.lifecycleDriver = &drv
+	} else if cusf := cus.Factorio; cusf != nil {
+		if len(cusf.GameInstall) == 0 {
+			uck.errorf("field GameInstall cannot be empty")
+		}
+		if len(cusf.Save) == 0 && !cusf.LoadLatest {
+			uck.errorf("one of Save or LoadLatest must be set")
+		}
+		if cusf.RconPort != 0 && len(cusf.RconPassword) == 0 {
+			uck.errorf("field RconPassword cannot be empty when RconPort is set")
+		}
+		drv := *cusf
+		drv.state = &factorioState{}
+		serv.lifecycleDriver = &drv
+	} else if cust := cus.Terraria; cust != nil {
+		if len(cust.GameInstall) == 0 {
+			uck.errorf("field GameInstall cannot be empty")
+		}
+		if len(cust.Flavor) == 0 {
+			cust.Flavor = "vanilla"
+		}
+		if _, ok := terrariaExecutables[cust.Flavor]; !ok {
+			uck.errorf("unknown Terraria Flavor '%s', expected 'vanilla', 'tshock' or 'tmodloader'", cust.Flavor)
+		}
+		if len(cust.Config) == 0 {
+			uck.errorf("field Config cannot be empty")
+		}
+		drv := *cust
+		serv.lifecycleDriver = &drv
+	} else if cusv := cus.Valheim; cusv != nil {
+		if len(cusv.GameInstall) == 0 {
+			uck.errorf("field GameInstall cannot be empty")
+		}
+		if len(cusv.Name) == 0 {
+			uck.errorf("field Name cannot be empty")
+		}
+		if len(cusv.World) == 0 {
+			uck.errorf("field World cannot be empty")
+		}
+		if len(cusv.Password) > 0 && len(cusv.Password) < 5 {
+			uck.errorf("field Password must be at least 5 characters long")
+		}
+		if len(cusv.Password) > 0 && strings.Contains(cusv.Name, cusv.Password) {
+			uck.errorf("field Password cannot be part of Name")
+		}
+		drv := *cusv
+		serv.lifecycleDriver = &drv
+	} else {
+		drv := &SlfdrvSimple{}
+		if len(cus.StartScript) > 0 && len(cus.StartCommand) > 0 {
+			uck.errorf("only one of StartCommand and StartScript can be set")
+		}
+		if len(cus.StartScript) > 0 {
+			drv.Start = cus.StartScript
+			drv.StartMode = ServiceScriptedStart
 		} else {
-			return nil, errors.New("unit must have either Service or Target section")
+			drv.Start = cus.StartCommand
+			drv.StartMode = ServiceDirectStart
+		}
+		if len(drv.Start) == 0 || len(drv.Start[0]) == 0 {
+			uck.errorf("one of StartCommand or StartScript must be set, and not empty")
 		}
 
-		res.units = append(res.units, u)
-		res.unitsLut[u.Name] = u
+		var stops []string
+		if len(cus.StopInput) > 0 {
+			stops = append(stops, "StopInput")
+		}
+		if len(cus.StopScript) > 0 {
+			stops = append(stops, "StopScript")
+		}
+		if len(cus.StopSignal) > 0 {
+			stops = append(stops, "StopSignal")
+		}
+		if len(cus.StopSequence) > 0 {
+			stops = append(stops, "StopSequence")
+		}
+		if len(stops) > 1 {
+			uck.errorf("only one of %s can be set", strings.Join(stops, ", "))
+		}
+		if len(cus.StopSignalTarget) > 0 && len(cus.StopSignal) == 0 {
+			uck.warnf("field StopSignalTarget is ignored without a StopSignal")
+		}
+
+		switch {
+		case len(cus.StopScript) > 0:
+			drv.Stop = cus.StopScript
+			drv.StopMode = ServiceScriptStop
+			if len(drv.Stop[0]) == 0 {
+				uck.errorf("field StopScript cannot start with an empty path")
+			}
+		case len(cus.StopSignal) > 0:
+			drv.StopMode = ServiceSignalStop
+			var err error
+			drv.StopSignal, err = parseSignal(cus.StopSignal)
+			if err != nil {
+				uck.errorf("invalid StopSignal: %s", err)
+			}
+			drv.StopSignalTarget, err = parseSignalTarget(cus.StopSignalTarget)
+			if err != nil {
+				uck.errorf("invalid StopSignalTarget: %s", err)
+			}
+		case len(cus.StopSequence) > 0:
+			drv.StopMode = ServiceSequenceStop
+			drv.StopSequence = newStopSequence(uck, cus.StopSequence)
+			// Even a sequence without waits gets some time to work
+			serv.forceStopAfter = max(stopSequenceDuration(drv.StopSequence), defaultForceStopAfter)
+		default:
+			drv.Stop = cus.StopInput
+			drv.StopMode = ServiceInputStop
+			if len(drv.Stop) == 0 {
+				uck.warnf("none of StopInput, StopScript, StopSignal or StopSequence is set, the unit can only be force stopped")
+			}
+		}
+		serv.lifecycleDriver = drv
 	}
 
-	for _, cu := range cfg.Units {
-		if cu.Target == nil {
+	var err error
+	serv.backup, err = newBackupPolicy(cus)
+	if err != nil {
+		uck.errorf("%s", err)
+	}
+
+	err = checkArchivePaths(cus.DataPaths)
+	if err != nil {
+		uck.errorf("DataPaths: %s", err)
+	}
+	serv.dataPaths = cus.DataPaths
+	serv.keepDeadPanes = cus.KeepDeadPanes
+	serv.tmuxSession = cus.TmuxSession
+	if len(serv.tmuxSession) == 0 {
+		serv.tmuxSession = defaultTmuxSession
+	}
+	for _, p := range cus.Ports {
+		ps, err := parsePortSpec(p)
+		if err != nil {
+			uck.errorf("%s", err)
 			continue
 		}
+		serv.preStart.Ports = append(serv.preStart.Ports, ps)
+	}
+	serv.preStart.LockFiles = cus.LockFiles
+	serv.preStart.RequiredPaths = cus.RequiredPaths
+	serv.logRules = newLogRules(uck, cus.LogRules)
 
-		d := cu.Target.linkedGroupUnit
-		d.requirements = make([]*Unit, len(cu.Target.Requires))
-		for i, subpartName := range cu.Target.Requires {
-			d.requirements[i] = res.unitsLut[subpartName]
+	return serv
+}
+
+func newStopSequence(uck *configChecker, csss []configStopStep) []StopStep {
+	var res []StopStep
+	for i, css := range csss {
+		var step StopStep
+		var err error
+		kinds := 0
+		if len(css.Input) > 0 {
+			kinds++
+			step.Input = css.Input
+		}
+		if len(css.Signal) > 0 {
+			kinds++
+			step.Signal, err = parseSignal(css.Signal)
+			if err != nil {
+				uck.errorf("StopSequence step %d: %s", i+1, err)
+			}
+			step.Target, err = parseSignalTarget(css.Target)
+			if err != nil {
+				uck.errorf("StopSequence step %d: %s", i+1, err)
+			}
+		} else if len(css.Target) > 0 {
+			uck.warnf("StopSequence step %d: Target is ignored without a Signal", i+1)
 		}
+		if len(css.Wait) > 0 {
+			kinds++
+			step.Wait, err = time.ParseDuration(css.Wait)
+			if err != nil {
+				uck.errorf("StopSequence step %d: invalid Wait: %s", i+1, err)
+			} else if step.Wait <= 0 {
+				uck.errorf("StopSequence step %d: Wait must be positive", i+1)
+			}
+		}
+		if kinds != 1 {
+			uck.errorf("StopSequence step %d: exactly one of Input, Signal and Wait must be set", i+1)
+		}
+		res = append(res, step)
 	}
+	return res
+}
 
-	return res, nil
+func newLogRules(uck *configChecker, clrs []configLogRule) []*LogRule {
+	var res []*LogRule
+	names := make(map[string]bool)
+	for _, clr := range clrs {
+		rule := &LogRule{Name: clr.Name}
+		if len(rule.Name) == 0 {
+			rule.Name = clr.Pattern
+		}
+		if names[rule.Name] {
+			uck.errorf("duplicate log rule name '%s'", rule.Name)
+		}
+		names[rule.Name] = true
+
+		var err error
+		if len(clr.Pattern) == 0 {
+			uck.errorf("log rule %s: field Pattern cannot be empty", rule.Name)
+		} else if rule.Pattern, err = regexp.Compile(clr.Pattern); err != nil {
+			uck.errorf("log rule %s: invalid Pattern: %s", rule.Name, err)
+		}
+		for _, a := range clr.Actions {
+			action, err := parseLogRuleAction(a)
+			if err != nil {
+				uck.errorf("log rule %s: %s", rule.Name, err)
+				continue
+			}
+			rule.Actions = append(rule.Actions, action)
+		}
+		if len(clr.Cooldown) > 0 {
+			rule.Cooldown, err = time.ParseDuration(clr.Cooldown)
+			if err != nil {
+				uck.errorf("log rule %s: invalid Cooldown: %s", rule.Name, err)
+			}
+		}
+		res = append(res, rule)
+	}
+	return res
 }
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestNewStopSequence(t *testing.T) {
+	ck := &configChecker{file: "test.toml"}
+	got := newStopSequence(ck, []configStopStep{
+		{Input: []string{"stop", "Enter"}},
+		{Wait: "30s"},
+		{Signal: "TERM", Target: "group"},
+		{Wait: "10s"},
+		{Signal: "SIGKILL"},
+	})
+	want := []StopStep{
+		{Input: []string{"stop", "Enter"}},
+		{Wait: 30 * time.Second},
+		{Signal: syscall.SIGTERM, Target: SignalGroup},
+		{Wait: 10 * time.Second},
+		{Signal: syscall.SIGKILL, Target: SignalPane},
+	}
+	if len(ck.problems) > 0 {
+		t.Errorf("newStopSequence() reported %v", ck.problems)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("newStopSequence() = %+v, want %+v", got, want)
+	}
+
+	invalid := []struct {
+		name string
+		step configStopStep
+		// Whether the only problem is a warning
+		warning bool
+	}{
+		{name: "empty step", step: configStopStep{}},
+		{name: "input and signal", step: configStopStep{Input: []string{"stop"}, Signal: "TERM"}},
+		{name: "signal and wait", step: configStopStep{Signal: "TERM", Wait: "5s"}},
+		{name: "unknown signal", step: configStopStep{Signal: "FOO"}},
+		{name: "unknown target", step: configStopStep{Signal: "TERM", Target: "everything"}},
+		{name: "invalid wait", step: configStopStep{Wait: "soon"}},
+		{name: "negative wait", step: configStopStep{Wait: "-5s"}},
+		{name: "target without signal", step: configStopStep{Input: []string{"stop"}, Target: "group"}, warning: true},
+	}
+	for _, tt := range invalid {
+		ck := &configChecker{file: "test.toml"}
+		newStopSequence(ck, []configStopStep{tt.step})
+		switch {
+		case len(ck.problems) == 0:
+			t.Errorf("%s: newStopSequence() reported no problems", tt.name)
+		case tt.warning && (len(ck.problems) != 1 || !ck.problems[0].Warning):
+			t.Errorf("%s: newStopSequence() reported %v, want a single warning", tt.name, ck.problems)
+		case !tt.warning && ck.problems[0].Warning:
+			t.Errorf("%s: newStopSequence() reported %v, want an error", tt.name, ck.problems)
+		}
+	}
+}
+
+func TestLoadConfigTemplateLogRules(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.toml")
+	err := os.WriteFile(configFile, []byte(`
+StateFile = ""
+HistoryFile = ""
+[Web]
+StaticFilesDir = "../static"
+[OutputLog]
+Dir = "`+filepath.Join(dir, "logs")+`"
+
+[[Templates]]
+Name = "dst@"
+[Templates.Service]
+StartCommand = ["sleep", "600"]
+[[Templates.Service.LogRules]]
+Name = "desync"
+Pattern = "Desync detected"
+
+[[Units]]
+Template = "dst@"
+Instance = "caves"
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, problems := loadConfig(configFile)
+	for _, p := range problems {
+		if !p.Warning {
+			t.Errorf("loadConfig() reported %s", p)
+		}
+	}
+	if res == nil {
+		t.FailNow()
+	}
+	unit, err := res.MatchByName("dst@caves")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rules := unit.v.(*Unitv4Service).logRules; len(rules) != 1 || rules[0].Name != "desync" {
+		t.Errorf("logRules = %+v, want desync", rules)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Failures of starting and stopping services, kept with the service so that they can be seen on the panel instead of
+// only in the panel's own output.
+
+// How many [unitError]s each service keeps.
+const unitErrorsKept = 10
+
+// An external command that failed, along with what it had to say about it.
+type commandError struct {
+	// e.g. "tmux new-window"
+	Command string
+	Err     error
+	// What it printed (usually on stderr), trimmed. May be empty.
+	Output string
+}
+
+func (e *commandError) Error() string {
+	if len(e.Output) == 0 {
+		return e.Command + ": " + e.Err.Error()
+	}
+	return e.Command + ": " + e.Err.Error() + ": " + e.Output
+}
+
+func (e *commandError) Unwrap() error {
+	return e.Err
+}
+
+// Wrap err from running a command with [exec.Cmd.Output], which keeps the stderr of failed commands around.
+func newCommandError(command string, err error) error {
+	ce := &commandError{Command: command, Err: err}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		ce.Output = strings.TrimSpace(string(exitErr.Stderr))
+	}
+	return ce
+}
+
+// A failed start or stop of a service.
+type unitError struct {
+	Time time.Time `json:"time"`
+	Unit string    `json:"unit"`
+	// "start", "stop" or "force stop"
+	Action string `json:"action"`
+	// One per thing that went wrong, e.g. per shard of a DST cluster, or per check before starting.
+	Problems []string `json:"problems"`
+
+	err error
+}
+
+func (e *unitError) Error() string {
+	return fmt.Sprintf("failed to %s %s: %s", e.Action, e.Unit, strings.Join(e.Problems, "; "))
+}
+
+func (e *unitError) Unwrap() error {
+	return e.err
+}
+
+// Split err into the problems it is made of, see [unitError.Problems].
+func errorProblems(err error) []string {
+	switch e := err.(type) {
+	case interface{ Unwrap() []error }:
+		var res []string
+		for _, inner := range e.Unwrap() {
+			res = append(res, errorProblems(inner)...)
+		}
+		return res
+	case *preStartError:
+		return e.problems
+	}
+	return []string{err.Error()}
+}
+
+// Record that action failed with err, and return the [unitError] describing it. Nil if err is.
+// Must be called with modelLock held exclusively.
+func (serv *Unitv4Service) noteError(action string, err error) error {
+	if err == nil {
+		return nil
+	}
+	ue := &unitError{Time: time.Now(), Unit: serv.unit.Name, Action: action, Problems: errorProblems(err), err: err}
+	fmt.Printf("[WARN] %s\n", ue)
+
+	serv.recentErrors = append(serv.recentErrors, *ue)
+	if len(serv.recentErrors) > unitErrorsKept {
+		serv.recentErrors = serv.recentErrors[len(serv.recentErrors)-unitErrorsKept:]
+	}
+	return ue
+}
+
+// Every [unitError] in err, which may be joined from those of several services.
+func unitErrorsOf(err error) []unitError {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		var res []unitError
+		for _, inner := range joined.Unwrap() {
+			res = append(res, unitErrorsOf(inner)...)
+		}
+		return res
+	}
+	var ue *unitError
+	if errors.As(err, &ue) {
+		return []unitError{*ue}
+	}
+	return nil
+}
+
+// Cookie carrying a [flashMessage] to the next render of the frontpage.
+const flashCookie = "tmaxhoc-flash"
+
+// Shown once at the top of the frontpage, after e.g. a unit failed to start.
+type flashMessage struct {
+	Lines []string `json:"lines"`
+	// Page with the details, empty if there is none.
+	URL string `json:"url,omitempty"`
+}
+
+// Cookies can't be much bigger than 4 KiB, so don't let a chatty start script take all of it.
+const flashMaxLines = 10
+const flashMaxLineLength = 300
+
+func setFlash(w http.ResponseWriter, flash flashMessage) {
+	if len(flash.Lines) > flashMaxLines {
+		flash.Lines = append(flash.Lines[:flashMaxLines-1], "...")
+	}
+	for i, line := range flash.Lines {
+		if len(line) > flashMaxLineLength {
+			flash.Lines[i] = line[:flashMaxLineLength] + "..."
+		}
+	}
+	value, _ := json.Marshal(flash)
+	http.SetCookie(w, &http.Cookie{
+		Name:     flashCookie,
+		Value:    base64.RawURLEncoding.EncodeToString(value),
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// The flash message set by the previous response, if any, which is then cleared.
+func takeFlash(w http.ResponseWriter, req *http.Request) *flashMessage {
+	cookie, err := req.Cookie(flashCookie)
+	if err != nil {
+		return nil
+	}
+	http.SetCookie(w, &http.Cookie{Name: flashCookie, Path: "/", MaxAge: -1})
+
+	value, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil {
+		return nil
+	}
+	var flash flashMessage
+	if json.Unmarshal(value, &flash) != nil || len(flash.Lines) == 0 {
+		return nil
+	}
+	return &flash
+}
+
+// Response body of a unit action that failed, when requested with `Accept: application/json`.
+type apiActionError struct {
+	// Canonical name of the unit that the action was applied to, see [apiResult].
+	Unit  string `json:"unit"`
+	Error string `json:"error"`
+	// What went wrong with each service involved. Empty if the action failed before getting to any.
+	Failures []unitError `json:"failures,omitempty"`
+}
+
+// Finish a failed unit action: API clients get the error as JSON, browsers are sent back to the panel, which shows it.
+func respondFailed(w http.ResponseWriter, req *http.Request, unit *Unit, code int, err error) {
+	failures := unitErrorsOf(err)
+	if wantsJSON(req) {
+		writeJSON(w, code, apiActionError{Unit: unit.Name, Error: err.Error(), Failures: failures})
+		return
+	}
+
+	flash := flashMessage{Lines: []string{err.Error()}}
+	if len(failures) > 0 {
+		flash.Lines = nil
+		for _, ue := range failures {
+			flash.Lines = append(flash.Lines, fmt.Sprintf("Failed to %s %s:", ue.Action, ue.Unit))
+			flash.Lines = append(flash.Lines, ue.Problems...)
+		}
+	}
+	if _, ok := unit.v.(*Unitv4Service); ok {
+		flash.URL = unitPageURL(unit) + "#errors"
+	}
+	setFlash(w, flash)
+	http.Redirect(w, req, "/", http.StatusFound)
+}
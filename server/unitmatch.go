@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// How a unit name matched a query, from worst to best.
+// Candidates in a better tier always outrank those in a worse tier, regardless of [UnitMatch.Score].
+type UnitMatchTier int
+
+const (
+	// Query characters appear in order in the name, e.g. "dstc" for "DST Caves"
+	MatchSubsequence UnitMatchTier = iota
+	// Query is a regex written as /.../ and it matches the name
+	MatchRegex
+	// Query is contained in the name, ignoring case, whitespace, '-' and '_'
+	MatchSubstring
+	// Name starts with the query, ignoring case, whitespace, '-' and '_'
+	MatchPrefix
+	// Query and name are equal ignoring case, whitespace, '-' and '_'
+	MatchNormalized
+	MatchExact
+)
+
+type UnitMatch struct {
+	Unit *Unit
+	Tier UnitMatchTier
+	// Fzf-like quality of the match within its tier, higher is better. Only set for the prefix, substring and
+	// subsequence tiers.
+	Score int
+}
+
+// How much better than the runner-up of its tier a match has to score, for [UnitSystem.MatchByName] to pick it.
+const matchScoreMargin = 8
+
+// Returned by [UnitSystem.MatchByName] when no unit matches the query.
+type NoSuchUnitError struct {
+	Query string
+}
+
+func (e *NoSuchUnitError) Error() string {
+	return "no such unit: " + e.Query
+}
+
+// Returned by [UnitSystem.MatchByName] when the query is matched equally well by more than one unit.
+type AmbiguousUnitError struct {
+	Query      string
+	Candidates []string
+}
+
+func (e *AmbiguousUnitError) Error() string {
+	return fmt.Sprintf("unit name '%s' is ambiguous, candidates: %s", e.Query, strings.Join(e.Candidates, ", "))
+}
+
+func isNameSeparator(r rune) bool {
+	return unicode.IsSpace(r) || r == '-' || r == '_'
+}
+
+// Lowercase, and remove everything that [isNameSeparator].
+func normalizeUnitName(s string) string {
+	var sb strings.Builder
+	for _, r := range s {
+		if isNameSeparator(r) {
+			continue
+		}
+		sb.WriteRune(unicode.ToLower(r))
+	}
+	return sb.String()
+}
+
+// Score how well the (normalized) query matches name as a subsequence, in the spirit of fzf.
+// Returns false if it doesn't match at all.
+func fuzzyScore(name string, normQuery string) (int, bool) {
+	const (
+		scoreMatch       = 16
+		bonusBoundary    = 8
+		bonusConsecutive = 8
+		penaltyGap       = 1
+	)
+
+	query := []rune(normQuery)
+	if len(query) == 0 {
+		return 0, false
+	}
+
+	score := 0
+	qi := 0
+	prev := rune(0)
+	prevMatched := false
+	started := false
+	for i, r := range []rune(name) {
+		if qi == len(query) {
+			break
+		}
+		if isNameSeparator(r) {
+			prev = r
+			continue
+		}
+
+		if unicode.ToLower(r) == query[qi] {
+			score += scoreMatch
+			if i == 0 || isNameSeparator(prev) || (unicode.IsUpper(r) && unicode.IsLower(prev)) {
+				score += bonusBoundary
+			}
+			if prevMatched {
+				score += bonusConsecutive
+			}
+			qi++
+			prevMatched = true
+			started = true
+		} else {
+			if started {
+				score -= penaltyGap
+			}
+			prevMatched = false
+		}
+		prev = r
+	}
+
+	if qi < len(query) {
+		return 0, false
+	}
+	return score, true
+}
+
+// Find all units matching the query, best match first.
+//
+// A query written as /.../ is treated as a regex, and selects every unit whose name it matches. Otherwise, the query
+// is compared against unit names exactly, then ignoring case, whitespace, '-' and '_', and finally as a fuzzy
+// subsequence.
+func (cfg *UnitSystem) MatchUnits(query string) ([]UnitMatch, error) {
+	cfg.unitsLock.RLock()
+	defer cfg.unitsLock.RUnlock()
+
+	var res []UnitMatch
+
+	if len(query) >= 2 && strings.HasPrefix(query, "/") && strings.HasSuffix(query, "/") {
+		re, err := regexp.Compile(query[1 : len(query)-1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid unit name regex: %w", err)
+		}
+		for _, unit := range cfg.units {
+			if re.MatchString(unit.Name) {
+				res = append(res, UnitMatch{Unit: unit, Tier: MatchRegex})
+			}
+		}
+		return res, nil
+	}
+
+	normQuery := normalizeUnitName(query)
+	for _, unit := range cfg.units {
+		normName := normalizeUnitName(unit.Name)
+		m := UnitMatch{Unit: unit}
+		switch {
+		case unit.Name == query:
+			m.Tier = MatchExact
+		case normName == normQuery:
+			m.Tier = MatchNormalized
+		case normQuery != "" && strings.HasPrefix(normName, normQuery):
+			m.Tier = MatchPrefix
+			m.Score, _ = fuzzyScore(unit.Name, normQuery)
+		case normQuery != "" && strings.Contains(normName, normQuery):
+			m.Tier = MatchSubstring
+			m.Score, _ = fuzzyScore(unit.Name, normQuery)
+		default:
+			score, ok := fuzzyScore(unit.Name, normQuery)
+			if !ok {
+				continue
+			}
+			m.Tier = MatchSubsequence
+			m.Score = score
+		}
+		res = append(res, m)
+	}
+
+	// Stable, so that equally good matches stay in config order
+	sort.SliceStable(res, func(i, j int) bool {
+		if res[i].Tier != res[j].Tier {
+			return res[i].Tier > res[j].Tier
+		}
+		return res[i].Score > res[j].Score
+	})
+	return res, nil
+}
+
+// Resolve a user supplied name to exactly one unit, see [UnitSystem.MatchUnits] for the accepted syntax.
+//
+// Returns [*NoSuchUnitError] if nothing matches, or [*AmbiguousUnitError] if the best match doesn't outscore the others
+// of its tier by [matchScoreMargin]. An exact match always wins.
+func (cfg *UnitSystem) MatchByName(name string) (*Unit, error) {
+	cfg.unitsLock.RLock()
+	unit := cfg.unitsLut[name]
+	cfg.unitsLock.RUnlock()
+	if unit != nil {
+		return unit, nil
+	}
+
+	candidates, err := cfg.MatchUnits(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(candidates) == 0 {
+		return nil, &NoSuchUnitError{Query: name}
+	}
+
+	best := candidates[0]
+	tooClose := func(c UnitMatch) bool {
+		return c.Tier == best.Tier && best.Score-c.Score < matchScoreMargin
+	}
+	if len(candidates) > 1 && tooClose(candidates[1]) {
+		ambig := &AmbiguousUnitError{Query: name}
+		for _, c := range candidates {
+			if !tooClose(c) {
+				break
+			}
+			ambig.Candidates = append(ambig.Candidates, c.Unit.Name)
+		}
+		return nil, ambig
+	}
+	return best.Unit, nil
+}
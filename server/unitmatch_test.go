@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func testUnitSystem(names ...string) *UnitSystem {
+	cfg := &UnitSystem{unitsLut: make(map[string]*Unit)}
+	for _, name := range names {
+		unit := &Unit{Name: name}
+		cfg.units = append(cfg.units, unit)
+		cfg.unitsLut[name] = unit
+	}
+	return cfg
+}
+
+func TestNormalizeUnitName(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"Minecraft", "minecraft"},
+		{"DST Caves", "dstcaves"},
+		{"minecraft-modded_1", "minecraftmodded1"},
+		{" \t", ""},
+	}
+	for _, tt := range tests {
+		if got := normalizeUnitName(tt.in); got != tt.want {
+			t.Errorf("normalizeUnitName(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestFuzzyScore(t *testing.T) {
+	tests := []struct {
+		name, query string
+		ok          bool
+	}{
+		{"DST Caves", "dstc", true},
+		{"DST Caves", "dc", true},
+		{"DST Caves", "cd", false},
+		{"DST Caves", "dstcavess", false},
+		{"Factorio", "", false},
+	}
+	for _, tt := range tests {
+		if _, ok := fuzzyScore(tt.name, tt.query); ok != tt.ok {
+			t.Errorf("fuzzyScore(%q, %q) matched = %v, want %v", tt.name, tt.query, ok, tt.ok)
+		}
+	}
+
+	// Pairs of (name, query), the first scoring higher than the second
+	better := []struct {
+		name1, query1, name2, query2 string
+	}{
+		// Word boundaries
+		{"Minecraft Server", "ms", "Mimosa", "ms"},
+		// camelCase boundaries
+		{"MyServer", "ms", "Mimosa", "ms"},
+		// Consecutive characters
+		{"Factorio", "fac", "Fxaxc", "fac"},
+		// Fewer gaps
+		{"abc", "ac", "abbbbc", "ac"},
+	}
+	for _, tt := range better {
+		s1, _ := fuzzyScore(tt.name1, tt.query1)
+		s2, _ := fuzzyScore(tt.name2, tt.query2)
+		if s1 <= s2 {
+			t.Errorf("fuzzyScore(%q, %q) = %d, want more than fuzzyScore(%q, %q) = %d", tt.name1, tt.query1, s1, tt.name2, tt.query2, s2)
+		}
+	}
+}
+
+func TestMatchUnits(t *testing.T) {
+	cfg := testUnitSystem("Minecraft", "minecraft-modded", "DST Master", "DST Caves", "Factorio")
+
+	tests := []struct {
+		query string
+		// Names of the matches, best first
+		want []string
+		// Tier of the best match
+		tier UnitMatchTier
+	}{
+		{"Minecraft", []string{"Minecraft", "minecraft-modded"}, MatchExact},
+		{"minecraft", []string{"Minecraft", "minecraft-modded"}, MatchNormalized},
+		{"MINECRAFT MODDED", []string{"minecraft-modded"}, MatchNormalized},
+		{"dst", []string{"DST Master", "DST Caves"}, MatchPrefix},
+		{"caves", []string{"DST Caves"}, MatchSubstring},
+		{"fcto", []string{"Factorio"}, MatchSubsequence},
+		{"/^DST/", []string{"DST Master", "DST Caves"}, MatchRegex},
+		{"/o$/", []string{"Factorio"}, MatchRegex},
+		{"zzz", nil, 0},
+	}
+	for _, tt := range tests {
+		matches, err := cfg.MatchUnits(tt.query)
+		if err != nil {
+			t.Errorf("MatchUnits(%q): %s", tt.query, err)
+			continue
+		}
+		var got []string
+		for _, m := range matches {
+			got = append(got, m.Unit.Name)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("MatchUnits(%q) = %q, want %q", tt.query, got, tt.want)
+			continue
+		}
+		if len(matches) > 0 && matches[0].Tier != tt.tier {
+			t.Errorf("MatchUnits(%q) best tier = %d, want %d", tt.query, matches[0].Tier, tt.tier)
+		}
+	}
+
+	if _, err := cfg.MatchUnits("/[/"); err == nil {
+		t.Errorf("MatchUnits with an invalid regex succeeded")
+	}
+}
+
+func TestMatchByName(t *testing.T) {
+	cfg := testUnitSystem("Minecraft", "minecraft-modded", "DST Master", "DST Caves", "Factorio", "Fancy Cat Toy", "Terraria", "Terra Firma")
+
+	tests := []struct {
+		query string
+		// Empty if the match should fail
+		want string
+		// Candidates reported for an ambiguous query
+		ambiguous []string
+	}{
+		{query: "Minecraft", want: "Minecraft"},
+		{query: "minecraft", want: "Minecraft"},
+		{query: "fac", want: "Factorio"},
+		{query: "caves", want: "DST Caves"},
+		{query: "dst", ambiguous: []string{"DST Master", "DST Caves"}},
+		// Both subsequences, but one is much tighter
+		{query: "fcto", want: "Factorio"},
+		// Both prefixes, and too close to call
+		{query: "terra", ambiguous: []string{"Terraria", "Terra Firma"}},
+		{query: "nope"},
+	}
+	for _, tt := range tests {
+		unit, err := cfg.MatchByName(tt.query)
+		switch {
+		case tt.want != "":
+			if err != nil || unit.Name != tt.want {
+				t.Errorf("MatchByName(%q) = %v, %v, want %s", tt.query, unit, err, tt.want)
+			}
+		case tt.ambiguous != nil:
+			var ambig *AmbiguousUnitError
+			if !errors.As(err, &ambig) || !slices.Equal(ambig.Candidates, tt.ambiguous) {
+				t.Errorf("MatchByName(%q) = %v, %v, want ambiguous between %q", tt.query, unit, err, tt.ambiguous)
+			}
+		default:
+			var noSuch *NoSuchUnitError
+			if !errors.As(err, &noSuch) {
+				t.Errorf("MatchByName(%q) = %v, %v, want no such unit", tt.query, unit, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// Replaced by the instance name in every string of a template.
+const instancePlaceholder = "{instance}"
+
+// Instance names end up in tmux window names and shell commands, so keep them boring.
+var instanceNameRegex = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// Make the config of a unit instantiating tmpl, as requested by cu (which has Template and Instance set).
+// Name, Description and Styles of cu override those of the template, if set.
+func expandTemplate(tmpl *configUnit, cu *configUnit) (configUnit, error) {
+	if cu.Service != nil || cu.Target != nil {
+		return configUnit{}, errors.New("unit instantiating a template cannot have its own Service or Target section")
+	}
+	if !instanceNameRegex.MatchString(cu.Instance) {
+		return configUnit{}, fmt.Errorf("invalid instance name '%s', must be letters, digits, '_', '.' and '-'", cu.Instance)
+	}
+
+	// Deep copy, so that instances don't share slices with the template or each other
+	copied, err := cloneConfig(tmpl)
+	if err != nil {
+		return configUnit{}, err
+	}
+	res := *copied
+	mapConfigStrings(reflect.ValueOf(&res).Elem(), func(s string) string {
+		return strings.ReplaceAll(s, instancePlaceholder, cu.Instance)
+	})
+
+	res.Template = tmpl.Name
+	res.Instance = cu.Instance
+	res.Name = tmpl.Name + cu.Instance
+	if len(cu.Name) > 0 {
+		res.Name = cu.Name
+	}
+	if len(cu.Description) > 0 {
+		res.Description = cu.Description
+	}
+	if len(cu.Styles) > 0 {
+		res.Styles = cu.Styles
+	}
+	res.Hidden = res.Hidden || cu.Hidden
+	return res, nil
+}
+
+// Create a new service unit from a template while the panel is running. The unit lasts until it is removed with
+// [UnitSystem.RemoveInstance], and is recreated from the state file after a restart.
+// Must be called with modelLock held.
+func (cfg *UnitSystem) InstantiateTemplate(templateName string, instance string) (*Unit, error) {
+	tmpl := cfg.templates[templateName]
+	if tmpl == nil {
+		return nil, errors.New("no template named '" + templateName + "'")
+	}
+	cu, err := expandTemplate(tmpl, &configUnit{Template: templateName, Instance: instance})
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.unitsLut[cu.Name] != nil {
+		return nil, fmt.Errorf("unit '%s' already exists", cu.Name)
+	}
+	ck := &configChecker{file: "template '" + templateName + "'"}
+	serv := newServiceUnit(ck.forUnit(0, cu.Name), &cu)
+	for _, p := range ck.problems {
+		if !p.Warning {
+			return nil, errors.New(p.String())
+		}
+	}
+	if serv == nil {
+		return nil, errors.New("template '" + templateName + "' cannot be instantiated")
+	}
+	if cfg.tmuxNameLut[serv.TmuxName] != nil {
+		return nil, fmt.Errorf("tmux window name '%s' is already used by another unit", serv.TmuxName)
+	}
+	serv.session = cfg.sessionNamed(serv.tmuxSession)
+	if serv.session == nil {
+		return nil, fmt.Errorf("no tmux session named '%s'", serv.tmuxSession)
+	}
+
+	unit := &Unit{
+		Name:            cu.Name,
+		Description:     cu.Description,
+		Styles:          cu.Styles,
+		Hidden:          cu.Hidden,
+		Template:        cu.Template,
+		Instance:        cu.Instance,
+		runtimeInstance: true,
+		v:               serv,
+	}
+	serv.unit = unit
+
+	cfg.unitsLock.Lock()
+	cfg.units = append(cfg.units, unit)
+	cfg.unitsLut[unit.Name] = unit
+	cfg.tmuxNameLut[serv.TmuxName] = serv
+	cfg.unitsLock.Unlock()
+
+	fmt.Printf("instantiated template %s as %s\n", templateName, unit.Name)
+	return unit, nil
+}
+
+// Remove a unit created by [UnitSystem.InstantiateTemplate]. It must be stopped.
+// Must be called with modelLock held.
+func (cfg *UnitSystem) RemoveInstance(unit *Unit) error {
+	if !unit.runtimeInstance {
+		return errors.New("unit '" + unit.Name + "' is defined in the config file, and cannot be removed")
+	}
+	if unit.v.status() != Stopped {
+		return errors.New("unit '" + unit.Name + "' must be stopped before it can be removed")
+	}
+	for _, other := range cfg.units {
+		if grp, ok := other.v.(*Unitv4Group); ok {
+			for _, req := range grp.requirements {
+				if req == unit {
+					return errors.New("unit '" + unit.Name + "' is required by '" + other.Name + "'")
+				}
+			}
+		}
+	}
+
+	serv := unit.v.(*Unitv4Service)
+	serv.dismissDeadPanes()
+
+	cfg.unitsLock.Lock()
+	defer cfg.unitsLock.Unlock()
+	for i, u := range cfg.units {
+		if u == unit {
+			cfg.units = append(cfg.units[:i:i], cfg.units[i+1:]...)
+			break
+		}
+	}
+	delete(cfg.unitsLut, unit.Name)
+	if cfg.tmuxNameLut[serv.TmuxName] == serv {
+		delete(cfg.tmuxNameLut, serv.TmuxName)
+	}
+
+	fmt.Printf("removed instance %s\n", unit.Name)
+	return nil
+}
+
+// POST /api/instantiate-unit with template=<name>&instance=<name>
+func apiInstantiateUnit(w http.ResponseWriter, req *http.Request) {
+	templateName := req.FormValue("template")
+	fmt.Printf("got /api/instantiate-unit for template=%s instance=%s\n", templateName, req.FormValue("instance"))
+	if unitsys.templates[templateName] == nil {
+		http.Error(w, "no template named '"+templateName+"'", http.StatusNotFound)
+		return
+	}
+
+	modelLock.Lock()
+	unit, err := unitsys.InstantiateTemplate(templateName, req.FormValue("instance"))
+	unitsys.saveState()
+	modelLock.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	respondDone(w, req, unit)
+}
+
+// POST /api/remove-instance with unit=<name>
+func apiRemoveInstance(w http.ResponseWriter, req *http.Request) {
+	fmt.Printf("got /api/remove-instance for unit=%s\n", req.FormValue("unit"))
+	unit := resolveUnitParam(w, req)
+	if unit == nil {
+		return
+	}
+
+	modelLock.Lock()
+	err := unitsys.RemoveInstance(unit)
+	unitsys.saveState()
+	modelLock.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	respondDone(w, req, unit)
+}